@@ -0,0 +1,396 @@
+package main
+
+import (
+	"breathaipay/database"
+	"breathaipay/fulfillment"
+	"breathaipay/money"
+	"breathaipay/payments"
+	"breathaipay/refunds"
+	"breathaipay/sites"
+	"breathaipay/subscriptions"
+	"breathaipay/vouchers"
+
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 后台每页展示的条数, 订单页会逐条查询支付方的状态, 不宜过大
+const adminPageSize = 20
+
+// adminOrderRow 后台订单列表中的一行
+type adminOrderRow struct {
+	database.Order
+	PaymentStatus string // 支付方返回的原始状态
+}
+
+// adminSubscriptionRow 后台订阅列表中的一行
+type adminSubscriptionRow struct {
+	database.Subscription
+	PlanName string
+}
+
+// adminCustomerRow 后台客户列表中的一行, 附带已支付的订单
+type adminCustomerRow struct {
+	database.Customer
+	Orders []database.Order
+}
+
+// registerAdminRoutes 注册后台路由, 使用HTTP Basic认证
+// 浏览器会自动带上Basic认证, 所有POST请求都要求来自本站页面
+func registerAdminRoutes(r *gin.Engine, username string, password string) {
+	admin := r.Group("/admin", gin.BasicAuth(gin.Accounts{username: password}), sameOrigin)
+
+	admin.GET("", func(c *gin.Context) {
+		c.Redirect(http.StatusFound, "/admin/orders")
+	})
+	admin.GET("/orders", adminOrdersHandler)
+	admin.GET("/customers", adminCustomersHandler)
+	admin.POST("/orders/:id/refund", adminRefundHandler)
+	admin.POST("/orders/:id/fulfill", adminFulfillHandler)
+	admin.GET("/orders/:id/events", adminOrderEventsHandler)
+	admin.GET("/ledger", adminLedgerHandler)
+	admin.GET("/vouchers", adminVouchersHandler)
+	admin.POST("/vouchers", adminGenerateVouchersHandler)
+	admin.POST("/vouchers/:code/disable", adminDisableVoucherHandler)
+	admin.GET("/subscriptions", adminSubscriptionsHandler)
+	admin.POST("/subscriptions/:id/cancel", adminSubscriptionActionHandler(subscriptions.Cancel))
+	admin.POST("/subscriptions/:id/resume", adminSubscriptionActionHandler(subscriptions.Resume))
+}
+
+// adminOrderEventsHandler 订单的状态变更记录
+func adminOrderEventsHandler(c *gin.Context) {
+	orderID := c.Param("id")
+	events, err := database.ListOrderEvents(orderID)
+	if err != nil {
+		log.Printf("查询订单状态变更记录失败 (%s): %v", orderID, err)
+		c.String(http.StatusInternalServerError, "查询订单状态变更记录失败")
+		return
+	}
+
+	c.HTML(http.StatusOK, "admin_order_events.html", gin.H{
+		"OrderID": orderID,
+		"Events":  events,
+	})
+}
+
+// adminLedgerHandler 积分流水, 可按邮箱、订单号或OpenWebUI用户ID查询积分是否到账
+func adminLedgerHandler(c *gin.Context) {
+	page := adminPage(c)
+	entries, err := database.ListLedgerEntries(database.LedgerFilter{
+		OrderID:         c.Query("order"),
+		OpenWebUIUserID: c.Query("user"),
+		Email:           c.Query("email"),
+		Limit:           adminPageSize,
+		Offset:          (page - 1) * adminPageSize,
+	})
+	if err != nil {
+		log.Printf("查询积分流水失败: %v", err)
+		c.String(http.StatusInternalServerError, "查询积分流水失败")
+		return
+	}
+
+	c.HTML(http.StatusOK, "admin_ledger.html", gin.H{
+		"Entries":  entries,
+		"Query":    c.Request.URL.Query(),
+		"Page":     page,
+		"PrevPage": adminPageURL(c, page-1),
+		"NextPage": adminPageURL(c, page+1),
+		"HasNext":  len(entries) == adminPageSize,
+	})
+}
+
+// adminVouchersHandler 兑换码列表, 可按状态筛选
+func adminVouchersHandler(c *gin.Context) {
+	renderAdminVouchers(c, nil, "")
+}
+
+// adminGenerateVouchersHandler 批量生成兑换码, 生成的兑换码只在本次页面中完整展示一次以便复制
+func adminGenerateVouchersHandler(c *gin.Context) {
+	count, _ := strconv.Atoi(c.PostForm("count"))
+	points, _ := strconv.ParseInt(c.PostForm("points"), 10, 64)
+	var expiresAt time.Time
+	if date := c.PostForm("expires"); date != "" {
+		// 过期日期按本地时区解析, 当天仍然可以兑换
+		day, err := time.ParseInLocation("2006-01-02", date, time.Local)
+		if err != nil {
+			renderAdminVouchers(c, nil, "过期日期无效")
+			return
+		}
+		expiresAt = day.AddDate(0, 0, 1)
+	}
+
+	codes, err := vouchers.Generate(count, points, c.PostForm("site"), expiresAt, c.PostForm("note"))
+	if err != nil {
+		log.Printf("生成兑换码失败: %v", err)
+		renderAdminVouchers(c, nil, "生成兑换码失败: "+err.Error())
+		return
+	}
+	log.Printf("已生成 %d 个兑换码 (站点 %s, 每个 %d 积分)", len(codes), c.PostForm("site"), points)
+	renderAdminVouchers(c, codes, "")
+}
+
+// adminDisableVoucherHandler 作废尚未兑换的兑换码
+func adminDisableVoucherHandler(c *gin.Context) {
+	code := c.Param("code")
+	disabled, err := database.DisableVoucher(code)
+	if err != nil {
+		log.Printf("作废兑换码失败 (%s): %v", code, err)
+		c.String(http.StatusInternalServerError, "作废兑换码失败")
+		return
+	}
+	if !disabled {
+		c.String(http.StatusConflict, "兑换码不存在或已被使用")
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/admin/vouchers")
+}
+
+// renderAdminVouchers 展示兑换码列表, generated为刚生成的兑换码
+func renderAdminVouchers(c *gin.Context, generated []string, message string) {
+	page := adminPage(c)
+	list, err := database.ListVouchers(c.Query("status"), adminPageSize, (page-1)*adminPageSize)
+	if err != nil {
+		log.Printf("查询兑换码失败: %v", err)
+		c.String(http.StatusInternalServerError, "查询兑换码失败")
+		return
+	}
+
+	c.HTML(http.StatusOK, "admin_vouchers.html", gin.H{
+		"Vouchers":  list,
+		"Generated": generated,
+		"Error":     message,
+		"Sites":     sites.Enabled(),
+		"Statuses": []string{database.VoucherStatusActive, database.VoucherStatusRedeeming,
+			database.VoucherStatusRedeemed, database.VoucherStatusDisabled},
+		"Query":    c.Request.URL.Query(),
+		"Page":     page,
+		"PrevPage": adminPageURL(c, page-1),
+		"NextPage": adminPageURL(c, page+1),
+		"HasNext":  len(list) == adminPageSize,
+	})
+}
+
+// adminSubscriptionsHandler 订阅列表, 可按邮箱筛选
+func adminSubscriptionsHandler(c *gin.Context) {
+	page := adminPage(c)
+	list, err := database.ListSubscriptions(c.Query("email"), adminPageSize, (page-1)*adminPageSize)
+	if err != nil {
+		log.Printf("查询订阅失败: %v", err)
+		c.String(http.StatusInternalServerError, "查询订阅失败")
+		return
+	}
+
+	rows := make([]adminSubscriptionRow, len(list))
+	planNames := make(map[int]string)
+	for i, sub := range list {
+		rows[i].Subscription = sub
+		if _, ok := planNames[sub.PlanID]; !ok {
+			plan, err := database.GetSubscriptionPlan(sub.PlanID)
+			if err != nil {
+				log.Printf("获取订阅套餐失败 (%d): %v", sub.PlanID, err)
+			}
+			planNames[sub.PlanID] = plan.Name
+		}
+		rows[i].PlanName = planNames[sub.PlanID]
+	}
+
+	c.HTML(http.StatusOK, "admin_subscriptions.html", gin.H{
+		"Subscriptions": rows,
+		"Query":         c.Request.URL.Query(),
+		"Page":          page,
+		"PrevPage":      adminPageURL(c, page-1),
+		"NextPage":      adminPageURL(c, page+1),
+		"HasNext":       len(list) == adminPageSize,
+	})
+}
+
+// adminSubscriptionActionHandler 在周期结束时取消订阅或撤销取消
+func adminSubscriptionActionHandler(action func(id string) (subscriptions.Subscription, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		if _, err := action(id); err != nil {
+			log.Printf("修改订阅失败 (%s): %v", id, err)
+			c.String(http.StatusInternalServerError, "修改订阅失败: %v", err)
+			return
+		}
+		c.Redirect(http.StatusSeeOther, "/admin/subscriptions")
+	}
+}
+
+// adminRefundHandler 发起退款并扣回对应比例的积分, 金额为空时全额退款
+func adminRefundHandler(c *gin.Context) {
+	orderID := c.Param("id")
+	var amount money.Money
+	if amountStr := c.PostForm("amount"); amountStr != "" {
+		// 按订单币种解析, 小数位数超过币种允许的位数时拒绝, 不做取整
+		order, err := database.GetOrder(orderID)
+		if err != nil {
+			log.Printf("获取订单失败 (%s): %v", orderID, err)
+			c.String(http.StatusNotFound, "订单不存在")
+			return
+		}
+		amount, err = money.Parse(amountStr, order.Amount.Currency)
+		if err != nil || !amount.IsPositive() {
+			c.String(http.StatusBadRequest, "退款金额无效")
+			return
+		}
+	}
+
+	if err := refunds.Create(orderID, amount); err != nil {
+		log.Printf("退款失败 (%s): %v", orderID, err)
+		c.String(http.StatusInternalServerError, "退款失败: %v", err)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/admin/orders")
+}
+
+// adminFulfillHandler 管理员核对支付金额不一致的订单后, 按订单记录的积分发放
+func adminFulfillHandler(c *gin.Context) {
+	orderID := c.Param("id")
+	order, err := database.GetOrder(orderID)
+	if err != nil {
+		log.Printf("获取订单失败 (%s): %v", orderID, err)
+		c.String(http.StatusNotFound, "订单不存在")
+		return
+	}
+	if order.Status != database.OrderAmountMismatch {
+		c.String(http.StatusConflict, "只能发放支付金额不一致的订单")
+		return
+	}
+
+	// 不再核对金额, 由管理员确认
+	queued, err := fulfillment.Enqueue(orderID, order.Email, order.SiteType, order.Points, money.Money{}, database.OrderActorAdmin)
+	if err != nil {
+		log.Printf("发放订单失败 (%s): %v", orderID, err)
+		c.String(http.StatusInternalServerError, "发放失败: %v", err)
+		return
+	}
+	if !queued {
+		c.String(http.StatusConflict, "订单状态已变化, 请刷新后重试")
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/admin/orders")
+}
+
+// adminOrdersHandler 订单列表, 支持按状态、邮箱、站点和日期筛选
+func adminOrdersHandler(c *gin.Context) {
+	page := adminPage(c)
+	filter := database.OrderFilter{
+		Status:   c.Query("status"),
+		Email:    c.Query("email"),
+		SiteType: c.Query("site"),
+		Limit:    adminPageSize,
+		Offset:   (page - 1) * adminPageSize,
+	}
+	// 日期按本地时区解析, 结束日期包含当天
+	if from, err := time.ParseInLocation("2006-01-02", c.Query("from"), time.Local); err == nil {
+		filter.From = from
+	}
+	if to, err := time.ParseInLocation("2006-01-02", c.Query("to"), time.Local); err == nil {
+		filter.To = to.AddDate(0, 0, 1)
+	}
+
+	orders, err := database.ListOrders(filter)
+	if err != nil {
+		log.Printf("查询订单失败: %v", err)
+		c.String(http.StatusInternalServerError, "查询订单失败")
+		return
+	}
+	statuses, err := database.ListOrderStatuses()
+	if err != nil {
+		log.Printf("查询订单状态失败: %v", err)
+	}
+
+	// 并发查询每个订单在支付方的状态, 未支付订单的邮箱和站点也从元数据中补全
+	rows := make([]adminOrderRow, len(orders))
+	var wg sync.WaitGroup
+	for i, order := range orders {
+		rows[i].Order = order
+		wg.Add(1)
+		go func(row *adminOrderRow) {
+			defer wg.Done()
+			provider, err := payments.For(row.Provider)
+			var p payments.Payment
+			if err == nil {
+				p, err = provider.Get(row.OrderID)
+			}
+			if err != nil {
+				log.Printf("获取支付状态失败 (%s): %v", row.OrderID, err)
+				row.PaymentStatus = "查询失败"
+				return
+			}
+			row.PaymentStatus = p.RawStatus
+			if row.Email == "" {
+				row.Email = p.Metadata["email"]
+			}
+			if row.SiteType == "" {
+				row.SiteType = p.Metadata["sitetype"]
+			}
+		}(&rows[i])
+	}
+	wg.Wait()
+
+	c.HTML(http.StatusOK, "admin_orders.html", gin.H{
+		"Orders":   rows,
+		"Statuses": statuses,
+		"Query":    c.Request.URL.Query(),
+		"Page":     page,
+		"PrevPage": adminPageURL(c, page-1),
+		"NextPage": adminPageURL(c, page+1),
+		"HasNext":  len(orders) == adminPageSize,
+	})
+}
+
+// adminCustomersHandler 客户列表及其购买记录
+func adminCustomersHandler(c *gin.Context) {
+	page := adminPage(c)
+	customers, err := database.ListCustomers(c.Query("email"), adminPageSize, (page-1)*adminPageSize)
+	if err != nil {
+		log.Printf("查询客户失败: %v", err)
+		c.String(http.StatusInternalServerError, "查询客户失败")
+		return
+	}
+
+	rows := make([]adminCustomerRow, len(customers))
+	for i, customer := range customers {
+		rows[i].Customer = customer
+		rows[i].Orders, err = database.ListOrders(database.OrderFilter{Email: customer.Email, Limit: 100})
+		if err != nil {
+			log.Printf("查询客户订单失败 (%s): %v", customer.Email, err)
+		}
+	}
+
+	c.HTML(http.StatusOK, "admin_customers.html", gin.H{
+		"Customers": rows,
+		"Query":     c.Request.URL.Query(),
+		"Page":      page,
+		"PrevPage":  adminPageURL(c, page-1),
+		"NextPage":  adminPageURL(c, page+1),
+		"HasNext":   len(customers) == adminPageSize,
+	})
+}
+
+// adminPage 从查询参数中获取页码, 最小为1
+func adminPage(c *gin.Context) int {
+	page, err := strconv.Atoi(c.Query("page"))
+	if err != nil || page < 1 {
+		return 1
+	}
+	return page
+}
+
+// adminPageURL 保留当前筛选条件生成翻页链接
+func adminPageURL(c *gin.Context, page int) string {
+	query := url.Values{}
+	for key, values := range c.Request.URL.Query() {
+		query[key] = values
+	}
+	query.Set("page", strconv.Itoa(page))
+	return c.Request.URL.Path + "?" + query.Encode()
+}
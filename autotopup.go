@@ -0,0 +1,177 @@
+package main
+
+import (
+	"breathaipay/autotopup"
+	"breathaipay/cards"
+	"breathaipay/catalog"
+	"breathaipay/database"
+	"breathaipay/sites"
+
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// autoTopupView 页面上展示的自动充值设置
+type autoTopupView struct {
+	database.AutoTopup
+	SiteName    string
+	ProductName string
+	Token       string // 管理链接的签名
+}
+
+// newAutoTopupView 补充站点和商品的展示名称
+func newAutoTopupView(t database.AutoTopup) autoTopupView {
+	view := autoTopupView{AutoTopup: t, SiteName: siteName(t.SiteType), Token: autotopup.ManageToken(t.ID)}
+	if product, err := database.GetProduct(t.ProductID); err == nil {
+		view.ProductName = product.Name
+	} else {
+		view.ProductName = strconv.Itoa(t.ProductID)
+	}
+	return view
+}
+
+// autoTopupViews 查询邮箱的所有自动充值设置
+func autoTopupViews(email string) []autoTopupView {
+	list, err := database.ListAutoTopups(email)
+	if err != nil {
+		log.Printf("查询自动充值设置失败 (%s): %v", email, err)
+	}
+	views := make([]autoTopupView, 0, len(list))
+	for _, t := range list {
+		views = append(views, newAutoTopupView(t))
+	}
+	return views
+}
+
+// quickAutoTopupHandler 在一键购买页面使用已保存的卡片开启自动充值, 成功后跳转到管理页
+func quickAutoTopupHandler(c *gin.Context) {
+	session := sessionFromForm(c)
+	customerID, ok := quickSession(c, session)
+	if !ok {
+		return
+	}
+
+	t, message := readAutoTopupForm(c, session.Email, customerID)
+	if message != "" {
+		renderQuickBuy(c, session, message)
+		return
+	}
+	id, err := database.SaveAutoTopup(t)
+	if err != nil {
+		log.Printf("保存自动充值设置失败 (%s): %v", session.Email, err)
+		renderQuickBuy(c, session, "保存自动充值设置失败，请稍后再试。")
+		return
+	}
+	log.Printf("%s 在%s开启了自动充值: 余额低于 %d 时购买商品 %d", t.Email, t.SiteType, t.Threshold, t.ProductID)
+	c.Redirect(http.StatusSeeOther, "/auto-topup?id="+strconv.Itoa(id)+"&token="+autotopup.ManageToken(id))
+}
+
+// readAutoTopupForm 读取并校验自动充值表单
+// 校验失败时返回展示给用户的提示
+func readAutoTopupForm(c *gin.Context, email string, customerID string) (database.AutoTopup, string) {
+	t := database.AutoTopup{Email: email, CustomerID: customerID}
+	card, err := cards.Get(customerID, c.PostForm("paymentMethod"))
+	if err != nil {
+		if !errors.Is(err, cards.ErrNotFound) {
+			log.Printf("获取卡片失败 (%s): %v", c.PostForm("paymentMethod"), err)
+		}
+		return t, "请选择一张已保存的卡片。"
+	}
+	t.PaymentMethodID = card.ID
+
+	site, ok := sites.GetEnabled(c.PostForm("siteType"))
+	if !ok {
+		return t, "无效的站点"
+	}
+	t.SiteType = site.Key
+	productID, _ := strconv.Atoi(c.PostForm("productID"))
+	if _, err := catalog.Get(productID, site.Key); err != nil {
+		return t, "该商品在所选站点不可购买"
+	}
+	t.ProductID = productID
+	if t.Threshold, err = strconv.ParseInt(c.PostForm("threshold"), 10, 64); err != nil || t.Threshold < 1 {
+		return t, "无效的余额阈值"
+	}
+	if t.DailyLimit, err = strconv.Atoi(c.PostForm("dailyLimit")); err != nil || t.DailyLimit < 1 || t.DailyLimit > autotopup.MaxDailyLimit() {
+		return t, "每日最多充值次数需要在1到" + strconv.Itoa(autotopup.MaxDailyLimit()) + "之间"
+	}
+	if _, err := findOpenWebUIUser(email, site); err != nil {
+		return t, accountErrorMessage(err, site)
+	}
+	return t, ""
+}
+
+// autoTopupPageHandler 通过签名链接查看自动充值设置
+func autoTopupPageHandler(c *gin.Context) {
+	t, ok := manageableAutoTopup(c, c.Query("id"), c.Query("token"))
+	if !ok {
+		return
+	}
+	renderAutoTopup(c, t, "")
+}
+
+// autoTopupActionHandler 通过签名链接关闭或重新开启自动充值
+func autoTopupActionHandler(c *gin.Context) {
+	t, ok := manageableAutoTopup(c, c.PostForm("id"), c.PostForm("token"))
+	if !ok {
+		return
+	}
+
+	var enabled bool
+	switch c.PostForm("action") {
+	case "disable":
+		enabled = false
+	case "enable":
+		// 卡片可能在关闭期间被移除, 重新开启前确认卡片仍然可用
+		if _, err := cards.Get(t.CustomerID, t.PaymentMethodID); err != nil {
+			if !errors.Is(err, cards.ErrNotFound) {
+				log.Printf("获取卡片失败 (%s): %v", t.PaymentMethodID, err)
+				renderAutoTopup(c, t, "暂时无法确认卡片状态，请稍后再试。")
+				return
+			}
+			renderAutoTopup(c, t, "所选卡片已被移除，请通过一键购买重新设置自动充值。")
+			return
+		}
+		enabled = true
+	default:
+		c.String(http.StatusBadRequest, "无效的操作")
+		return
+	}
+	if err := database.SetAutoTopupEnabled(t.ID, enabled, ""); err != nil {
+		log.Printf("修改自动充值设置失败 (%d): %v", t.ID, err)
+		renderAutoTopup(c, t, "暂时无法修改自动充值，请稍后再试。")
+		return
+	}
+	log.Printf("用户修改了自动充值 %d: %s", t.ID, c.PostForm("action"))
+	t.Enabled = enabled
+	t.LastError = ""
+	renderAutoTopup(c, t, "")
+}
+
+// manageableAutoTopup 校验管理链接并读取设置, 失败时已经写入响应
+func manageableAutoTopup(c *gin.Context, id string, token string) (database.AutoTopup, bool) {
+	topupID, _ := strconv.Atoi(id)
+	if !autotopup.VerifyManageToken(topupID, token) {
+		c.String(http.StatusForbidden, "链接无效")
+		return database.AutoTopup{}, false
+	}
+	t, err := database.GetAutoTopup(topupID)
+	if err != nil {
+		log.Printf("获取自动充值设置失败 (%d): %v", topupID, err)
+		c.String(http.StatusNotFound, "自动充值设置不存在")
+		return database.AutoTopup{}, false
+	}
+	return t, true
+}
+
+// renderAutoTopup 展示自动充值设置及关闭、开启按钮
+func renderAutoTopup(c *gin.Context, t database.AutoTopup, message string) {
+	c.HTML(http.StatusOK, "auto_topup.html", gin.H{
+		"AutoTopup": newAutoTopupView(t),
+		"Error":     message,
+	})
+}
@@ -0,0 +1,281 @@
+package autotopup
+
+import (
+	"breathaipay/cards"
+	"breathaipay/catalog"
+	"breathaipay/database"
+	"breathaipay/fulfillment"
+	"breathaipay/mail"
+	"breathaipay/openwebui"
+	"breathaipay/payments"
+	"breathaipay/pricing"
+	"breathaipay/sites"
+	"breathaipay/utils"
+
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 管理链接签名的用途
+const linkPurpose = "auto-topup"
+
+// 订单处于这些状态时说明上一笔扣款还没有完成发放, 余额尚未更新, 不能再次扣款
+var inFlight = []database.OrderStatus{
+	database.OrderCreated,
+	database.OrderRequiresCapture,
+	database.OrderFulfilling,
+}
+
+// Start 按AUTO_TOPUP_INTERVAL(分钟)定期检查开启了自动充值的用户余额, 配置为0时不检查
+// 未配置LINK_SECRET时用户无法通过链接关闭自动充值, 同样不检查
+func Start() {
+	if !utils.LinksEnabled() {
+		log.Print("未配置LINK_SECRET, 不检查自动充值")
+		return
+	}
+	minutes, _ := strconv.Atoi(utils.GetEnvVariable("AUTO_TOPUP_INTERVAL", "10"))
+	if minutes <= 0 {
+		log.Printf("AUTO_TOPUP_INTERVAL为 %d, 不检查自动充值", minutes)
+		return
+	}
+	interval := time.Duration(minutes) * time.Minute
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			runOnce(interval)
+			<-ticker.C
+		}
+	}()
+}
+
+// MaxDailyLimit 用户可以设置的每日最多扣款次数
+func MaxDailyLimit() int {
+	limit, _ := strconv.Atoi(utils.GetEnvVariable("AUTO_TOPUP_MAX_DAILY", "3"))
+	return max(limit, 1)
+}
+
+// runOnce 检查所有开启的自动充值
+func runOnce(interval time.Duration) {
+	list, err := database.ListAutoTopups("")
+	if err != nil {
+		log.Printf("获取自动充值设置失败: %v", err)
+		return
+	}
+	for _, t := range list {
+		// 认领时留出一半间隔的余量, 以免执行耗时导致跳过下一个周期; 其他实例已经检查过的直接跳过
+		claimed, err := database.ClaimAutoTopupCheck(t.ID, time.Now().Add(-interval/2))
+		if err != nil {
+			log.Printf("认领自动充值检查失败 (%d): %v", t.ID, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		if err := check(t); err != nil {
+			log.Printf("自动充值检查失败 (%d, %s): %v", t.ID, t.Email, err)
+		}
+	}
+}
+
+// check 余额低于阈值且未达到当天上限时扣款一次
+// 返回的错误为暂时性的错误, 下个周期会重新检查; 需要用户处理的问题会关闭自动充值并发送邮件
+func check(t database.AutoTopup) error {
+	site, ok := sites.GetEnabled(t.SiteType)
+	if !ok {
+		return fmt.Errorf("站点 %s 不存在或已停止下单", t.SiteType)
+	}
+	user := openwebui.GetUserIDWithEmail(t.Email, site)
+	if user.ID == "" {
+		return fmt.Errorf("无法获取 %s 在%s的余额", t.Email, site.Name)
+	}
+	if user.Credit >= t.Threshold {
+		return nil
+	}
+
+	// 查询今天及最近一小时内发起的扣款, 跨天时上一笔扣款可能仍未完成
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	since := today
+	if recent := now.Add(-time.Hour); recent.Before(since) {
+		since = recent
+	}
+	charges, err := database.ListAutoTopupCharges(t.ID, since)
+	if err != nil {
+		return err
+	}
+	attempts, used := 0, 0
+	for _, c := range charges {
+		if c.Status != database.AutoTopupChargeFailed && slices.Contains(inFlight, c.OrderStatus) {
+			log.Printf("自动充值 %d 的上一笔扣款 %s 尚未完成, 跳过本次检查", t.ID, c.PaymentIntentID)
+			return nil
+		}
+		if c.CreatedAt.Before(today) {
+			continue
+		}
+		attempts++
+		// 失败的扣款不计入每日上限
+		if c.Status != database.AutoTopupChargeFailed {
+			used++
+		}
+	}
+	if used >= t.DailyLimit {
+		log.Printf("自动充值 %d 今天已扣款 %d 次, 达到上限", t.ID, used)
+		return nil
+	}
+
+	product, err := catalog.Get(t.ProductID, site.Key)
+	if err != nil {
+		disable(t, "所选商品已下架")
+		return nil
+	}
+	card, err := cards.Get(t.CustomerID, t.PaymentMethodID)
+	if errors.Is(err, cards.ErrNotFound) {
+		disable(t, "所选卡片已被移除")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	quote, err := pricing.QuoteOrder(product, 1, nil, cards.MethodFor(product))
+	if err != nil {
+		disable(t, "所选商品的金额无效")
+		return nil
+	}
+
+	// 幂等键按当天的扣款序号生成, 重复执行时复用同一个PaymentIntent, 复用时按重新查询到的状态处理
+	log.Printf("%s 在%s的余额 %d 低于 %d, 自动充值 %d 积分", t.Email, site.Name, user.Credit, t.Threshold, quote.Points)
+	pi, err := cards.CreateIntent(cards.Purchase{
+		Email:           t.Email,
+		CustomerID:      t.CustomerID,
+		Card:            card,
+		SiteType:        site.Key,
+		OpenWebUIUserID: user.ID,
+		Product:         product,
+		Quantity:        1,
+		Quote:           quote,
+		IdempotencyKey:  fmt.Sprintf("auto-topup-%d-%s-%d", t.ID, today.Format("20060102"), attempts+1),
+	})
+	if pi.ID == "" {
+		return err
+	}
+	// 扣款记录是计算扣款序号和每日上限的依据, 记录失败时不扣款也不发邮件
+	// 下个周期使用同一个幂等键, 复用这个PaymentIntent重新记录, 不会重复扣款或重复通知
+	if recordErr := database.RecordAutoTopupCharge(database.AutoTopupCharge{
+		PaymentIntentID: pi.ID,
+		TopupID:         t.ID,
+		Status:          database.AutoTopupChargePending,
+	}); recordErr != nil {
+		return fmt.Errorf("记录自动充值扣款失败 (%s): %w", pi.ID, recordErr)
+	}
+	if err != nil {
+		return err
+	}
+
+	pi, err = cards.ConfirmOffSession(pi)
+	if errors.Is(err, cards.ErrAuthenticationRequired) || errors.Is(err, cards.ErrDeclined) {
+		log.Printf("自动充值扣款失败 (%s): %v", pi.ID, err)
+		chargeFailed(pi.ID, err.Error())
+		disable(t, err.Error())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch pi.Status {
+	case payments.StatusSucceeded:
+		log.Printf("自动充值扣款成功: %s", pi.ID)
+		if err := database.UpdateAutoTopupCharge(pi.ID, database.AutoTopupChargeSucceeded, ""); err != nil {
+			log.Printf("更新自动充值扣款失败 (%s): %v", pi.ID, err)
+		}
+		if _, err := fulfillment.Enqueue(pi.ID, t.Email, site.Key, quote.Points, pi.Amount, database.OrderActorAutoTopup); err != nil {
+			// 订单已经支付, Webhook会再次尝试发放
+			log.Printf("处理自动充值订单时出错 (%s): %v", pi.ID, err)
+		}
+		notifyCharged(t, site, quote)
+	case payments.StatusProcessing:
+		// 扣款结果由Webhook处理, 订单完成前不会再次扣款
+		log.Printf("自动充值扣款处理中: %s", pi.ID)
+	case payments.StatusCanceled:
+		// 复用到已被过期清理取消的PaymentIntent, 不是卡片的问题, 下次检查时扣款序号增加, 使用新的幂等键
+		log.Printf("自动充值的PaymentIntent已取消: %s", pi.ID)
+		if err := database.UpdateAutoTopupCharge(pi.ID, database.AutoTopupChargeFailed, pi.RawStatus); err != nil {
+			log.Printf("更新自动充值扣款失败 (%s): %v", pi.ID, err)
+		}
+	default:
+		chargeFailed(pi.ID, pi.RawStatus)
+		disable(t, "卡片扣款失败")
+	}
+	return nil
+}
+
+// chargeFailed 记录扣款失败, 订单交由过期清理取消
+func chargeFailed(paymentIntentID string, reason string) {
+	if err := database.UpdateAutoTopupCharge(paymentIntentID, database.AutoTopupChargeFailed, reason); err != nil {
+		log.Printf("更新自动充值扣款失败 (%s): %v", paymentIntentID, err)
+	}
+	if err := database.TransitionOrderStatus(paymentIntentID, database.OrderPaymentFailed, database.OrderActorAutoTopup, reason); err != nil {
+		log.Printf("更新订单状态失败 (%s): %v", paymentIntentID, err)
+	}
+}
+
+// disable 关闭自动充值并通知用户, 用户处理后可以通过管理链接重新开启
+func disable(t database.AutoTopup, reason string) {
+	log.Printf("关闭自动充值 %d (%s): %s", t.ID, t.Email, reason)
+	if err := database.SetAutoTopupEnabled(t.ID, false, reason); err != nil {
+		log.Printf("关闭自动充值失败 (%d): %v", t.ID, err)
+		return
+	}
+
+	body := fmt.Sprintf("您好,尊敬的灵息用户 %s , 您在%s的自动充值未能完成: %s<br>自动充值已暂停, 请更换卡片或手动购买积分", t.Email, siteName(t.SiteType), reason)
+	if link := ManageURL(t.ID); strings.HasPrefix(link, "http") {
+		body += fmt.Sprintf("<br>处理后可以通过以下链接重新开启自动充值: %s", link)
+	}
+	body += "<br><br>灵息.com 自动邮件<br>请勿回复"
+	if err := mail.NewMailer().SendMail([]string{t.Email}, "自动充值失败", body, "text/html"); err != nil {
+		log.Printf("发送自动充值失败邮件失败 (%s): %v", t.Email, err)
+	}
+}
+
+// notifyCharged 扣款成功后通知用户, 邮件中附带关闭自动充值的链接
+func notifyCharged(t database.AutoTopup, site sites.Site, quote pricing.Quote) {
+	body := fmt.Sprintf("您好,尊敬的灵息用户 %s , 您在%s的余额低于 %d, 已使用保存的卡片自动支付 %s 购买 %d 积分, 积分将很快到账",
+		t.Email, site.Name, t.Threshold, quote.Total, quote.Points)
+	if link := ManageURL(t.ID); strings.HasPrefix(link, "http") {
+		body += fmt.Sprintf("<br>如需关闭自动充值, 请访问: %s", link)
+	}
+	body += "<br><br>灵息.com 自动邮件<br>请勿回复"
+	if err := mail.NewMailer().SendMail([]string{t.Email}, "自动充值成功", body, "text/html"); err != nil {
+		log.Printf("发送自动充值邮件失败 (%s): %v", t.Email, err)
+	}
+}
+
+// siteName 站点的展示名称, 站点已删除时使用站点标识
+func siteName(key string) string {
+	if site, ok := sites.Get(key); ok {
+		return site.Name
+	}
+	return key
+}
+
+// ManageToken 自动充值管理链接的签名
+func ManageToken(id int) string {
+	return utils.SignLink(linkPurpose, strconv.Itoa(id))
+}
+
+// ManageURL 自动充值管理页的链接, 持有链接即可关闭或重新开启自动充值
+func ManageURL(id int) string {
+	return utils.PublicURL("/auto-topup?id=" + strconv.Itoa(id) + "&token=" + ManageToken(id))
+}
+
+// VerifyManageToken 校验管理链接中的签名
+func VerifyManageToken(id int, token string) bool {
+	return id > 0 && utils.VerifyLink(linkPurpose, strconv.Itoa(id), token)
+}
@@ -0,0 +1,108 @@
+package cards
+
+import (
+	"breathaipay/database"
+	"breathaipay/mail"
+	"breathaipay/payments"
+	"breathaipay/utils"
+
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 登录链接签名的用途
+const linkPurpose = "saved-cards"
+
+// 登录链接的有效期, 过期后需要重新发送
+const linkTTL = time.Hour
+
+// ErrNotFound 卡片不存在或不属于该客户
+var ErrNotFound = errors.New("卡片不存在")
+
+// Card 客户在Stripe中保存的一张卡片
+type Card = payments.Card
+
+// Session 通过邮件链接验证过的邮箱, 表单提交时原样带回以便再次校验
+type Session struct {
+	Email   string
+	Expires int64 // Unix时间戳
+	Token   string
+}
+
+// Valid 校验签名和有效期
+func (s Session) Valid() bool {
+	return s.Email != "" && time.Now().Unix() < s.Expires &&
+		utils.VerifyLink(linkPurpose, s.Email+"|"+strconv.FormatInt(s.Expires, 10), s.Token)
+}
+
+// Query 作为查询参数的会话信息
+func (s Session) Query() string {
+	return url.Values{
+		"email":   {s.Email},
+		"expires": {strconv.FormatInt(s.Expires, 10)},
+		"token":   {s.Token},
+	}.Encode()
+}
+
+// newSession 为邮箱生成新的会话
+func newSession(email string) Session {
+	expires := time.Now().Add(linkTTL).Unix()
+	return Session{
+		Email:   email,
+		Expires: expires,
+		Token:   utils.SignLink(linkPurpose, email+"|"+strconv.FormatInt(expires, 10)),
+	}
+}
+
+// SendLoginLink 向已有Stripe客户的邮箱发送一键购买链接, 邮箱没有对应客户时什么也不做
+// 无论邮箱是否存在都返回nil, 调用方给出相同的提示, 避免泄露邮箱是否购买过
+func SendLoginLink(email string) error {
+	if _, err := database.FindCustomerID(email); err != nil {
+		if database.IsNotFound(err) {
+			log.Printf("邮箱 %s 没有对应的客户, 不发送一键购买链接", email)
+			return nil
+		}
+		return err
+	}
+
+	link := utils.PublicURL("/quick/buy?" + newSession(email).Query())
+	if !strings.HasPrefix(link, "http") {
+		return errors.New("未配置PUBLIC_BASE_URL, 无法发送一键购买链接")
+	}
+	body := fmt.Sprintf("您好,尊敬的灵息用户 %s , 请在 %d 分钟内点击以下链接使用已保存的卡片购买积分:<br><a href=\"%s\">%s</a><br>如果不是您本人操作, 请忽略本邮件<br><br>灵息.com 自动邮件<br>请勿回复",
+		email, int(linkTTL.Minutes()), link, link)
+	return mail.NewMailer().SendMail([]string{email}, "一键购买链接", body, "text/html")
+}
+
+// List 查询客户保存的卡片
+func List(customerID string) ([]Card, error) {
+	return payments.Stripe().ListCards(customerID)
+}
+
+// Get 获取客户的一张卡片, 卡片不属于该客户时返回ErrNotFound
+func Get(customerID string, paymentMethodID string) (Card, error) {
+	card, err := payments.Stripe().GetCard(paymentMethodID)
+	if err != nil {
+		if errors.Is(err, payments.ErrCardNotFound) {
+			return Card{}, ErrNotFound
+		}
+		return Card{}, err
+	}
+	if card.CustomerID == "" || card.CustomerID != customerID {
+		return Card{}, ErrNotFound
+	}
+	return card, nil
+}
+
+// Remove 从客户中移除一张卡片, 之后不能再用于一键购买
+func Remove(customerID string, paymentMethodID string) error {
+	if _, err := Get(customerID, paymentMethodID); err != nil {
+		return err
+	}
+	return payments.Stripe().DetachCard(paymentMethodID)
+}
@@ -0,0 +1,95 @@
+package cards
+
+import (
+	"breathaipay/catalog"
+	"breathaipay/database"
+	"breathaipay/payments"
+	"breathaipay/pricing"
+
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// PaymentMethodCard 已保存的卡片对应的支付方式
+const PaymentMethodCard = "card"
+
+// ErrAuthenticationRequired 发卡行要求持卡人验证, 需要用户在场时重新确认
+var ErrAuthenticationRequired = payments.ErrAuthenticationRequired
+
+// ErrDeclined 扣款被拒绝, 如余额不足或卡片过期
+var ErrDeclined = payments.ErrDeclined
+
+// Purchase 使用已保存的卡片购买一个商品
+type Purchase struct {
+	Email           string
+	CustomerID      string
+	Card            Card
+	SiteType        string
+	OpenWebUIUserID string
+	Product         *catalog.Product
+	Quantity        int
+	Quote           pricing.Quote
+	IdempotencyKey  string // 同时用作Stripe的Idempotency-Key, 为空时不设置
+}
+
+// MethodFor 已保存的都是卡片, 配置了卡片的手续费规则时按该规则计算
+func MethodFor(product *catalog.Product) string {
+	if pricing.ValidPaymentMethod(product.Currency, PaymentMethodCard) {
+		return PaymentMethodCard
+	}
+	return ""
+}
+
+// CreateIntent 创建尚未确认的PaymentIntent并记录订单
+// 先记录订单再扣款, 保证扣款成功的PaymentIntent一定有对应的订单
+func CreateIntent(p Purchase) (payments.Payment, error) {
+	pi, err := payments.Stripe().Create(payments.CreateParams{
+		Amount:        p.Quote.Total,
+		Description:   "购买灵息积分",
+		Email:         p.Email,
+		CustomerID:    p.CustomerID,
+		PaymentMethod: PaymentMethodCard,
+		SavedCard:     p.Card.ID,
+		Metadata: map[string]string{
+			"email":           p.Email,
+			"sitetype":        p.SiteType,
+			"amount":          strconv.FormatInt(p.Quote.Points, 10),
+			"productID":       strconv.Itoa(p.Product.ID),
+			"openwebuiUserID": p.OpenWebUIUserID,
+			"coupon":          "",
+			"discount":        "0",
+			"fee":             strconv.FormatInt(p.Quote.Fee.Amount, 10),
+		},
+		IdempotencyKey: p.IdempotencyKey,
+	})
+	if err != nil {
+		return payments.Payment{}, fmt.Errorf("创建PaymentIntent失败: %w", err)
+	}
+
+	err = database.RecordOrder(database.Order{
+		OrderID:         pi.ID,
+		Status:          database.OrderCreated,
+		Provider:        payments.ProviderStripe,
+		ExpiresAt:       time.Now().Add(30 * time.Minute),
+		OpenWebUIUserID: p.OpenWebUIUserID,
+		Email:           p.Email,
+		SiteType:        p.SiteType,
+		ProductID:       p.Product.ID,
+		Quantity:        p.Quantity,
+		Points:          p.Quote.Points,
+		Amount:          p.Quote.Total,
+		IdempotencyKey:  p.IdempotencyKey,
+		Discount:        p.Quote.Discount,
+	})
+	if err != nil {
+		return pi, fmt.Errorf("记录订单失败: %w", err)
+	}
+	return pi, nil
+}
+
+// ConfirmOffSession 在用户不在场时确认PaymentIntent, 以重新查询到的状态为准, 重复提交时不会再次扣款
+// 发卡行要求验证时返回ErrAuthenticationRequired, 被拒绝时返回包装了ErrDeclined的错误
+func ConfirmOffSession(pi payments.Payment) (payments.Payment, error) {
+	return payments.Stripe().ConfirmOffSession(pi)
+}
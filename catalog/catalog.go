@@ -0,0 +1,67 @@
+package catalog
+
+import (
+	"breathaipay/database"
+	"breathaipay/sites"
+
+	"errors"
+	"slices"
+)
+
+// Product 商品信息, 数据保存在数据库的products表中
+type Product = database.Product
+
+// ErrNotFound 商品不存在、已下架或在所选站点不可购买
+var ErrNotFound = errors.New("商品不存在或已下架")
+
+// List 返回指定站点可购买的商品, site为空时返回在任一启用站点可购买的商品
+// 每次调用都从数据库读取, 修改商品后无需重启
+func List(site string) ([]Product, error) {
+	products, err := database.ListProducts()
+	if err != nil {
+		return nil, err
+	}
+	available := make([]Product, 0, len(products))
+	for _, p := range products {
+		if (site == "" && len(SitesFor(p)) > 0) || (site != "" && AvailableOn(p, site)) {
+			available = append(available, p)
+		}
+	}
+	return available, nil
+}
+
+// Get 按ID获取上架的商品, site不为空时同时校验该站点是否可购买
+func Get(id int, site string) (*Product, error) {
+	p, err := database.GetProduct(id)
+	if err != nil {
+		if database.IsNotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if !p.Active || (site != "" && !AvailableOn(p, site)) {
+		return nil, ErrNotFound
+	}
+	return &p, nil
+}
+
+// AvailableOn 判断商品是否可以在指定站点购买
+// 商品需在该站点上架, 且商品币种与站点币种一致
+func AvailableOn(p Product, siteKey string) bool {
+	if len(p.Sites) > 0 && !slices.Contains(p.Sites, siteKey) {
+		return false
+	}
+	site, ok := sites.Get(siteKey)
+	return ok && site.Currency == p.Currency
+}
+
+// SitesFor 返回可以购买该商品的所有启用站点
+func SitesFor(p Product) []sites.Site {
+	var available []sites.Site
+	for _, site := range sites.Enabled() {
+		if AvailableOn(p, site.Key) {
+			available = append(available, site)
+		}
+	}
+	return available
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"breathaipay/catalog"
+	"breathaipay/database"
+	"breathaipay/payments"
+	"breathaipay/pricing"
+	"breathaipay/sites"
+	"breathaipay/utils"
+
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Checkout Session的有效期, Stripe要求至少30分钟, 多留1分钟以免请求耗时导致创建失败
+const checkoutSessionTTL = 31 * time.Minute
+
+// checkoutOrder 付款页校验通过的订单信息
+type checkoutOrder struct {
+	product         *catalog.Product
+	site            sites.Site
+	quantity        int
+	email           string
+	openwebuiUserID string
+	quote           pricing.Quote
+}
+
+// useCheckoutSession PAYMENT_MODE为checkout时跳转到Stripe托管的Checkout页面付款, 否则在付款页嵌入Payment Element
+func useCheckoutSession() bool {
+	return utils.GetEnvVariable("PAYMENT_MODE", "elements") == "checkout"
+}
+
+// redirectToCheckout 创建Checkout Session并跳转到Stripe的付款页面
+// 订单在支付完成前以Session ID记录, 支付完成后改用PaymentIntent ID, 与普通订单走同样的发放流程
+func redirectToCheckout(c *gin.Context, o checkoutOrder) error {
+	customerID, err := database.GetCustomerId(o.email)
+	if err != nil {
+		return fmt.Errorf("获取客户失败: %w", err)
+	}
+
+	metadata := map[string]string{
+		"email":           o.email,
+		"sitetype":        o.site.Key,
+		"amount":          strconv.FormatInt(o.quote.Points, 10),
+		"productID":       strconv.Itoa(o.product.ID),
+		"openwebuiUserID": o.openwebuiUserID,
+		"coupon":          o.quote.CouponCode,
+		"discount":        strconv.FormatInt(o.quote.Discount.Amount, 10),
+		"fee":             strconv.FormatInt(o.quote.Fee.Amount, 10),
+	}
+	expiresAt := time.Now().Add(checkoutSessionTTL)
+	base := baseURL(c)
+
+	// 优惠码和手续费已经计入金额, 作为一个商品展示
+	cs, err := payments.Stripe().CreateCheckoutSession(payments.CheckoutParams{
+		CustomerID:          customerID,
+		Amount:              o.quote.Total,
+		Name:                fmt.Sprintf("%s × %d", o.product.Name, o.quantity),
+		ProductDescription:  fmt.Sprintf("%d 积分, 充值到%s", o.quote.Points, o.site.Name),
+		Description:         "购买灵息积分",
+		Email:               o.email,
+		Metadata:            metadata,
+		PaymentMethod:       o.quote.PaymentMethod,
+		SuccessURL:          base + "/success?session_id={CHECKOUT_SESSION_ID}",
+		CancelURL:           base + "/",
+		ExpiresAt:           expiresAt,
+		Locale:              utils.GetEnvVariable("CHECKOUT_LOCALE", "auto"),
+		AllowPromotionCodes: utils.GetEnvVariable("CHECKOUT_ALLOW_PROMOTION_CODES", "false") == "true",
+		AutomaticTax:        utils.GetEnvVariable("CHECKOUT_AUTOMATIC_TAX", "false") == "true",
+	})
+	if err != nil {
+		return fmt.Errorf("创建Checkout Session失败: %w", err)
+	}
+
+	err = database.RecordOrder(database.Order{
+		OrderID:         cs.ID,
+		Status:          database.OrderCreated,
+		ExpiresAt:       expiresAt,
+		OpenWebUIUserID: o.openwebuiUserID,
+		Email:           o.email,
+		SiteType:        o.site.Key,
+		ProductID:       o.product.ID,
+		Quantity:        o.quantity,
+		Points:          o.quote.Points,
+		Amount:          o.quote.Total,
+		CouponCode:      o.quote.CouponCode,
+		Discount:        o.quote.Discount,
+	})
+	if err != nil {
+		return fmt.Errorf("记录订单失败 (%s): %w", cs.ID, err)
+	}
+
+	log.Printf("Checkout Session created: %s", cs.ID)
+	c.Redirect(http.StatusSeeOther, cs.URL)
+	return nil
+}
+
+// baseURL 拼接Checkout跳转回来的地址, 未配置PUBLIC_BASE_URL时使用当前请求的地址
+func baseURL(c *gin.Context) string {
+	if base := utils.PublicURL(""); strings.HasPrefix(base, "http") {
+		return base
+	}
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// completeCheckoutSession 处理已完成的Checkout Session, 成功页、Webhook共用, actor为调用方
+// 订单改用PaymentIntent ID后, 已支付的交给与PaymentIntent相同的发放流程; 返回false表示尚未支付或已被处理过
+func completeCheckoutSession(cs payments.CheckoutSession, actor string) (bool, error) {
+	// 只处理本程序创建的积分订单
+	if !cs.PaymentMode || cs.Metadata["sitetype"] == "" {
+		log.Printf("不是积分订单的Checkout Session, 跳过: %s", cs.ID)
+		return false, nil
+	}
+	if cs.Status != payments.CheckoutComplete || cs.PaymentIntentID == "" {
+		return false, nil
+	}
+	if err := database.AttachPaymentIntent(cs.ID, cs.PaymentIntentID, cs.Amount); err != nil {
+		return false, fmt.Errorf("更新订单的PaymentIntent失败: %w", err)
+	}
+	if !cs.Paid {
+		// 银行转账等异步支付方式, 到账后由Webhook继续处理
+		log.Printf("Checkout Session %s 等待异步支付完成", cs.ID)
+		return false, nil
+	}
+	return fulfillPayment(payments.Payment{ID: cs.PaymentIntentID, Provider: payments.ProviderStripe, Metadata: cs.Metadata}, actor)
+}
+
+// checkoutSuccessHandler Checkout支付完成后跳转回来的成功页, 与Webhook共用同一发放流程
+func checkoutSuccessHandler(c *gin.Context, sessionID string) {
+	cs, err := payments.Stripe().GetCheckoutSession(sessionID)
+	if err != nil {
+		log.Printf("获取 Checkout Session 失败 (%s): %v", sessionID, err)
+		c.String(http.StatusInternalServerError, "无法验证支付状态，请联系客服。")
+		return
+	}
+	if _, err := completeCheckoutSession(cs, database.OrderActorSuccessPage); err != nil {
+		log.Printf("处理支付成功订单时出错 (%s): %v", sessionID, err)
+		c.String(http.StatusInternalServerError, "系统错误，请联系客服。")
+		return
+	}
+
+	switch {
+	case cs.Paid && cs.PaymentIntentID != "":
+		log.Printf("支付成功: Checkout Session ID=%s, Amount=%s", cs.ID, cs.Amount)
+		renderSuccessPage(c, cs.PaymentIntentID, cs.Metadata["email"], cs.Metadata["sitetype"], cs.Amount)
+	case cs.Status == payments.CheckoutComplete:
+		c.String(http.StatusOK, "支付处理中，到账后积分将自动发放，请稍后查看邮箱。")
+	default:
+		log.Printf("支付未完成: Checkout Session ID=%s, Status=%s", cs.ID, cs.Status)
+		c.String(http.StatusBadRequest, "支付失败或已取消。")
+	}
+}
@@ -0,0 +1,95 @@
+package coupons
+
+import (
+	"breathaipay/database"
+	"breathaipay/money"
+
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Coupon 优惠码, 数据保存在数据库的coupons表中
+type Coupon = database.Coupon
+
+// 优惠码不可用的原因, 错误信息会直接展示给用户
+var (
+	ErrNotFound      = errors.New("优惠码不存在或已停用")
+	ErrExpired       = errors.New("优惠码已过期")
+	ErrExhausted     = errors.New("优惠码已达到使用次数上限")
+	ErrEmailLimit    = errors.New("该邮箱已达到此优惠码的使用次数上限")
+	ErrNotApplicable = errors.New("优惠码不适用于所选商品")
+)
+
+// Normalize 优惠码不区分大小写, 统一转换为大写
+func Normalize(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Validate 校验优惠码能否用于购买指定的商品, code为空时返回nil
+// 使用次数只统计已支付的订单, 因此同时进行中的多个订单可能使总次数略微超过上限
+func Validate(code string, email string, productID int, currency string) (*Coupon, error) {
+	code = Normalize(code)
+	if code == "" {
+		return nil, nil
+	}
+
+	c, err := database.GetCoupon(code)
+	if err != nil {
+		if database.IsNotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if !c.Active {
+		return nil, ErrNotFound
+	}
+	if !c.ExpiresAt.IsZero() && time.Now().After(c.ExpiresAt) {
+		return nil, ErrExpired
+	}
+	if len(c.ProductIDs) > 0 && !slices.Contains(c.ProductIDs, productID) {
+		return nil, ErrNotApplicable
+	}
+	if c.AmountOff > 0 && c.Currency != "" && c.Currency != currency {
+		return nil, ErrNotApplicable
+	}
+
+	if c.MaxRedemptions > 0 || c.PerEmailLimit > 0 {
+		total, byEmail, err := database.CountCouponRedemptions(code, email)
+		if err != nil {
+			return nil, err
+		}
+		if c.MaxRedemptions > 0 && total >= c.MaxRedemptions {
+			return nil, ErrExhausted
+		}
+		if c.PerEmailLimit > 0 && byEmail >= c.PerEmailLimit {
+			return nil, ErrEmailLimit
+		}
+	}
+	return &c, nil
+}
+
+// Discount 计算优惠金额, 按比例优惠的部分舍去不足一分的零头
+// 同时设置了比例和固定金额时两者叠加, 优惠金额不超过小计
+func Discount(c *Coupon, subtotal money.Money) (money.Money, error) {
+	zero := money.New(0, subtotal.Currency)
+	if c == nil {
+		return zero, nil
+	}
+	percent, err := subtotal.MulDiv(int64(c.PercentOff), 100, money.RoundDown)
+	if err != nil {
+		return zero, err
+	}
+	discount := percent.Add(money.New(c.AmountOff, subtotal.Currency))
+	if discount.IsNegative() {
+		return zero, nil
+	}
+	return discount.Min(subtotal), nil
+}
+
+// IsUserError 判断错误是否为可以直接展示给用户的优惠码错误
+func IsUserError(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, ErrExpired) || errors.Is(err, ErrExhausted) ||
+		errors.Is(err, ErrEmailLimit) || errors.Is(err, ErrNotApplicable)
+}
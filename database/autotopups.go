@@ -0,0 +1,164 @@
+package database
+
+import (
+	"time"
+)
+
+// 自动充值扣款的状态
+const (
+	AutoTopupChargePending   = "pending"   // 已创建订单, 等待扣款结果
+	AutoTopupChargeSucceeded = "succeeded" // 扣款成功
+	AutoTopupChargeFailed    = "failed"    // 扣款失败
+)
+
+// AutoTopup 一条自动充值设置, 余额低于Threshold时使用保存的卡片购买ProductID
+type AutoTopup struct {
+	ID              int
+	Email           string
+	SiteType        string
+	CustomerID      string
+	PaymentMethodID string
+	ProductID       int
+	Threshold       int64
+	DailyLimit      int // 每天最多扣款次数
+	Enabled         bool
+	LastError       string // 最近一次被自动关闭的原因
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// AutoTopupCharge 自动充值发起的一笔扣款
+type AutoTopupCharge struct {
+	PaymentIntentID string
+	TopupID         int
+	Status          string
+	Error           string
+	OrderStatus     OrderStatus // 对应订单的当前状态, 订单不存在时为空
+	CreatedAt       time.Time
+}
+
+// 查询自动充值设置时选择的列, 与scanAutoTopup的顺序一致
+const autoTopupColumns = `id, email, site_type, customer_id, payment_method_id, product_id, threshold, daily_limit,
+	enabled, last_error, created_at, updated_at FROM auto_topups`
+
+// scanAutoTopup 读取一行autoTopupColumns
+func scanAutoTopup(row interface{ Scan(dest ...any) error }) (AutoTopup, error) {
+	var t AutoTopup
+	var createdAt, updatedAt string
+	err := row.Scan(&t.ID, &t.Email, &t.SiteType, &t.CustomerID, &t.PaymentMethodID, &t.ProductID, &t.Threshold, &t.DailyLimit,
+		&t.Enabled, &t.LastError, &createdAt, &updatedAt)
+	if err != nil {
+		return AutoTopup{}, err
+	}
+	t.CreatedAt = parseDBTime(createdAt, time.UTC)
+	t.UpdatedAt = parseDBTime(updatedAt, time.UTC)
+	return t, nil
+}
+
+// SaveAutoTopup 开启邮箱在站点上的自动充值, 已有设置时覆盖并重新开启, 返回设置的ID
+func (s *sqlStore) SaveAutoTopup(t AutoTopup) (int, error) {
+	query := `INSERT INTO auto_topups (email, site_type, customer_id, payment_method_id, product_id, threshold, daily_limit, enabled, last_error, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, '', ?)
+		ON CONFLICT (email, site_type) DO UPDATE SET customer_id = excluded.customer_id, payment_method_id = excluded.payment_method_id,
+		product_id = excluded.product_id, threshold = excluded.threshold, daily_limit = excluded.daily_limit,
+		enabled = excluded.enabled, last_error = '', updated_at = excluded.updated_at`
+	_, err := s.db.Exec(s.q(query), t.Email, t.SiteType, t.CustomerID, t.PaymentMethodID, t.ProductID, t.Threshold, t.DailyLimit,
+		true, utcNow())
+	if err != nil {
+		return 0, err
+	}
+	var id int
+	err = s.db.QueryRow(s.q("SELECT id FROM auto_topups WHERE email = ? AND site_type = ?"), t.Email, t.SiteType).Scan(&id)
+	return id, err
+}
+
+// GetAutoTopup 按ID查询自动充值设置, 不存在时返回sql.ErrNoRows
+func (s *sqlStore) GetAutoTopup(id int) (AutoTopup, error) {
+	return scanAutoTopup(s.db.QueryRow(s.q("SELECT "+autoTopupColumns+" WHERE id = ?"), id))
+}
+
+// ListAutoTopups 查询自动充值设置, email为空时返回所有开启的设置, 否则返回该邮箱的所有设置
+func (s *sqlStore) ListAutoTopups(email string) ([]AutoTopup, error) {
+	query := "SELECT " + autoTopupColumns + " WHERE enabled = ? ORDER BY id"
+	args := []any{true}
+	if email != "" {
+		query = "SELECT " + autoTopupColumns + " WHERE email = ? ORDER BY id"
+		args = []any{email}
+	}
+	rows, err := s.db.Query(s.q(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []AutoTopup
+	for rows.Next() {
+		t, err := scanAutoTopup(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+// SetAutoTopupEnabled 开启或关闭自动充值, reason为关闭的原因, 开启时清空
+func (s *sqlStore) SetAutoTopupEnabled(id int, enabled bool, reason string) error {
+	query := "UPDATE auto_topups SET enabled = ?, last_error = ?, updated_at = ? WHERE id = ?"
+	_, err := s.db.Exec(s.q(query), enabled, reason, utcNow(), id)
+	return err
+}
+
+// ClaimAutoTopupCheck 认领一次余额检查, 上次检查早于before时才能认领成功
+// 多个实例同时运行时同一条设置在一个检查周期内只会被检查一次
+func (s *sqlStore) ClaimAutoTopupCheck(id int, before time.Time) (bool, error) {
+	query := "UPDATE auto_topups SET checked_at = ? WHERE id = ? AND enabled = ? AND (checked_at IS NULL OR checked_at < ?)"
+	result, err := s.db.Exec(s.q(query), utcNow(), id, true, before.UTC().Format(timeLayout))
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// RecordAutoTopupCharge 记录一笔自动充值扣款
+func (s *sqlStore) RecordAutoTopupCharge(charge AutoTopupCharge) error {
+	query := "INSERT INTO auto_topup_charges (payment_intent_id, topup_id, status, error, created_at) VALUES (?, ?, ?, ?, ?)"
+	_, err := s.db.Exec(s.q(query), charge.PaymentIntentID, charge.TopupID, charge.Status, charge.Error, utcNow())
+	return err
+}
+
+// UpdateAutoTopupCharge 更新扣款结果
+func (s *sqlStore) UpdateAutoTopupCharge(paymentIntentID string, status string, errMsg string) error {
+	query := "UPDATE auto_topup_charges SET status = ?, error = ? WHERE payment_intent_id = ?"
+	_, err := s.db.Exec(s.q(query), status, errMsg, paymentIntentID)
+	return err
+}
+
+// ListAutoTopupCharges 查询设置在since之后发起的扣款及对应订单的状态, 按时间倒序
+func (s *sqlStore) ListAutoTopupCharges(topupID int, since time.Time) ([]AutoTopupCharge, error) {
+	query := `SELECT c.payment_intent_id, c.topup_id, c.status, c.error, COALESCE(o.status, ''), c.created_at
+		FROM auto_topup_charges c LEFT JOIN orders o ON o.order_id = c.payment_intent_id
+		WHERE c.topup_id = ? AND c.created_at >= ? ORDER BY c.created_at DESC`
+	rows, err := s.db.Query(s.q(query), topupID, since.UTC().Format(timeLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var charges []AutoTopupCharge
+	for rows.Next() {
+		var c AutoTopupCharge
+		var orderStatus, createdAt string
+		if err := rows.Scan(&c.PaymentIntentID, &c.TopupID, &c.Status, &c.Error, &orderStatus, &createdAt); err != nil {
+			return nil, err
+		}
+		c.OrderStatus = OrderStatus(orderStatus)
+		c.CreatedAt = parseDBTime(createdAt, time.UTC)
+		charges = append(charges, c)
+	}
+	return charges, rows.Err()
+}
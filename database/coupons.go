@@ -0,0 +1,66 @@
+package database
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Coupon 优惠码, 数据保存在coupons表中
+type Coupon struct {
+	Code           string
+	PercentOff     int   // 按比例优惠, 0-100
+	AmountOff      int64 // 固定金额优惠, 以最小货币单位(分)保存
+	Currency       string
+	BonusPoints    int64
+	ExpiresAt      time.Time // 零值表示永不过期
+	MaxRedemptions int
+	PerEmailLimit  int
+	ProductIDs     []int // 为空表示所有商品
+	Active         bool
+}
+
+// GetCoupon 按优惠码获取优惠信息(包括已停用的), 不存在时返回sql.ErrNoRows
+func (s *sqlStore) GetCoupon(code string) (Coupon, error) {
+	var c Coupon
+	var expiresAt sql.NullString
+	var productIDs string
+	query := `SELECT code, percent_off, amount_off, currency, bonus_points, expires_at, max_redemptions, per_email_limit, product_ids, active
+		FROM coupons WHERE code = ?`
+	err := s.db.QueryRow(s.q(query), code).Scan(&c.Code, &c.PercentOff, &c.AmountOff, &c.Currency, &c.BonusPoints, &expiresAt,
+		&c.MaxRedemptions, &c.PerEmailLimit, &productIDs, &c.Active)
+	if err != nil {
+		return Coupon{}, err
+	}
+	if expiresAt.Valid {
+		c.ExpiresAt = parseDBTime(expiresAt.String, time.Local)
+	}
+	for _, id := range strings.Split(productIDs, ",") {
+		if id, err := strconv.Atoi(strings.TrimSpace(id)); err == nil {
+			c.ProductIDs = append(c.ProductIDs, id)
+		}
+	}
+	return c, nil
+}
+
+// CountCouponRedemptions 获取优惠码已使用的次数, 以及其中该邮箱使用的次数
+// 只有支付成功的订单才会计入
+func (s *sqlStore) CountCouponRedemptions(code string, email string) (total int, byEmail int, err error) {
+	query := `SELECT COUNT(*), COALESCE(SUM(CASE WHEN email = ? THEN 1 ELSE 0 END), 0)
+		FROM coupon_redemptions WHERE code = ?`
+	err = s.db.QueryRow(s.q(query), email, code).Scan(&total, &byEmail)
+	return total, byEmail, err
+}
+
+// redeemCouponTx 订单使用了优惠码时写入使用记录, 与认领订单在同一个事务中完成
+func (s *sqlStore) redeemCouponTx(tx *sql.Tx, orderID string) error {
+	var code, email string
+	err := tx.QueryRow(s.q("SELECT coupon_code, email FROM orders WHERE order_id = ?"), orderID).Scan(&code, &email)
+	if err != nil || code == "" {
+		return err
+	}
+	query := "INSERT INTO coupon_redemptions (code, order_id, email) VALUES (?, ?, ?) ON CONFLICT (order_id) DO NOTHING"
+	_, err = tx.Exec(s.q(query), code, orderID, email)
+	return err
+}
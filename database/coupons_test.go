@@ -0,0 +1,53 @@
+package database
+
+import (
+	"breathaipay/money"
+
+	"testing"
+)
+
+func TestCouponRedeemedOnceAfterPayment(t *testing.T) {
+	s := newTestStore(t)
+	query := "INSERT INTO coupons (code, percent_off, bonus_points, max_redemptions, per_email_limit, product_ids) VALUES (?, ?, ?, ?, ?, ?)"
+	if _, err := s.db.Exec(query, "SPRING", 10, 500, 2, 1, "1, 2"); err != nil {
+		t.Fatal(err)
+	}
+	c, err := s.GetCoupon("SPRING")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.PercentOff != 10 || c.BonusPoints != 500 || c.MaxRedemptions != 2 || c.PerEmailLimit != 1 ||
+		len(c.ProductIDs) != 2 || c.ProductIDs[1] != 2 || !c.ExpiresAt.IsZero() || !c.Active {
+		t.Fatalf("GetCoupon() = %+v", c)
+	}
+
+	recordTestOrder(t, s, Order{OrderID: "pi_coupon", Amount: money.New(1800, "cny"), CouponCode: "SPRING", Discount: money.New(200, "cny")})
+	recordTestOrder(t, s, Order{OrderID: "pi_unpaid", Email: "d@e.f", Amount: money.New(1800, "cny"), CouponCode: "SPRING", Discount: money.New(200, "cny")})
+
+	// 未支付的订单不计入使用次数
+	if total, byEmail, err := s.CountCouponRedemptions("SPRING", "a@b.c"); err != nil || total != 0 || byEmail != 0 {
+		t.Fatalf("CountCouponRedemptions() = %d, %d, %v, want 0, 0", total, byEmail, err)
+	}
+
+	// 同一订单被认领两次只计入一次
+	for range 2 {
+		if _, err := s.ClaimOrderForFulfillment(testJob("pi_coupon"), money.New(1800, "cny"), OrderActorWebhook); err != nil {
+			t.Fatal(err)
+		}
+	}
+	total, byEmail, err := s.CountCouponRedemptions("SPRING", "a@b.c")
+	if err != nil || total != 1 || byEmail != 1 {
+		t.Fatalf("CountCouponRedemptions() = %d, %d, %v, want 1, 1", total, byEmail, err)
+	}
+	if _, byEmail, _ := s.CountCouponRedemptions("SPRING", "d@e.f"); byEmail != 0 {
+		t.Errorf("其他邮箱的使用次数 = %d, want 0", byEmail)
+	}
+
+	// 金额不一致的订单等待人工核对, 不计入使用次数
+	if _, err := s.ClaimOrderForFulfillment(testJob("pi_unpaid"), money.New(100, "cny"), OrderActorWebhook); err == nil {
+		t.Fatal("金额不一致时没有返回错误")
+	}
+	if total, _, _ := s.CountCouponRedemptions("SPRING", "d@e.f"); total != 1 {
+		t.Errorf("CountCouponRedemptions() total = %d, want 1", total)
+	}
+}
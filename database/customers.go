@@ -0,0 +1,58 @@
+package database
+
+// Customer 客户信息, ID为Stripe的客户ID
+type Customer struct {
+	ID    string
+	Email string
+}
+
+// FindCustomerID 按邮箱查询Stripe客户ID, 不存在时返回sql.ErrNoRows
+func (s *sqlStore) FindCustomerID(email string) (string, error) {
+	var id string
+	err := s.db.QueryRow(s.q("SELECT id FROM customers WHERE mail = ?"), email).Scan(&id)
+	return id, err
+}
+
+// SaveCustomer 保存邮箱对应的Stripe客户ID, 返回最终保存的ID
+// 邮箱已经存在时(其他实例先写入)保留原有的ID
+func (s *sqlStore) SaveCustomer(id string, email string) (string, error) {
+	query := "INSERT INTO customers (id, mail) VALUES (?, ?) ON CONFLICT (mail) DO NOTHING"
+	if _, err := s.db.Exec(s.q(query), id, email); err != nil {
+		return id, err
+	}
+	err := s.db.QueryRow(s.q("SELECT id FROM customers WHERE mail = ?"), email).Scan(&id)
+	return id, err
+}
+
+// ListCustomers 查询客户列表, email不为空时按邮箱模糊匹配
+func (s *sqlStore) ListCustomers(email string, limit int, offset int) ([]Customer, error) {
+	query := "SELECT id, mail FROM customers"
+	var args []any
+	if email != "" {
+		query += " WHERE mail LIKE ?"
+		args = append(args, "%"+email+"%")
+	}
+	// 按创建顺序倒序, PostgreSQL没有rowid, 使用自增的seq列
+	if s.postgres {
+		query += " ORDER BY seq DESC LIMIT ? OFFSET ?"
+	} else {
+		query += " ORDER BY rowid DESC LIMIT ? OFFSET ?"
+	}
+	args = append(args, limit, offset)
+
+	rows, err := s.db.Query(s.q(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var customers []Customer
+	for rows.Next() {
+		var c Customer
+		if err := rows.Scan(&c.ID, &c.Email); err != nil {
+			return nil, err
+		}
+		customers = append(customers, c)
+	}
+	return customers, rows.Err()
+}
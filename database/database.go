@@ -1,217 +1,251 @@
 package database
 
 import (
+	"breathaipay/payments"
+	"breathaipay/utils"
+
 	"database/sql"
 	"errors"
+	"fmt"
+	"io"
 	"log"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
-
-	"github.com/stripe/stripe-go/v84"
-	"github.com/stripe/stripe-go/v84/customer"
-	"github.com/stripe/stripe-go/v84/paymentintent"
-
-	_ "modernc.org/sqlite"
 )
 
-var db *sql.DB                  // 数据库连接器
-var dbMutex sync.Mutex          // 数据库操作锁，用于解决并发访问问题
-var dbMutexCustomers sync.Mutex // 客户数据库操作锁，用于解决并发访问问题
+// 数据库中时间字段统一使用的格式
+const timeLayout = "2006-01-02 15:04:05"
 
-var dbCustomers *sql.DB
+// sqlStore 基于database/sql的存储, SQLite与PostgreSQL共用同一套SQL
+// 语句统一使用?占位符, 由q转换为对应数据库的格式
+// 所有表都在同一个数据库中, 需要原子完成的多步修改使用事务
+type sqlStore struct {
+	db       *sql.DB
+	locks    *sql.DB // PostgreSQL持有咨询锁使用的连接池, 与db分开, 持有锁时不占用执行fn所需的连接
+	postgres bool
+}
 
+// InitDB 按DATABASE_URL打开数据库并执行迁移
+// 未配置时使用当前目录下的SQLite数据库, 以postgres://或postgresql://开头时使用PostgreSQL
 func InitDB() error {
 	var err error
-	db, err = sql.Open("sqlite", "./orders.db?cache=shared&journal_mode=WAL")
+	store, err = openStore(utils.GetEnvVariable("DATABASE_URL", ""))
 	if err != nil {
 		log.Fatal("打开数据库失败:", err)
 		return err
 	}
 
-	dbCustomers, err = sql.Open("sqlite", "./custormers.db?cache=shared&journal_mode=WAL")
-	if err != nil {
-		log.Fatal("打开数据库失败:", err)
+	// 按顺序执行尚未执行的迁移, 表结构都由migrations包中的SQL文件定义
+	if err = store.Migrate(); err != nil {
+		log.Fatal("执行数据库迁移失败:", err)
 		return err
 	}
 
-	// 设置连接池参数，减少锁竞争
-	db.SetMaxOpenConns(1)
-	db.SetMaxIdleConns(1)
-
-	dbCustomers.SetMaxOpenConns(1)
-	dbCustomers.SetMaxIdleConns(1)
-
-	// 创建订单表
-	sqlTable := `CREATE TABLE IF NOT EXISTS orders (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		order_id TEXT NOT NULL UNIQUE,
-		status TEXT NOT NULL,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		expires_at DATETIME NOT NULL
-	);`
+	log.Println("数据库初始化成功")
+	return nil
+}
 
-	_, err = db.Exec(sqlTable)
-	if err != nil {
-		log.Fatal("创建订单表失败:", err)
-		return err
+// PrintPendingMigrations 打开数据库并输出尚未执行的迁移, 不会执行任何迁移
+func PrintPendingMigrations(w io.Writer) error {
+	dsn := utils.GetEnvVariable("DATABASE_URL", "")
+	// 旧数据库的导入会创建新文件, 这里只做提示
+	if dsn == "" && sqliteImportPending() {
+		fmt.Fprintf(w, "下次启动时将把%s和%s导入到%s并执行所有迁移\n", legacyOrdersPath, legacyCustomersPath, sqlitePath)
+		return nil
 	}
-
-	// 客户记录表
-	sqlTable = `CREATE TABLE IF NOT EXISTS customers (
-		id TEXT PRIMARY KEY,
-		mail TEXT NOT NULL UNIQUE
-	)`
-	_, err = dbCustomers.Exec(sqlTable)
+	s, err := openStore(dsn)
 	if err != nil {
-		log.Fatal("创建客户表失败:", err)
 		return err
 	}
+	defer s.Close()
+	return s.PrintPendingMigrations(w)
+}
 
-	log.Println("数据库初始化成功")
-	return nil
+// openStore 根据DSN选择存储实现
+func openStore(dsn string) (Store, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return newPostgresStore(dsn)
+	}
+	if dsn != "" {
+		return nil, fmt.Errorf("不支持的DATABASE_URL, 仅支持postgres://或postgresql://")
+	}
+	return newSQLiteStore()
 }
 
 func CloseDb() {
-	db.Close()
+	if err := store.Close(); err != nil {
+		log.Printf("关闭数据库失败: %v", err)
+	}
 }
 
-func UpdateOrderStatus(orderID string, status string, ignoreLock bool) error {
-	if !ignoreLock { // 在DeleteExpiredOrder中, 会持有锁对象, 如果这里不忽略锁, 则会造成死锁
-		dbMutex.Lock()
-		defer dbMutex.Unlock()
-	} else {
-		log.Print("跳过锁检查")
+func (s *sqlStore) Close() error {
+	if s.locks != nil {
+		s.locks.Close()
 	}
-	query := "UPDATE orders SET status = ? WHERE order_id = ?"
-	_, err := db.Exec(query, status, orderID)
-	log.Print("SQL执行完成")
-	return err
+	return s.db.Close()
 }
 
-func IsOrderProcessed(orderID string) (bool, error) {
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
-
-	var count int
-	query := "SELECT COUNT(*) FROM orders WHERE order_id = ? AND status = 'succeeded'"
-	err := db.QueryRow(query, orderID).Scan(&count)
-	if err != nil {
-		return false, err
+// q 将语句中的?占位符转换为当前数据库使用的格式
+func (s *sqlStore) q(query string) string {
+	if !s.postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
 	}
-	return count > 0, nil
+	return b.String()
 }
 
-func RecordOrder(orderID string, status string, expiresAt time.Time) error {
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
-
-	query := "INSERT INTO orders (order_id, status, expires_at) VALUES (?, ?, ?)"
-	_, err := db.Exec(query, orderID, status, expiresAt.Format("2006-01-02 15:04:05"))
-	return err
+// utcNow 当前的UTC时间, 与created_at的默认值格式一致
+// 不使用CURRENT_TIMESTAMP, 因为PostgreSQL中它的格式与SQLite不同
+func utcNow() string {
+	return time.Now().UTC().Format(timeLayout)
 }
 
-func DeleteExpiredOrder() error {
-	dbMutex.Lock()
-	// log.Printf("开始查询过期订单...")
-
-	// 收集所有需要处理的过期订单ID
-	var expiredOrderIDs []string
-	nowTime := time.Now().Format("2006-01-02 15:04:05")
-	query := "SELECT order_id FROM orders WHERE status = 'created' AND expires_at < ?"
+// RecordOrder 记录新订单
+// 相同幂等键的重复请求会得到同一个PaymentIntent, 订单已存在时忽略
+// 新订单的创建同样记录为一次状态变更
+func (s *sqlStore) RecordOrder(order Order) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	// 先执行查询获取所有过期订单ID
-	rows, err := db.Query(query, nowTime)
+	provider := order.Provider
+	if provider == "" {
+		provider = payments.ProviderStripe
+	}
+	query := `INSERT INTO orders (order_id, status, expires_at, openwebui_user_id, email, site_type,
+		product_id, quantity, points, amount, currency, idempotency_key, coupon_code, discount, provider)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT(order_id) DO NOTHING`
+	result, err := tx.Exec(s.q(query), order.OrderID, string(order.Status), order.ExpiresAt.Format(timeLayout), order.OpenWebUIUserID, order.Email,
+		order.SiteType, order.ProductID, order.Quantity, order.Points, order.Amount.Amount, order.Amount.Currency, order.IdempotencyKey,
+		order.CouponCode, order.Discount.Amount, provider)
 	if err != nil {
-		log.Printf("查询过期订单失败: %v", err)
-		dbMutex.Unlock()
 		return err
 	}
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 0 {
+		return err
+	}
+	if err := s.recordOrderEvent(tx, OrderEvent{OrderID: order.OrderID, To: order.Status, Actor: OrderActorCheckout}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
+// ListExpiredOrders 查询已过期但仍未支付的订单
+func (s *sqlStore) ListExpiredOrders(now time.Time) ([]Order, error) {
+	query := "SELECT " + orderColumns + " WHERE o.status IN ('created', 'payment_failed') AND o.expires_at < ?"
+	rows, err := s.db.Query(s.q(query), now.Format(timeLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []Order
 	for rows.Next() {
-		var orderID string
-		err := rows.Scan(&orderID)
+		o, err := scanOrder(rows)
 		if err != nil {
-			log.Printf("扫描订单记录出错: %v", err)
-			continue
+			return nil, err
 		}
-		expiredOrderIDs = append(expiredOrderIDs, orderID)
+		orders = append(orders, o)
 	}
+	return orders, rows.Err()
+}
 
-	// 检查扫描过程是否有错误
-	if err = rows.Err(); err != nil {
-		log.Printf("扫描订单行时出错: %v", err)
-		rows.Close()
-		dbMutex.Unlock()
+// DeleteExpiredOrder 取消所有过期未支付的订单, 每个订单通过创建它的支付方查询和取消
+// onSucceeded 用于处理在过期前已经支付成功的订单
+func DeleteExpiredOrder(onSucceeded func(p payments.Payment) error) error {
+	// 收集所有需要处理的过期订单, 查询完成后再逐个调用支付方
+	expiredOrders, err := store.ListExpiredOrders(time.Now())
+	if err != nil {
+		log.Printf("查询过期订单失败: %v", err)
 		return err
 	}
-
-	rows.Close()
-	// 在处理订单前释放锁，避免死锁
-	dbMutex.Unlock()
-	if len(expiredOrderIDs) > 0 {
-		log.Printf("查询完成，共找到 %d 个过期订单", len(expiredOrderIDs))
+	if len(expiredOrders) > 0 {
+		log.Printf("查询完成，共找到 %d 个过期订单", len(expiredOrders))
 	}
 
-	// 处理每个过期订单，此时不再持有全局锁
+	// 处理每个过期订单
 	count := 0
-	for _, orderID := range expiredOrderIDs {
+	for _, order := range expiredOrders {
+		orderID := order.OrderID
 		count++
 		log.Printf("第 %d 个 - 发现过期订单: %s", count, orderID)
 
-		// 首先获取支付意图以检查其状态
-		pi, err := paymentintent.Get(orderID, nil)
+		// Checkout Session模式的订单在支付完成前以Session ID记录
+		if order.Provider == payments.ProviderStripe && strings.HasPrefix(orderID, "cs_") {
+			sweepCheckoutSession(orderID, onSucceeded)
+			continue
+		}
+
+		// 首先获取支付状态
+		provider, err := payments.For(order.Provider)
+		var p payments.Payment
+		if err == nil {
+			p, err = provider.Get(orderID)
+		}
 		if err != nil {
-			log.Printf("获取支付意图失败 %s: %v", orderID, err)
+			log.Printf("获取支付状态失败 %s: %v", orderID, err)
 			// 如果获取失败，仍然更新数据库状态
-			if err := UpdateOrderStatus(orderID, "error_retrieving", false); err != nil {
+			if err := TransitionOrderStatus(orderID, OrderErrorRetrieving, OrderActorSweeper, err.Error()); err != nil {
 				log.Printf("更新订单状态失败 %s: %v", orderID, err)
 			}
 			continue
 		}
 
-		// 检查支付意图是否可以取消
-		if pi.Status == stripe.PaymentIntentStatusCanceled ||
-			pi.Status == stripe.PaymentIntentStatusSucceeded ||
-			pi.Status == stripe.PaymentIntentStatusRequiresCapture {
-			log.Printf("支付意图 %s 状态为 %s，跳过取消操作", orderID, pi.Status)
-			// 根据状态更新本地数据库
-			var newStatus string
-			switch pi.Status {
-			case stripe.PaymentIntentStatusCanceled:
-				newStatus = "canceled"
-			case stripe.PaymentIntentStatusSucceeded:
-				newStatus = "succeeded"
-			case stripe.PaymentIntentStatusRequiresCapture:
-				newStatus = "requires_capture"
+		// 检查支付是否可以取消
+		switch p.Status {
+		case payments.StatusSucceeded:
+			// 已支付的订单交给发放流程处理, 避免只改状态而漏发积分
+			if onSucceeded != nil {
+				if err := onSucceeded(p); err != nil {
+					log.Printf("处理已支付订单失败 %s: %v", orderID, err)
+				}
+			} else {
+				log.Printf("第 %d 个订单已支付, 等待发放流程处理", count)
 			}
-			if err := UpdateOrderStatus(orderID, newStatus, false); err != nil {
+			log.Printf("第 %d 个订单处理完成", count)
+			continue
+		case payments.StatusCanceled, payments.StatusRequiresCapture:
+			log.Printf("支付 %s 状态为 %s，跳过取消操作", orderID, p.RawStatus)
+			newStatus := OrderCanceled
+			if p.Status == payments.StatusRequiresCapture {
+				newStatus = OrderRequiresCapture
+			}
+			if err := TransitionOrderStatus(orderID, newStatus, OrderActorSweeper, "支付方状态为"+p.RawStatus); err != nil {
 				log.Printf("更新订单状态失败 %s: %v", orderID, err)
 			}
 			log.Printf("第 %d 个订单处理完成", count)
 			continue
 		}
 
-		// 使用Stripe支持的取消原因 - 改为"abandoned"（已放弃）
-		params := &stripe.PaymentIntentCancelParams{
-			CancellationReason: stripe.String("abandoned"),
-		}
-
 		log.Printf("正在取消订单: %s", orderID)
-		_, err = paymentintent.Cancel(orderID, params)
+		err = provider.Cancel(orderID)
 		log.Printf("取消订单API调用完成，订单ID: %s", orderID)
 
 		if err != nil {
 			// 如果取消失败，记录错误但继续处理其他订单
 			log.Printf("取消过期订单失败 %s: %v", orderID, err)
 			// 即使取消API调用失败，也要更新数据库状态
-			if err := UpdateOrderStatus(orderID, "canceled_due_to_error", false); err != nil {
+			if err := TransitionOrderStatus(orderID, OrderCanceledDueToError, OrderActorSweeper, err.Error()); err != nil {
 				log.Printf("更新订单状态失败 %s: %v", orderID, err)
 			}
 			log.Printf("第 %d 个订单处理完成（取消失败）", count)
 			continue
 		}
 
-		if err := UpdateOrderStatus(orderID, "canceled", false); err != nil {
+		if err := TransitionOrderStatus(orderID, OrderCanceled, OrderActorSweeper, "订单已过期"); err != nil {
 			log.Printf("更新订单状态失败 %s: %v", orderID, err)
 			log.Printf("第 %d 个订单处理完成（更新状态失败）", count)
 			continue
@@ -226,13 +260,53 @@ func DeleteExpiredOrder() error {
 	return nil
 }
 
+// sweepCheckoutSession 处理过期的Checkout Session订单
+// 仍可支付的Session先使其过期, 避免订单取消后用户仍能付款; 已完成的改用PaymentIntent ID, 已支付的交给发放流程
+// 已完成但仍在处理中的支付(如银行转账)在下一轮按普通订单处理
+func sweepCheckoutSession(orderID string, onSucceeded func(p payments.Payment) error) {
+	cs, err := payments.Stripe().GetCheckoutSession(orderID)
+	if err != nil {
+		log.Printf("获取Checkout Session失败 %s: %v", orderID, err)
+		if err := TransitionOrderStatus(orderID, OrderErrorRetrieving, OrderActorSweeper, err.Error()); err != nil {
+			log.Printf("更新订单状态失败 %s: %v", orderID, err)
+		}
+		return
+	}
+
+	if cs.Status == payments.CheckoutOpen {
+		log.Printf("正在使Checkout Session过期: %s", orderID)
+		if cs, err = payments.Stripe().ExpireCheckoutSession(orderID); err != nil {
+			log.Printf("使Checkout Session过期失败 %s: %v", orderID, err)
+			if err := TransitionOrderStatus(orderID, OrderCanceledDueToError, OrderActorSweeper, err.Error()); err != nil {
+				log.Printf("更新订单状态失败 %s: %v", orderID, err)
+			}
+			return
+		}
+	}
+
+	if cs.Status == payments.CheckoutComplete && cs.PaymentIntentID != "" {
+		if err := AttachPaymentIntent(orderID, cs.PaymentIntentID, cs.Amount); err != nil {
+			log.Printf("更新订单的PaymentIntent失败 %s: %v", orderID, err)
+			return
+		}
+		if cs.Paid && onSucceeded != nil {
+			if err := onSucceeded(payments.Payment{ID: cs.PaymentIntentID, Provider: payments.ProviderStripe, Metadata: cs.Metadata}); err != nil {
+				log.Printf("处理已支付订单失败 %s: %v", cs.PaymentIntentID, err)
+			}
+		}
+		return
+	}
+
+	if err := TransitionOrderStatus(orderID, OrderCanceled, OrderActorSweeper, "Checkout Session已过期"); err != nil {
+		log.Printf("更新订单状态失败 %s: %v", orderID, err)
+		return
+	}
+	log.Printf("订单 %s 已取消", orderID)
+}
+
 func GetCustomerId(email string) (string, error) {
 	// 获取CustomerID , 如果不存在则新建
-	dbMutexCustomers.Lock()
-	var id string
-	sqlQuery := "SELECT id FROM customers WHERE mail = ?"
-	err := dbCustomers.QueryRow(sqlQuery, email).Scan(&id)
-	dbMutexCustomers.Unlock()
+	id, err := store.FindCustomerID(email)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			log.Print("客户: ", email, "不存在, 开始新建")
@@ -242,22 +316,11 @@ func GetCustomerId(email string) (string, error) {
 	} else {
 		return id, nil
 	}
-	// 调用Stripe创建新客户
-	params := &stripe.CustomerParams{
-		Email: stripe.String(email),
-	}
-
-	customerObj, err := customer.New(params)
+	// 通过Stripe支付方创建新客户
+	customerID, err := payments.Stripe().CreateCustomer(email)
 	if err != nil {
 		return "", err
 	}
-	// 写入数据库
-	dbMutexCustomers.Lock()
-	sqlQuery = "INSERT INTO customers (id, mail) VALUES (?, ?)"
-	_, err = dbCustomers.Exec(sqlQuery, customerObj.ID, email) // 写入数据库
-	dbMutexCustomers.Unlock()
-	if err != nil {
-		return customerObj.ID, err
-	}
-	return customerObj.ID, nil
+	// 写入数据库, 多个实例同时创建时以先写入的为准
+	return store.SaveCustomer(customerID, email)
 }
@@ -0,0 +1,272 @@
+package database
+
+import (
+	"breathaipay/money"
+
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 发放任务状态
+const (
+	JobStatusPending   = "pending"   // 等待执行(包括等待重试)
+	JobStatusRunning   = "running"   // 已被某个worker领取
+	JobStatusSucceeded = "succeeded" // 积分已发放
+	JobStatusDead      = "dead"      // 多次失败, 进入死信状态等待人工处理
+)
+
+// FulfillmentJob 一个积分发放任务, 每个PaymentIntent最多对应一个任务
+// 订阅账单的任务没有对应的订单, 以账单ID作为PaymentIntentID
+type FulfillmentJob struct {
+	PaymentIntentID string
+	Source          string // 积分流水的来源, 购买为purchase, 订阅账单为subscription
+	OpenWebUIUserID string // 下单时查到的用户ID, 为空时按邮箱查找用户
+	Email           string
+	SiteType        string
+	Points          int64
+	Status          string
+	Attempts        int
+	LastError       string
+	NextRunAt       time.Time
+	CreditStarted   bool // 之前的尝试已经开始写入余额, 但没有记录结果
+}
+
+const fulfillmentJobColumns = `payment_intent_id, source, openwebui_user_id, email, site_type, points, status, attempts, last_error, next_run_at,
+	credit_started_at IS NOT NULL FROM fulfillment_jobs`
+
+// scanFulfillmentJob 读取一行fulfillmentJobColumns
+func scanFulfillmentJob(row interface{ Scan(dest ...any) error }) (FulfillmentJob, error) {
+	var job FulfillmentJob
+	var nextRunAt string
+	err := row.Scan(&job.PaymentIntentID, &job.Source, &job.OpenWebUIUserID, &job.Email, &job.SiteType, &job.Points, &job.Status, &job.Attempts, &job.LastError, &nextRunAt, &job.CreditStarted)
+	if err != nil {
+		return FulfillmentJob{}, err
+	}
+	job.NextRunAt = parseDBTime(nextRunAt, time.UTC)
+	return job, nil
+}
+
+// ErrAmountMismatch 支付金额与订单金额不一致, 订单已变更为amount_mismatch, 不发放积分
+var ErrAmountMismatch = errors.New("支付金额与订单金额不一致")
+
+// ClaimOrderForFulfillment 将订单原子地变更为fulfilling(发放中), 并在同一事务中写入发放任务
+// 只有状态机允许变更到fulfilling的订单可以被认领, 并发调用时只有一个能认领成功, 返回false表示订单已经被处理过
+// paid为支付方返回的实际支付金额, 与订单金额不一致时订单变更为amount_mismatch并返回ErrAmountMismatch, 为零值时不核对
+// 积分发放成功后订单状态变为succeeded
+func (s *sqlStore) ClaimOrderForFulfillment(job FulfillmentJob, paid money.Money, actor string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if paid.Currency != "" {
+		if err := s.checkPaidAmountTx(tx, job.PaymentIntentID, paid, actor); err != nil {
+			if errors.Is(err, ErrAmountMismatch) {
+				if commitErr := tx.Commit(); commitErr != nil {
+					return false, commitErr
+				}
+			}
+			if errors.Is(err, ErrIllegalTransition) || errors.Is(err, sql.ErrNoRows) {
+				return false, nil
+			}
+			return false, err
+		}
+	}
+
+	// 订单不存在、已经在发放中或者已经完成时都不能再次认领
+	from, err := s.transitionTx(tx, job.PaymentIntentID, OrderFulfilling, actor, "支付成功")
+	if errors.Is(err, ErrIllegalTransition) || errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil || from == OrderFulfilling {
+		return false, err
+	}
+
+	// 记录实际发放的积分, 并补全旧订单缺少的邮箱和站点
+	query := `UPDATE orders SET points = ?, email = CASE WHEN email = '' THEN ? ELSE email END,
+		site_type = CASE WHEN site_type = '' THEN ? ELSE site_type END WHERE order_id = ?`
+	if _, err := tx.Exec(s.q(query), job.Points, job.Email, job.SiteType, job.PaymentIntentID); err != nil {
+		return false, err
+	}
+	// 积分发放给下单时查到的用户
+	if err := tx.QueryRow(s.q("SELECT openwebui_user_id FROM orders WHERE order_id = ?"), job.PaymentIntentID).Scan(&job.OpenWebUIUserID); err != nil {
+		return false, err
+	}
+	// 优惠码在支付成功后才计入使用次数
+	if err := s.redeemCouponTx(tx, job.PaymentIntentID); err != nil {
+		return false, err
+	}
+
+	job.Source = LedgerSourcePurchase
+	if err := s.insertFulfillmentJobTx(tx, job); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// insertFulfillmentJobTx 在事务中写入一个立即执行的发放任务, 任务已存在时不做任何事
+func (s *sqlStore) insertFulfillmentJobTx(tx *sql.Tx, job FulfillmentJob) error {
+	query := `INSERT INTO fulfillment_jobs (payment_intent_id, source, openwebui_user_id, email, site_type, points, status, next_run_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (payment_intent_id) DO NOTHING`
+	_, err := tx.Exec(s.q(query), job.PaymentIntentID, job.Source, job.OpenWebUIUserID, job.Email, job.SiteType, job.Points, JobStatusPending, utcNow())
+	return err
+}
+
+// checkPaidAmountTx 核对实际支付金额, 不一致时将订单变更为amount_mismatch并返回ErrAmountMismatch
+// 旧版本的订单没有记录金额, 不核对; 订单已经处于amount_mismatch时返回ErrIllegalTransition, 不重复记录
+func (s *sqlStore) checkPaidAmountTx(tx *sql.Tx, orderID string, paid money.Money, actor string) error {
+	var amount int64
+	var currency string
+	if err := tx.QueryRow(s.q("SELECT amount, currency FROM orders WHERE order_id = ?"), orderID).Scan(&amount, &currency); err != nil {
+		return err
+	}
+	expected := money.New(amount, currency)
+	if amount <= 0 || paid == expected {
+		return nil
+	}
+
+	reason := fmt.Sprintf("支付金额 %s 与订单金额 %s 不一致", paid, expected)
+	from, err := s.transitionTx(tx, orderID, OrderAmountMismatch, actor, reason)
+	if err != nil {
+		return err
+	}
+	if from == OrderAmountMismatch {
+		return fmt.Errorf("%w: %s 已等待人工核对", ErrIllegalTransition, orderID)
+	}
+	return fmt.Errorf("%w: %s %s", ErrAmountMismatch, orderID, reason)
+}
+
+// ClaimDueFulfillmentJobs 领取最多limit个到期的任务, 并将其标记为执行中
+// 逐个使用条件更新领取, 多个实例同时查询到同一个任务时只有一个能领取成功
+func (s *sqlStore) ClaimDueFulfillmentJobs(limit int) ([]FulfillmentJob, error) {
+	query := "SELECT " + fulfillmentJobColumns + " WHERE status = ? AND next_run_at <= ? ORDER BY next_run_at LIMIT ?"
+	rows, err := s.db.Query(s.q(query), JobStatusPending, utcNow(), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var due []FulfillmentJob
+	for rows.Next() {
+		job, err := scanFulfillmentJob(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		due = append(due, job)
+	}
+	if err = rows.Err(); err != nil {
+		rows.Close()
+		return nil, err
+	}
+	rows.Close()
+
+	var jobs []FulfillmentJob
+	for _, job := range due {
+		query = "UPDATE fulfillment_jobs SET status = ?, updated_at = ? WHERE payment_intent_id = ? AND status = ?"
+		result, err := s.db.Exec(s.q(query), JobStatusRunning, utcNow(), job.PaymentIntentID, JobStatusPending)
+		if err != nil {
+			return jobs, err
+		}
+		if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+			continue
+		}
+		job.Status = JobStatusRunning
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// RecordFulfillmentAttempt 记录一次发放尝试及其结果, 并更新任务状态
+// status为pending时任务将在nextRunAt之后重试
+func (s *sqlStore) RecordFulfillmentAttempt(paymentIntentID string, attempt int, status string, errMsg string, nextRunAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.recordAttemptTx(tx, paymentIntentID, attempt, status, errMsg, nextRunAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// StartFulfillmentCredit 在写入余额之前标记任务, 写入后进程退出时下一次尝试据此判断积分可能已经到账
+func (s *sqlStore) StartFulfillmentCredit(paymentIntentID string) error {
+	query := "UPDATE fulfillment_jobs SET credit_started_at = ?, updated_at = ? WHERE payment_intent_id = ?"
+	_, err := s.db.Exec(s.q(query), utcNow(), utcNow(), paymentIntentID)
+	return err
+}
+
+// ClearFulfillmentCredit 确认余额没有写入后清除标记, 任务可以安全地重试
+func (s *sqlStore) ClearFulfillmentCredit(paymentIntentID string) error {
+	query := "UPDATE fulfillment_jobs SET credit_started_at = NULL, updated_at = ? WHERE payment_intent_id = ?"
+	_, err := s.db.Exec(s.q(query), utcNow(), paymentIntentID)
+	return err
+}
+
+// CompleteFulfillment 在同一事务中写入积分流水并将任务记录为发放成功, entry为nil时只记录结果
+// 流水与任务状态同时提交, 之后的尝试可以通过流水确认积分已经到账
+func (s *sqlStore) CompleteFulfillment(paymentIntentID string, attempt int, entry *LedgerEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if entry != nil {
+		if err := s.recordLedgerEntryTx(tx, *entry); err != nil {
+			return err
+		}
+	}
+	if err := s.recordAttemptTx(tx, paymentIntentID, attempt, JobStatusSucceeded, "", time.Now()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// recordAttemptTx 在事务中记录一次发放尝试并更新任务状态, 发放成功时同时完成订单或订阅账单
+func (s *sqlStore) recordAttemptTx(tx *sql.Tx, paymentIntentID string, attempt int, status string, errMsg string, nextRunAt time.Time) error {
+	query := "INSERT INTO fulfillment_attempts (payment_intent_id, attempt, outcome, error) VALUES (?, ?, ?, ?)"
+	if _, err := tx.Exec(s.q(query), paymentIntentID, attempt, status, errMsg); err != nil {
+		return err
+	}
+
+	query = `UPDATE fulfillment_jobs SET status = ?, attempts = ?, last_error = ?, next_run_at = ?, updated_at = ?
+		WHERE payment_intent_id = ?`
+	if _, err := tx.Exec(s.q(query), status, attempt, errMsg, nextRunAt.UTC().Format(timeLayout), utcNow(), paymentIntentID); err != nil {
+		return err
+	}
+
+	// 发放期间订单可能已经退款, 此时只记录发放时间, 状态保持不变; 订阅账单没有订单, 同时将账单标记为已发放
+	if status == JobStatusSucceeded {
+		query = "UPDATE subscription_invoices SET status = ? WHERE invoice_id = ? AND status = ?"
+		if _, err := tx.Exec(s.q(query), InvoiceGrantGranted, paymentIntentID, InvoiceGrantGranting); err != nil {
+			return err
+		}
+		query = "UPDATE orders SET fulfilled_at = ? WHERE order_id = ? AND fulfilled_at IS NULL"
+		if _, err := tx.Exec(s.q(query), utcNow(), paymentIntentID); err != nil {
+			return err
+		}
+		reason := fmt.Sprintf("第 %d 次尝试发放成功", attempt)
+		_, err := s.transitionTx(tx, paymentIntentID, OrderSucceeded, OrderActorFulfillment, reason)
+		if err != nil && !errors.Is(err, ErrIllegalTransition) && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResetRunningFulfillmentJobs 将在staleBefore之前领取且仍在执行中的任务放回队列
+// 这些任务的worker已经退出或卡住, 其他实例正在执行的任务不受影响
+func (s *sqlStore) ResetRunningFulfillmentJobs(staleBefore time.Time) (int64, error) {
+	query := "UPDATE fulfillment_jobs SET status = ?, updated_at = ? WHERE status = ? AND updated_at < ?"
+	result, err := s.db.Exec(s.q(query), JobStatusPending, utcNow(), JobStatusRunning, staleBefore.UTC().Format(timeLayout))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
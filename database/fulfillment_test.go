@@ -0,0 +1,229 @@
+package database
+
+import (
+	"breathaipay/money"
+
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestStore 在临时目录中打开一个执行过全部迁移的SQLite数据库
+func newTestStore(t *testing.T) *sqlStore {
+	t.Helper()
+	s, err := openSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if err := s.Migrate(); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	return s
+}
+
+// recordTestOrder 记录一个等待支付的订单
+func recordTestOrder(t *testing.T, s *sqlStore, order Order) {
+	t.Helper()
+	order.Status = OrderCreated
+	order.ExpiresAt = time.Now().Add(30 * time.Minute)
+	if order.Email == "" {
+		order.Email = "a@b.c"
+	}
+	order.SiteType = "international"
+	order.Points = 100000
+	if err := s.RecordOrder(order); err != nil {
+		t.Fatalf("RecordOrder() error = %v", err)
+	}
+}
+
+func testJob(orderID string) FulfillmentJob {
+	return FulfillmentJob{PaymentIntentID: orderID, Email: "a@b.c", SiteType: "international", Points: 100000}
+}
+
+func TestIllegalTransitions(t *testing.T) {
+	s := newTestStore(t)
+	tests := []struct {
+		name string
+		path []OrderStatus // 依次变更, 最后一步不允许
+	}{
+		{"未支付直接完成", []OrderStatus{OrderSucceeded}},
+		{"取消后支付", []OrderStatus{OrderCanceled, OrderFulfilling}},
+		{"发放中取消", []OrderStatus{OrderFulfilling, OrderCanceled}},
+		{"完成后回到发放中", []OrderStatus{OrderFulfilling, OrderSucceeded, OrderFulfilling}},
+		{"全额退款后部分退款", []OrderStatus{OrderFulfilling, OrderRefunded, OrderPartiallyRefunded}},
+		{"金额不一致后完成", []OrderStatus{OrderAmountMismatch, OrderSucceeded}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orderID := "pi_transition_" + string(rune('a'+i))
+			recordTestOrder(t, s, Order{OrderID: orderID})
+			last := len(tt.path) - 1
+			for _, to := range tt.path[:last] {
+				if err := s.TransitionOrderStatus(orderID, to, OrderActorAdmin, ""); err != nil {
+					t.Fatalf("TransitionOrderStatus(%s) error = %v", to, err)
+				}
+			}
+			before, err := s.GetOrder(orderID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.TransitionOrderStatus(orderID, tt.path[last], OrderActorAdmin, "")
+			if !errors.Is(err, ErrIllegalTransition) {
+				t.Fatalf("TransitionOrderStatus(%s) error = %v, want %v", tt.path[last], err, ErrIllegalTransition)
+			}
+			after, err := s.GetOrder(orderID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if after.Status != before.Status {
+				t.Errorf("被拒绝的变更修改了订单状态: %s -> %s", before.Status, after.Status)
+			}
+			events, err := s.ListOrderEvents(orderID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != len(tt.path) {
+				t.Errorf("状态变更记录 %d 条, want %d", len(events), len(tt.path))
+			}
+		})
+	}
+
+	if err := s.TransitionOrderStatus("pi_missing", OrderCanceled, OrderActorAdmin, ""); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("TransitionOrderStatus() 订单不存在时 error = %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+func TestClaimOrderTwice(t *testing.T) {
+	s := newTestStore(t)
+	recordTestOrder(t, s, Order{OrderID: "pi_claim", Amount: money.New(2000, "cny")})
+
+	claimed, err := s.ClaimOrderForFulfillment(testJob("pi_claim"), money.New(2000, "cny"), OrderActorWebhook)
+	if err != nil || !claimed {
+		t.Fatalf("第一次认领 = %v, %v, want true", claimed, err)
+	}
+	// 成功页与Webhook同时到达时, 第二次认领不会再写入发放任务
+	claimed, err = s.ClaimOrderForFulfillment(testJob("pi_claim"), money.New(2000, "cny"), OrderActorSuccessPage)
+	if err != nil || claimed {
+		t.Fatalf("第二次认领 = %v, %v, want false", claimed, err)
+	}
+
+	order, err := s.GetOrder("pi_claim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Status != OrderFulfilling {
+		t.Errorf("订单状态 = %s, want %s", order.Status, OrderFulfilling)
+	}
+
+	// 发放任务同样只能被领取一次
+	jobs, err := s.ClaimDueFulfillmentJobs(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].PaymentIntentID != "pi_claim" || jobs[0].Points != 100000 || jobs[0].Source != LedgerSourcePurchase {
+		t.Fatalf("ClaimDueFulfillmentJobs() = %+v", jobs)
+	}
+	if jobs, err := s.ClaimDueFulfillmentJobs(10); err != nil || len(jobs) != 0 {
+		t.Fatalf("再次领取 = %+v, %v, want 空", jobs, err)
+	}
+
+	if err := s.CompleteFulfillment("pi_claim", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if order, _ := s.GetOrder("pi_claim"); order.Status != OrderSucceeded {
+		t.Errorf("发放后订单状态 = %s, want %s", order.Status, OrderSucceeded)
+	}
+	if claimed, err := s.ClaimOrderForFulfillment(testJob("pi_claim"), money.New(2000, "cny"), OrderActorSweeper); err != nil || claimed {
+		t.Errorf("发放完成后认领 = %v, %v, want false", claimed, err)
+	}
+}
+
+func TestClaimAmountMismatch(t *testing.T) {
+	s := newTestStore(t)
+	recordTestOrder(t, s, Order{OrderID: "pi_mismatch", Amount: money.New(2000, "cny")})
+
+	claimed, err := s.ClaimOrderForFulfillment(testJob("pi_mismatch"), money.New(1000, "cny"), OrderActorWebhook)
+	if !errors.Is(err, ErrAmountMismatch) || claimed {
+		t.Fatalf("ClaimOrderForFulfillment() = %v, %v, want false, %v", claimed, err, ErrAmountMismatch)
+	}
+
+	// 状态变更在返回错误的同时提交, 不写入发放任务
+	order, err := s.GetOrder("pi_mismatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Status != OrderAmountMismatch {
+		t.Errorf("订单状态 = %s, want %s", order.Status, OrderAmountMismatch)
+	}
+	if _, err := s.GetFulfillmentJob("pi_mismatch"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetFulfillmentJob() error = %v, want %v", err, sql.ErrNoRows)
+	}
+
+	// 重复的通知不会重复记录, 也不会发放
+	claimed, err = s.ClaimOrderForFulfillment(testJob("pi_mismatch"), money.New(1000, "cny"), OrderActorWebhook)
+	if err != nil || claimed {
+		t.Fatalf("再次认领 = %v, %v, want false, nil", claimed, err)
+	}
+	events, err := s.ListOrderEvents("pi_mismatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[1].To != OrderAmountMismatch {
+		t.Errorf("状态变更记录 = %+v, want created, amount_mismatch", events)
+	}
+
+	// 管理员核对后确认发放, 不再核对金额
+	claimed, err = s.ClaimOrderForFulfillment(testJob("pi_mismatch"), money.Money{}, OrderActorAdmin)
+	if err != nil || !claimed {
+		t.Fatalf("确认发放 = %v, %v, want true", claimed, err)
+	}
+}
+
+func TestFulfillmentNextRunAtUTC(t *testing.T) {
+	// 多个实例可能使用不同的时区, 下次执行时间与updated_at一样以UTC保存
+	local := time.Local
+	time.Local = time.FixedZone("UTC+8", 8*60*60)
+	t.Cleanup(func() { time.Local = local })
+
+	s := newTestStore(t)
+	recordTestOrder(t, s, Order{OrderID: "pi_retry"})
+	if _, err := s.ClaimOrderForFulfillment(testJob("pi_retry"), money.Money{}, OrderActorWebhook); err != nil {
+		t.Fatal(err)
+	}
+	if jobs, err := s.ClaimDueFulfillmentJobs(10); err != nil || len(jobs) != 1 {
+		t.Fatalf("ClaimDueFulfillmentJobs() = %+v, %v", jobs, err)
+	}
+
+	nextRunAt := time.Now().Add(time.Minute).Truncate(time.Second)
+	if err := s.RecordFulfillmentAttempt("pi_retry", 1, JobStatusPending, "timeout", nextRunAt); err != nil {
+		t.Fatal(err)
+	}
+	var stored string
+	if err := s.db.QueryRow("SELECT next_run_at FROM fulfillment_jobs WHERE payment_intent_id = ?", "pi_retry").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if want := nextRunAt.UTC().Format(timeLayout); parseDBTime(stored, time.UTC).UTC().Format(timeLayout) != want {
+		t.Errorf("next_run_at = %q, want %q", stored, want)
+	}
+	job, err := s.GetFulfillmentJob("pi_retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !job.NextRunAt.Equal(nextRunAt) {
+		t.Errorf("NextRunAt = %v, want %v", job.NextRunAt, nextRunAt)
+	}
+	// 未到下次执行时间时不能领取
+	if jobs, err := s.ClaimDueFulfillmentJobs(10); err != nil || len(jobs) != 0 {
+		t.Fatalf("ClaimDueFulfillmentJobs() = %+v, %v, want 空", jobs, err)
+	}
+
+	if err := s.RecordFulfillmentAttempt("pi_retry", 2, JobStatusPending, "timeout", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if jobs, err := s.ClaimDueFulfillmentJobs(10); err != nil || len(jobs) != 1 {
+		t.Fatalf("ClaimDueFulfillmentJobs() = %+v, %v, want 1", jobs, err)
+	}
+}
@@ -0,0 +1,110 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// 积分流水来源
+const (
+	LedgerSourcePurchase     = "purchase"     // 购买
+	LedgerSourceRefund       = "refund"       // 退款扣回
+	LedgerSourceManual       = "manual"       // 人工调整
+	LedgerSourcePromo        = "promo"        // 活动赠送
+	LedgerSourceVoucher      = "voucher"      // 兑换码
+	LedgerSourceSubscription = "subscription" // 订阅套餐每期发放
+)
+
+// LedgerEntry 一条积分流水, 每次修改OpenWebUI余额都会写入一条
+type LedgerEntry struct {
+	OrderID         string
+	OpenWebUIUserID string
+	Email           string
+	Site            string
+	Delta           int64
+	BalanceBefore   int64
+	BalanceAfter    int64
+	Source          string
+	Mismatch        bool // 写入后余额与预期不一致
+	CreatedAt       time.Time
+}
+
+// LedgerFilter 积分流水查询条件, 零值表示不过滤
+type LedgerFilter struct {
+	OrderID         string
+	OpenWebUIUserID string
+	Email           string
+	Limit           int
+	Offset          int
+}
+
+const insertLedgerEntry = `INSERT INTO credit_ledger (order_id, openwebui_user_id, email, site, delta, balance_before, balance_after, source, mismatch)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// RecordLedgerEntry 写入一条积分流水
+func (s *sqlStore) RecordLedgerEntry(entry LedgerEntry) error {
+	_, err := s.db.Exec(s.q(insertLedgerEntry), entry.OrderID, entry.OpenWebUIUserID, entry.Email, entry.Site, entry.Delta,
+		entry.BalanceBefore, entry.BalanceAfter, entry.Source, entry.Mismatch)
+	return err
+}
+
+// recordLedgerEntryTx 在事务中写入一条积分流水
+func (s *sqlStore) recordLedgerEntryTx(tx *sql.Tx, entry LedgerEntry) error {
+	_, err := tx.Exec(s.q(insertLedgerEntry), entry.OrderID, entry.OpenWebUIUserID, entry.Email, entry.Site, entry.Delta,
+		entry.BalanceBefore, entry.BalanceAfter, entry.Source, entry.Mismatch)
+	return err
+}
+
+// HasLedgerEntry 判断订单是否已有该来源的积分流水, 用于确认积分是否已经到账
+func (s *sqlStore) HasLedgerEntry(orderID string, source string) (bool, error) {
+	var exists bool
+	query := "SELECT EXISTS (SELECT 1 FROM credit_ledger WHERE order_id = ? AND source = ?)"
+	err := s.db.QueryRow(s.q(query), orderID, source).Scan(&exists)
+	return exists, err
+}
+
+// ListLedgerEntries 按条件查询积分流水, 按时间倒序排列
+func (s *sqlStore) ListLedgerEntries(filter LedgerFilter) ([]LedgerEntry, error) {
+	query := `SELECT order_id, openwebui_user_id, email, site, delta, balance_before, balance_after, source, mismatch, created_at
+		FROM credit_ledger`
+	var conditions []string
+	var args []any
+	if filter.OrderID != "" {
+		conditions = append(conditions, "order_id = ?")
+		args = append(args, filter.OrderID)
+	}
+	if filter.OpenWebUIUserID != "" {
+		conditions = append(conditions, "openwebui_user_id = ?")
+		args = append(args, filter.OpenWebUIUserID)
+	}
+	if filter.Email != "" {
+		conditions = append(conditions, "email = ?")
+		args = append(args, filter.Email)
+	}
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ? OFFSET ?"
+	args = append(args, filter.Limit, filter.Offset)
+
+	rows, err := s.db.Query(s.q(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []LedgerEntry
+	for rows.Next() {
+		var e LedgerEntry
+		var createdAt string
+		err := rows.Scan(&e.OrderID, &e.OpenWebUIUserID, &e.Email, &e.Site, &e.Delta,
+			&e.BalanceBefore, &e.BalanceAfter, &e.Source, &e.Mismatch, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		e.CreatedAt = parseDBTime(createdAt, time.UTC)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,112 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// 等待锁的最长时间, 超时后返回ErrLockTimeout, 由调用者稍后重试
+const lockWaitTimeout = 2 * time.Minute
+
+// SQLite锁的租期, 持有锁的实例异常退出后, 租期结束时其他实例可以接管
+// 需要大于一次加锁操作的最长耗时, 与发放任务的超时时间相同
+const lockLease = 10 * time.Minute
+
+// PostgreSQL锁连接池的连接数, 即可以同时持有的咨询锁数量
+const maxLockConns = 20
+
+// SQLite等待锁时的轮询间隔
+const lockPollInterval = 200 * time.Millisecond
+
+// ErrLockTimeout 等待锁超时
+var ErrLockTimeout = errors.New("等待锁超时")
+
+// WithLock 在名为name的锁内执行fn, 多个实例之间同样串行执行
+// PostgreSQL使用会话级咨询锁; SQLite使用locks表中的一行, 以条件更新获取
+func (s *sqlStore) WithLock(name string, fn func() error) error {
+	if s.postgres {
+		return s.withAdvisoryLock(name, fn)
+	}
+	return s.withLockRow(name, fn)
+}
+
+// withAdvisoryLock 在锁连接池的一个连接上获取会话级咨询锁后执行fn, 执行完成后释放
+// 等待连接和等待锁都受lockWaitTimeout限制; fn中的数据库操作使用db连接池, 不会与持有锁的连接互相等待
+// 键的第一部分固定为4399, 与迁移使用的单键咨询锁不会冲突
+func (s *sqlStore) withAdvisoryLock(name string, fn func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), lockWaitTimeout)
+	defer cancel()
+	conn, err := s.locks.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrLockTimeout, name, err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock(4399, hashtext($1))", name); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrLockTimeout, name, err)
+	}
+	defer func() {
+		var unlocked bool
+		err := conn.QueryRowContext(context.Background(), "SELECT pg_advisory_unlock(4399, hashtext($1))", name).Scan(&unlocked)
+		if err == nil && unlocked {
+			return
+		}
+		// 无法确认锁已释放时丢弃该连接, 会话结束时锁随之释放
+		log.Printf("释放咨询锁失败 (%s): %v", name, err)
+		conn.Raw(func(any) error { return driver.ErrBadConn })
+	}()
+	return fn()
+}
+
+// withLockRow 获取locks表中的锁后执行fn, 执行完成后释放
+func (s *sqlStore) withLockRow(name string, fn func() error) error {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	owner := hex.EncodeToString(b)
+
+	deadline := time.Now().Add(lockWaitTimeout)
+	for {
+		acquired, err := s.acquireLockRow(name, owner)
+		if err != nil {
+			return err
+		}
+		if acquired {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: %s", ErrLockTimeout, name)
+		}
+		time.Sleep(lockPollInterval)
+	}
+	defer func() {
+		if _, err := s.db.Exec(s.q("DELETE FROM locks WHERE name = ? AND owner = ?"), name, owner); err != nil {
+			log.Printf("释放锁失败 (%s): %v", name, err)
+		}
+	}()
+	return fn()
+}
+
+// acquireLockRow 锁不存在或租期已过时获取成功, 并发获取时只有一个能写入
+func (s *sqlStore) acquireLockRow(name string, owner string) (bool, error) {
+	now := time.Now().UTC()
+	query := `INSERT INTO locks (name, owner, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET owner = excluded.owner, expires_at = excluded.expires_at
+		WHERE locks.expires_at <= ?`
+	result, err := s.db.Exec(s.q(query), name, owner, now.Add(lockLease).Format(timeLayout), now.Format(timeLayout))
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
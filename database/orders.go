@@ -0,0 +1,185 @@
+package database
+
+import (
+	"breathaipay/money"
+
+	"strings"
+	"time"
+)
+
+// Order 订单信息, 发放状态来自发放任务, 未支付的订单该字段为空
+type Order struct {
+	OrderID           string
+	Status            OrderStatus
+	CreatedAt         time.Time
+	ExpiresAt         time.Time
+	PaidAt            time.Time // 未支付时为零值
+	FulfilledAt       time.Time // 积分未发放时为零值
+	Email             string
+	SiteType          string
+	OpenWebUIUserID   string // 下单时在所选站点上查到的用户ID
+	ProductID         int
+	Quantity          int
+	Points            int64
+	Amount            money.Money // 支付金额, 旧版本的订单为0
+	CouponCode        string
+	Discount          money.Money // 优惠金额
+	IdempotencyKey    string      // 前端提交的幂等键, 同时用作Stripe的Idempotency-Key
+	Provider          string      // 处理该订单的支付方, 为空时记录为Stripe
+	FulfillmentStatus string
+}
+
+// OrderFilter 订单查询条件, 零值表示不过滤
+type OrderFilter struct {
+	Status   string
+	Email    string
+	SiteType string
+	From     time.Time // 包含
+	To       time.Time // 不包含
+	Limit    int
+	Offset   int
+}
+
+// 查询订单时选择的列, 与scanOrder的顺序一致
+const orderColumns = `o.order_id, o.status, o.created_at, o.expires_at, COALESCE(o.paid_at, ''), COALESCE(o.fulfilled_at, ''),
+	o.email, o.site_type, o.openwebui_user_id, o.product_id, o.quantity, o.points, o.amount, o.currency, o.idempotency_key,
+	o.coupon_code, o.discount, o.provider, COALESCE(j.status, '')
+	FROM orders o LEFT JOIN fulfillment_jobs j ON j.payment_intent_id = o.order_id`
+
+// scanOrder 读取一行orderColumns
+func scanOrder(row interface{ Scan(dest ...any) error }) (Order, error) {
+	var o Order
+	var createdAt, expiresAt, paidAt, fulfilledAt, currency string
+	var amount, discount int64
+	err := row.Scan(&o.OrderID, &o.Status, &createdAt, &expiresAt, &paidAt, &fulfilledAt,
+		&o.Email, &o.SiteType, &o.OpenWebUIUserID, &o.ProductID, &o.Quantity, &o.Points, &amount, &currency, &o.IdempotencyKey,
+		&o.CouponCode, &discount, &o.Provider, &o.FulfillmentStatus)
+	if err != nil {
+		return Order{}, err
+	}
+	// 金额以最小货币单位保存, 币种保存在currency列
+	o.Amount = money.New(amount, currency)
+	o.Discount = money.New(discount, currency)
+	// created_at、paid_at与fulfilled_at均为UTC时间
+	o.CreatedAt = parseDBTime(createdAt, time.UTC)
+	o.ExpiresAt = parseDBTime(expiresAt, time.Local)
+	o.PaidAt = parseDBTime(paidAt, time.UTC)
+	o.FulfilledAt = parseDBTime(fulfilledAt, time.UTC)
+	return o, nil
+}
+
+// ListOrders 按条件查询订单, 按创建时间倒序排列
+func (s *sqlStore) ListOrders(filter OrderFilter) ([]Order, error) {
+	query := "SELECT " + orderColumns
+	var conditions []string
+	var args []any
+	if filter.Status != "" {
+		conditions = append(conditions, "o.status = ?")
+		args = append(args, filter.Status)
+	}
+	if filter.Email != "" {
+		conditions = append(conditions, "o.email = ?")
+		args = append(args, filter.Email)
+	}
+	if filter.SiteType != "" {
+		conditions = append(conditions, "o.site_type = ?")
+		args = append(args, filter.SiteType)
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "o.created_at >= ?")
+		args = append(args, filter.From.UTC().Format(timeLayout))
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "o.created_at < ?")
+		args = append(args, filter.To.UTC().Format(timeLayout))
+	}
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY o.id DESC LIMIT ? OFFSET ?"
+	args = append(args, filter.Limit, filter.Offset)
+
+	rows, err := s.db.Query(s.q(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []Order
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
+
+// GetOrder 按订单号获取订单, 不存在时返回sql.ErrNoRows
+func (s *sqlStore) GetOrder(orderID string) (Order, error) {
+	return scanOrder(s.db.QueryRow(s.q("SELECT "+orderColumns+" WHERE o.order_id = ?"), orderID))
+}
+
+// FindPendingOrder 查找相同邮箱、站点、商品、数量和优惠码且尚未过期的待支付订单, 用于复用已创建的PaymentIntent
+// 没有符合条件的订单时返回sql.ErrNoRows
+func (s *sqlStore) FindPendingOrder(email string, siteType string, productID int, quantity int, couponCode string) (Order, error) {
+	query := "SELECT " + orderColumns + ` WHERE o.email = ? AND o.site_type = ? AND o.product_id = ? AND o.quantity = ?
+		AND o.coupon_code = ? AND o.status = 'created' AND o.expires_at > ? ORDER BY o.id DESC LIMIT 1`
+	return scanOrder(s.db.QueryRow(s.q(query), email, siteType, productID, quantity, couponCode, time.Now().Format(timeLayout)))
+}
+
+// AttachPaymentIntent 将以Checkout Session ID记录的订单改为使用支付完成后的PaymentIntent ID
+// 之后的发放、退款和后台查询都与普通订单一致; 金额以实际支付的金额为准, 可能包含税费和Stripe优惠码
+// 订单已经改过或不存在时不做任何事
+func (s *sqlStore) AttachPaymentIntent(orderID string, paymentIntentID string, amount money.Money) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "UPDATE orders SET order_id = ?, amount = ?, currency = ? WHERE order_id = ?"
+	result, err := tx.Exec(s.q(query), paymentIntentID, amount.Amount, amount.Currency, orderID)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 0 {
+		return err
+	}
+	if _, err := tx.Exec(s.q("UPDATE order_events SET order_id = ? WHERE order_id = ?"), paymentIntentID, orderID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListOrderStatuses 获取订单表中出现过的所有状态, 用于筛选
+func (s *sqlStore) ListOrderStatuses() ([]string, error) {
+	rows, err := s.db.Query("SELECT DISTINCT status FROM orders ORDER BY status")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var statuses []string
+	for rows.Next() {
+		var status string
+		if err := rows.Scan(&status); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, rows.Err()
+}
+
+// parseDBTime 解析数据库中的时间字段, loc为写入时使用的时区
+// SQLite驱动会把DATETIME列解析为不带时区的RFC3339格式, 需要按写入时的时区还原
+func parseDBTime(value string, loc *time.Location) time.Time {
+	value = strings.TrimSuffix(strings.Replace(value, "T", " ", 1), "Z")
+	t, err := time.ParseInLocation(timeLayout, value, loc)
+	if err != nil {
+		return time.Time{}
+	}
+	return t.In(time.Local)
+}
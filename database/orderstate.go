@@ -0,0 +1,152 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// OrderStatus 订单状态, 状态之间的变更必须符合orderTransitions
+type OrderStatus string
+
+const (
+	OrderCreated            OrderStatus = "created"               // 已创建PaymentIntent, 等待支付
+	OrderPaymentFailed      OrderStatus = "payment_failed"        // 支付失败, 用户仍可以在同一个PaymentIntent上重试
+	OrderRequiresCapture    OrderStatus = "requires_capture"      // 已授权, 等待扣款
+	OrderFulfilling         OrderStatus = "fulfilling"            // 已支付, 积分发放中
+	OrderSucceeded          OrderStatus = "succeeded"             // 积分已发放
+	OrderPartiallyRefunded  OrderStatus = "partially_refunded"    // 部分退款
+	OrderRefunded           OrderStatus = "refunded"              // 全额退款
+	OrderCanceled           OrderStatus = "canceled"              // 已取消
+	OrderErrorRetrieving    OrderStatus = "error_retrieving"      // 过期清理时无法从Stripe获取PaymentIntent
+	OrderCanceledDueToError OrderStatus = "canceled_due_to_error" // 过期清理时取消PaymentIntent失败
+	OrderAmountMismatch     OrderStatus = "amount_mismatch"       // 支付金额与订单金额不一致, 等待人工核对
+)
+
+// 订单状态变更的来源
+const (
+	OrderActorCheckout    = "checkout"     // 下单
+	OrderActorWebhook     = "webhook"      // Stripe Webhook
+	OrderActorSweeper     = "sweeper"      // 过期订单清理
+	OrderActorSuccessPage = "success_page" // 支付成功页
+	OrderActorFulfillment = "fulfillment"  // 积分发放队列
+	OrderActorAdmin       = "admin"        // 管理后台
+	OrderActorAutoTopup   = "auto_topup"   // 自动充值
+)
+
+// orderTransitions 每个状态允许变更到的状态, 未列出的变更都会被拒绝
+// 过期清理出错的订单在Stripe上可能已经支付, 因此仍然可以被认领发放
+// 金额不一致的订单由管理员确认后发放积分或者退款
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderCreated:            {OrderPaymentFailed, OrderRequiresCapture, OrderFulfilling, OrderCanceled, OrderErrorRetrieving, OrderCanceledDueToError, OrderAmountMismatch},
+	OrderPaymentFailed:      {OrderRequiresCapture, OrderFulfilling, OrderCanceled, OrderErrorRetrieving, OrderCanceledDueToError, OrderAmountMismatch},
+	OrderRequiresCapture:    {OrderFulfilling, OrderCanceled, OrderAmountMismatch},
+	OrderErrorRetrieving:    {OrderRequiresCapture, OrderFulfilling, OrderCanceled, OrderAmountMismatch},
+	OrderCanceledDueToError: {OrderRequiresCapture, OrderFulfilling, OrderCanceled, OrderAmountMismatch},
+	OrderAmountMismatch:     {OrderFulfilling, OrderCanceled, OrderPartiallyRefunded, OrderRefunded},
+	OrderFulfilling:         {OrderSucceeded, OrderPartiallyRefunded, OrderRefunded},
+	OrderSucceeded:          {OrderPartiallyRefunded, OrderRefunded},
+	OrderPartiallyRefunded:  {OrderPartiallyRefunded, OrderRefunded},
+}
+
+// ErrIllegalTransition 订单当前状态不允许变更为目标状态
+var ErrIllegalTransition = errors.New("不允许的订单状态变更")
+
+// CanTransition 判断订单能否从from变更为to
+func CanTransition(from OrderStatus, to OrderStatus) bool {
+	return slices.Contains(orderTransitions[from], to)
+}
+
+// OrderEvent 一次订单状态变更记录
+type OrderEvent struct {
+	OrderID   string
+	From      OrderStatus // 订单创建时为空
+	To        OrderStatus
+	Actor     string
+	Reason    string
+	CreatedAt time.Time
+}
+
+// TransitionOrderStatus 将订单变更为to, 并记录变更的来源和原因
+// 不允许的变更返回ErrIllegalTransition, 订单不存在时返回sql.ErrNoRows, 订单已经处于to状态时不做任何事
+func (s *sqlStore) TransitionOrderStatus(orderID string, to OrderStatus, actor string, reason string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := s.transitionTx(tx, orderID, to, actor, reason); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// transitionTx 在事务中完成一次状态变更, 返回变更前的状态
+// 更新以读取到的状态为条件, 并发修改同一订单时只有一个能成功, 失败的一方重新读取后再判断
+func (s *sqlStore) transitionTx(tx *sql.Tx, orderID string, to OrderStatus, actor string, reason string) (OrderStatus, error) {
+	for {
+		var from OrderStatus
+		if err := tx.QueryRow(s.q("SELECT status FROM orders WHERE order_id = ?"), orderID).Scan(&from); err != nil {
+			return "", err
+		}
+		if from == to && !CanTransition(from, to) {
+			return from, nil
+		}
+		if !CanTransition(from, to) {
+			return from, fmt.Errorf("%w: %s 从 %s 到 %s", ErrIllegalTransition, orderID, from, to)
+		}
+
+		// 订单首次变为已支付时同时记录支付时间
+		query := `UPDATE orders SET status = ?,
+			paid_at = CASE WHEN paid_at IS NULL AND ? IN ('fulfilling', 'requires_capture') THEN ? ELSE paid_at END
+			WHERE order_id = ? AND status = ?`
+		result, err := tx.Exec(s.q(query), string(to), string(to), utcNow(), orderID, string(from))
+		if err != nil {
+			return from, err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return from, err
+		}
+		if affected == 0 {
+			continue
+		}
+
+		if err := s.recordOrderEvent(tx, OrderEvent{OrderID: orderID, From: from, To: to, Actor: actor, Reason: reason}); err != nil {
+			return from, err
+		}
+		return from, nil
+	}
+}
+
+// recordOrderEvent 写入一条状态变更记录
+func (s *sqlStore) recordOrderEvent(tx *sql.Tx, event OrderEvent) error {
+	query := "INSERT INTO order_events (order_id, from_status, to_status, actor, reason) VALUES (?, ?, ?, ?, ?)"
+	_, err := tx.Exec(s.q(query), event.OrderID, string(event.From), string(event.To), event.Actor, event.Reason)
+	return err
+}
+
+// ListOrderEvents 获取订单的状态变更记录, 按发生顺序排列
+func (s *sqlStore) ListOrderEvents(orderID string) ([]OrderEvent, error) {
+	query := "SELECT order_id, from_status, to_status, actor, reason, created_at FROM order_events WHERE order_id = ? ORDER BY id"
+	rows, err := s.db.Query(s.q(query), orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []OrderEvent
+	for rows.Next() {
+		var e OrderEvent
+		var createdAt string
+		if err := rows.Scan(&e.OrderID, &e.From, &e.To, &e.Actor, &e.Reason, &createdAt); err != nil {
+			return nil, err
+		}
+		e.CreatedAt = parseDBTime(createdAt, time.UTC)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,62 @@
+package database
+
+import (
+	"breathaipay/migrations"
+
+	"context"
+	"database/sql"
+	"fmt"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// newPostgresStore 连接PostgreSQL, 订单和客户保存在同一个数据库中
+// 多个实例可以共用同一个数据库, 并发控制依靠事务和条件更新完成
+func newPostgresStore(dsn string) (*sqlStore, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(5)
+
+	// 咨询锁在单独的连接池中持有, 锁最多嵌套两层(退款锁内的余额锁)
+	locks, err := sql.Open("pgx", dsn)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	locks.SetMaxOpenConns(maxLockConns)
+	locks.SetMaxIdleConns(2)
+
+	return &sqlStore{db: db, locks: locks, postgres: true}, nil
+}
+
+// migratePostgres 执行PostgreSQL的迁移并写入默认商品
+// 迁移在咨询锁内执行, 避免多个实例同时启动时重复执行
+func (s *sqlStore) migratePostgres() error {
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// 会话级咨询锁, 键为固定值
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock(4399)"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock(4399)")
+
+	if err := migrations.Apply(s.db, migrations.Postgres); err != nil {
+		return err
+	}
+	if err := s.seedProducts(); err != nil {
+		return fmt.Errorf("写入默认商品失败: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package database
+
+import (
+	"breathaipay/money"
+
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// Product 商品信息, 商品只下架不删除, 以保证进行中订单的商品ID始终有效
+type Product struct {
+	ID        int         `json:"id"`
+	Name      string      `json:"name"`
+	Price     money.Money `json:"price"` // 单价, 数据库中以最小货币单位保存在unit_amount
+	Points    int         `json:"points"`
+	Currency  string      `json:"currency"`
+	Active    bool        `json:"active"`
+	SortOrder int         `json:"sort_order"`
+	Sites     []string    `json:"sites"` // 可购买的站点, 为空表示所有站点
+}
+
+// 首次启动时写入的默认商品, 与旧版本硬编码的商品ID保持一致
+var defaultProducts = []Product{
+	{ID: 1, Name: "100,000 积分", Price: money.New(2000, "cny"), Points: 100000, Currency: "cny", Active: true, SortOrder: 1},
+	{ID: 2, Name: "500,000 积分", Price: money.New(5000, "cny"), Points: 500000, Currency: "cny", Active: true, SortOrder: 2},
+	{ID: 3, Name: "1,000,000 积分", Price: money.New(10000, "cny"), Points: 1000000, Currency: "cny", Active: true, SortOrder: 3},
+}
+
+// seedProducts 在商品表为空时写入默认商品
+func (s *sqlStore) seedProducts() error {
+	var count int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM products").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	for _, p := range defaultProducts {
+		query := "INSERT INTO products (id, name, unit_amount, points, currency, active, sort_order, sites) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+		_, err := s.db.Exec(s.q(query), p.ID, p.Name, p.Price.Amount, p.Points, p.Currency, p.Active, p.SortOrder, strings.Join(p.Sites, ","))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListProducts 获取所有上架的商品, 按排序字段排列
+func (s *sqlStore) ListProducts() ([]Product, error) {
+	query := "SELECT id, name, unit_amount, points, currency, active, sort_order, sites FROM products WHERE active = ? ORDER BY sort_order, id"
+	rows, err := s.db.Query(s.q(query), true)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var products []Product
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+	return products, rows.Err()
+}
+
+// GetProduct 按ID获取商品(包括已下架的), 不存在时返回sql.ErrNoRows
+func (s *sqlStore) GetProduct(id int) (Product, error) {
+	query := "SELECT id, name, unit_amount, points, currency, active, sort_order, sites FROM products WHERE id = ?"
+	return scanProduct(s.db.QueryRow(s.q(query), id))
+}
+
+// scanProduct 从查询结果中读取一行商品
+func scanProduct(row interface{ Scan(...any) error }) (Product, error) {
+	var p Product
+	var sites string
+	var unitAmount int64
+	err := row.Scan(&p.ID, &p.Name, &unitAmount, &p.Points, &p.Currency, &p.Active, &p.SortOrder, &sites)
+	if err != nil {
+		return Product{}, err
+	}
+	p.Price = money.New(unitAmount, p.Currency)
+	if sites != "" {
+		for _, site := range strings.Split(sites, ",") {
+			if site = strings.TrimSpace(site); site != "" {
+				p.Sites = append(p.Sites, site)
+			}
+		}
+	}
+	return p, nil
+}
+
+// IsNotFound 判断错误是否为记录不存在
+func IsNotFound(err error) bool {
+	return errors.Is(err, sql.ErrNoRows)
+}
@@ -0,0 +1,119 @@
+package database
+
+import (
+	"database/sql"
+)
+
+// 退款记录的状态
+const (
+	RefundStatusPending   = "pending" // 正在从用户余额扣回积分, 停留在该状态说明扣回结果无法确认, 需要人工核对
+	RefundStatusCompleted = "completed"
+)
+
+// Refund 一次退款对应的积分扣回记录
+// Points为按退款比例应扣回的积分, PointsDeducted为实际扣回的积分(余额不足时可能更少)
+type Refund struct {
+	PaymentIntentID string
+	AmountRefunded  int64 // 处理时该订单的累计退款金额(最小货币单位)
+	Points          int64
+	PointsDeducted  int64
+	DeductedFrom    string // user表示从用户余额扣回, job表示从尚未发放的任务中扣除
+	Source          string // webhook 或 admin
+	Status          string
+}
+
+// GetFulfillmentJob 获取订单对应的发放任务, 不存在时返回sql.ErrNoRows
+func (s *sqlStore) GetFulfillmentJob(paymentIntentID string) (FulfillmentJob, error) {
+	return scanFulfillmentJob(s.db.QueryRow(s.q("SELECT "+fulfillmentJobColumns+" WHERE payment_intent_id = ?"), paymentIntentID))
+}
+
+// RefundFromJob 从尚未发放的任务中扣除积分, 并在同一事务中写入退款记录
+// 仅当任务处于pending或dead状态且没有开始写入余额时生效, 返回false表示任务状态已经变化, 需要重新判断
+func (s *sqlStore) RefundFromJob(refund Refund) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE fulfillment_jobs SET points = CASE WHEN points > ? THEN points - ? ELSE 0 END, updated_at = ?
+		WHERE payment_intent_id = ? AND status IN (?, ?) AND credit_started_at IS NULL`
+	result, err := tx.Exec(s.q(query), refund.Points, refund.Points, utcNow(), refund.PaymentIntentID, JobStatusPending, JobStatusDead)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 0 {
+		return false, err
+	}
+
+	refund.DeductedFrom = "job"
+	refund.PointsDeducted = refund.Points
+	refund.Status = RefundStatusCompleted
+	if _, err := s.insertRefundTx(tx, refund); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// SumRefundedPoints 获取订单已经处理过的退款积分总数, 以及其中直接从发放任务里扣除的部分
+// pending状态的记录同样计入, 扣回结果无法确认的积分不会被再次扣回
+func (s *sqlStore) SumRefundedPoints(paymentIntentID string) (total int64, fromJob int64, err error) {
+	query := `SELECT COALESCE(SUM(points), 0), COALESCE(SUM(CASE WHEN deducted_from = 'job' THEN points ELSE 0 END), 0)
+		FROM refunds WHERE payment_intent_id = ?`
+	err = s.db.QueryRow(s.q(query), paymentIntentID).Scan(&total, &fromJob)
+	return total, fromJob, err
+}
+
+// StartRefund 从用户余额扣回积分前写入一条pending状态的退款记录, 返回记录的ID
+func (s *sqlStore) StartRefund(refund Refund) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	refund.Status = RefundStatusPending
+	id, err := s.insertRefundTx(tx, refund)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// CancelRefund 余额没有被修改时删除pending状态的退款记录, 之后可以重新扣回
+func (s *sqlStore) CancelRefund(id int64) error {
+	_, err := s.db.Exec(s.q("DELETE FROM refunds WHERE id = ? AND status = ?"), id, RefundStatusPending)
+	return err
+}
+
+// CompleteRefund 记录实际扣回的积分并将退款记录改为completed, 积分流水在同一事务中写入
+// entry为nil表示没有修改余额(如余额已经为0)
+func (s *sqlStore) CompleteRefund(id int64, pointsDeducted int64, entry *LedgerEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "UPDATE refunds SET points_deducted = ?, status = ? WHERE id = ? AND status = ?"
+	if _, err := tx.Exec(s.q(query), pointsDeducted, RefundStatusCompleted, id, RefundStatusPending); err != nil {
+		return err
+	}
+	if entry != nil {
+		if err := s.recordLedgerEntryTx(tx, *entry); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// insertRefundTx 在事务中写入一条退款记录, 返回记录的ID
+func (s *sqlStore) insertRefundTx(tx *sql.Tx, refund Refund) (int64, error) {
+	query := `INSERT INTO refunds (payment_intent_id, amount_refunded, points, points_deducted, deducted_from, source, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id`
+	var id int64
+	err := tx.QueryRow(s.q(query), refund.PaymentIntentID, refund.AmountRefunded, refund.Points, refund.PointsDeducted,
+		refund.DeductedFrom, refund.Source, refund.Status).Scan(&id)
+	return id, err
+}
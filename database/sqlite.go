@@ -0,0 +1,225 @@
+package database
+
+import (
+	"breathaipay/migrations"
+
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLite数据库文件, 订单、客户等所有表都保存在这一个文件中
+const sqlitePath = "./breathaipay.db"
+
+// 旧版本程序使用的两个数据库文件, 首次启动时导入后保留作为备份
+const (
+	legacyOrdersPath    = "./orders.db"
+	legacyCustomersPath = "./custormers.db"
+)
+
+// newSQLiteStore 打开当前目录下的breathaipay.db, 首次启动时先从旧的数据库文件导入数据
+func newSQLiteStore() (*sqlStore, error) {
+	if sqliteImportPending() {
+		if err := importLegacySQLite(); err != nil {
+			return nil, fmt.Errorf("导入旧数据库失败: %w", err)
+		}
+	}
+	return openSQLite(sqlitePath)
+}
+
+// openSQLite 打开指定的SQLite文件
+func openSQLite(path string) (*sqlStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite同一时间只允许一个写入者, 只使用一个连接, 事务期间其他请求等待连接释放
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+
+	return &sqlStore{db: db}, nil
+}
+
+// sqliteImportPending 新的数据库文件还不存在, 但存在旧版本程序的数据库文件时需要导入
+func sqliteImportPending() bool {
+	return !fileExists(sqlitePath) && (fileExists(legacyOrdersPath) || fileExists(legacyCustomersPath))
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+// importLegacySQLite 将orders.db和custormers.db中的数据导入到新的数据库文件
+// orders.db先完整复制一份再执行迁移, 客户逐行写入, 旧文件只读打开, 不会被修改
+// 导入在临时文件中完成, 成功后才重命名为breathaipay.db, 中途失败时下次启动会重新导入
+func importLegacySQLite() error {
+	tmpPath := sqlitePath + ".import"
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Remove(tmpPath + suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	if fileExists(legacyOrdersPath) {
+		legacy, err := sql.Open("sqlite", "file:"+legacyOrdersPath+"?mode=ro")
+		if err != nil {
+			return err
+		}
+		// VACUUM INTO会包含WAL中尚未写回的数据以及PRAGMA user_version
+		_, err = legacy.Exec("VACUUM INTO ?", tmpPath)
+		legacy.Close()
+		if err != nil {
+			return fmt.Errorf("复制%s失败: %w", legacyOrdersPath, err)
+		}
+	}
+
+	s, err := openSQLite(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := s.Migrate(); err != nil {
+		s.Close()
+		return err
+	}
+	customers, err := s.importLegacyCustomers()
+	if err != nil {
+		s.Close()
+		return fmt.Errorf("导入%s失败: %w", legacyCustomersPath, err)
+	}
+	if err := s.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, sqlitePath); err != nil {
+		return err
+	}
+	log.Printf("已将%s和%s导入到%s(客户%d个), 旧文件保留作为备份", legacyOrdersPath, legacyCustomersPath, sqlitePath, customers)
+	return nil
+}
+
+// importLegacyCustomers 在一个事务中写入custormers.db中的所有客户, 保持原有的创建顺序
+func (s *sqlStore) importLegacyCustomers() (int, error) {
+	if !fileExists(legacyCustomersPath) {
+		return 0, nil
+	}
+	legacy, err := sql.Open("sqlite", "file:"+legacyCustomersPath+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer legacy.Close()
+
+	var tables int
+	err = legacy.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'customers'").Scan(&tables)
+	if err != nil || tables == 0 {
+		return 0, err
+	}
+	rows, err := legacy.Query("SELECT id, mail FROM customers ORDER BY rowid")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	count := 0
+	for rows.Next() {
+		var id, mail string
+		if err := rows.Scan(&id, &mail); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("INSERT INTO customers (id, mail) VALUES (?, ?) ON CONFLICT DO NOTHING", id, mail); err != nil {
+			return 0, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return count, tx.Commit()
+}
+
+// sqliteLegacyBaseline 返回旧版本程序用PRAGMA user_version记录的版本已覆盖的迁移版本
+// user_version为1和2时, 分别对应迁移0002和0003已经执行
+func sqliteLegacyBaseline(conn *sql.DB) (int, error) {
+	applied, err := migrations.Applied(conn, migrations.SQLite)
+	if err != nil || len(applied) > 0 {
+		return 0, err
+	}
+	var userVersion int
+	if err := conn.QueryRow("PRAGMA user_version").Scan(&userVersion); err != nil {
+		return 0, err
+	}
+	if userVersion == 0 {
+		return 0, nil
+	}
+	return userVersion + 1, nil
+}
+
+// Migrate 执行尚未执行的迁移, 并写入默认商品
+func (s *sqlStore) Migrate() error {
+	if s.postgres {
+		return s.migratePostgres()
+	}
+
+	baseline, err := sqliteLegacyBaseline(s.db)
+	if err != nil {
+		return err
+	}
+	if baseline > 0 {
+		if err := migrations.Baseline(s.db, migrations.SQLite, baseline); err != nil {
+			return err
+		}
+	}
+	if err := migrations.Apply(s.db, migrations.SQLite); err != nil {
+		return err
+	}
+	if err := s.seedProducts(); err != nil {
+		return fmt.Errorf("写入默认商品失败: %w", err)
+	}
+	return nil
+}
+
+// PrintPendingMigrations 输出尚未执行的迁移, 不会执行任何迁移
+func (s *sqlStore) PrintPendingMigrations(w io.Writer) error {
+	if s.postgres {
+		return printPending(w, s.db, migrations.Postgres, 0)
+	}
+
+	baseline, err := sqliteLegacyBaseline(s.db)
+	if err != nil {
+		return err
+	}
+	return printPending(w, s.db, migrations.SQLite, baseline)
+}
+
+// printPending 输出一组迁移中尚未执行的部分, 版本号不超过baseline的视为已执行
+func printPending(w io.Writer, conn *sql.DB, set migrations.Set, baseline int) error {
+	pending, err := migrations.Pending(conn, set)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, m := range pending {
+		if m.Version <= baseline {
+			continue
+		}
+		fmt.Fprintf(w, "%s/%04d_%s\n", set.Dir, m.Version, m.Name)
+		count++
+	}
+	if count == 0 {
+		fmt.Fprintf(w, "%s: 没有待执行的迁移\n", set.Dir)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package database
+
+import (
+	"bytes"
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeLegacyDatabases 在当前目录写入旧版本程序的orders.db和custormers.db
+func writeLegacyDatabases(t *testing.T) {
+	t.Helper()
+	legacy := map[string][]string{
+		legacyOrdersPath: {
+			`CREATE TABLE orders (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				order_id TEXT NOT NULL UNIQUE,
+				status TEXT NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				expires_at DATETIME NOT NULL
+			)`,
+			"INSERT INTO orders (order_id, status, expires_at) VALUES ('pi_legacy', 'succeeded', '2024-01-01 00:00:00')",
+		},
+		legacyCustomersPath: {
+			"CREATE TABLE customers (id TEXT PRIMARY KEY, mail TEXT NOT NULL UNIQUE)",
+			"INSERT INTO customers (id, mail) VALUES ('cus_legacy', 'legacy@b.c')",
+		},
+	}
+	for path, statements := range legacy {
+		db, err := sql.Open("sqlite", "file:"+path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stmt := range statements {
+			if _, err := db.Exec(stmt); err != nil {
+				db.Close()
+				t.Fatalf("%s: %v", path, err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// openMigrated 按启动时的流程打开数据库并执行迁移
+func openMigrated(t *testing.T) *sqlStore {
+	t.Helper()
+	s, err := newSQLiteStore()
+	if err != nil {
+		t.Fatalf("newSQLiteStore() error = %v", err)
+	}
+	if err := s.Migrate(); err != nil {
+		s.Close()
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	return s
+}
+
+func TestLegacyImportRunTwice(t *testing.T) {
+	t.Chdir(t.TempDir())
+	writeLegacyDatabases(t)
+	// 上次导入中途退出时留下的临时文件
+	if err := os.WriteFile(sqlitePath+".import", []byte("partial"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := openMigrated(t)
+	order, err := s.GetOrder("pi_legacy")
+	if err != nil || order.Status != OrderSucceeded {
+		t.Fatalf("GetOrder() = %+v, %v", order, err)
+	}
+	if id, err := s.FindCustomerID("legacy@b.c"); err != nil || id != "cus_legacy" {
+		t.Fatalf("FindCustomerID() = %q, %v", id, err)
+	}
+	// 导入后写入的新数据
+	if err := s.RecordOrder(Order{OrderID: "pi_new", Status: OrderCreated, ExpiresAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(sqlitePath + ".import"); !os.IsNotExist(err) {
+		t.Errorf("临时文件没有被清理: %v", err)
+	}
+
+	// 第二次启动时旧文件仍然存在, 但不会再次导入, 也不会覆盖新数据
+	s = openMigrated(t)
+	defer s.Close()
+	if _, err := s.GetOrder("pi_new"); err != nil {
+		t.Errorf("第二次启动后新订单丢失: %v", err)
+	}
+	var orders, customers int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM orders").Scan(&orders); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM customers").Scan(&customers); err != nil {
+		t.Fatal(err)
+	}
+	if orders != 2 || customers != 1 {
+		t.Errorf("订单 %d 个, 客户 %d 个, want 2, 1", orders, customers)
+	}
+
+	var pending bytes.Buffer
+	if err := s.PrintPendingMigrations(&pending); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(pending.String(), "没有待执行的迁移") {
+		t.Errorf("PrintPendingMigrations() = %q", pending.String())
+	}
+}
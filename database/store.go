@@ -0,0 +1,345 @@
+package database
+
+import (
+	"breathaipay/money"
+
+	"io"
+	"time"
+)
+
+// OrderRepository 订单、积分发放任务与退款记录
+type OrderRepository interface {
+	RecordOrder(order Order) error
+	GetOrder(orderID string) (Order, error)
+	FindPendingOrder(email string, siteType string, productID int, quantity int, couponCode string) (Order, error)
+	AttachPaymentIntent(orderID string, paymentIntentID string, amount money.Money) error
+	ListOrders(filter OrderFilter) ([]Order, error)
+	ListOrderStatuses() ([]string, error)
+	ListExpiredOrders(now time.Time) ([]Order, error)
+	TransitionOrderStatus(orderID string, to OrderStatus, actor string, reason string) error
+	ListOrderEvents(orderID string) ([]OrderEvent, error)
+
+	ClaimOrderForFulfillment(job FulfillmentJob, paid money.Money, actor string) (bool, error)
+	ClaimDueFulfillmentJobs(limit int) ([]FulfillmentJob, error)
+	RecordFulfillmentAttempt(paymentIntentID string, attempt int, status string, errMsg string, nextRunAt time.Time) error
+	StartFulfillmentCredit(paymentIntentID string) error
+	ClearFulfillmentCredit(paymentIntentID string) error
+	CompleteFulfillment(paymentIntentID string, attempt int, entry *LedgerEntry) error
+	ResetRunningFulfillmentJobs(staleBefore time.Time) (int64, error)
+	GetFulfillmentJob(paymentIntentID string) (FulfillmentJob, error)
+
+	SumRefundedPoints(paymentIntentID string) (total int64, fromJob int64, err error)
+	RefundFromJob(refund Refund) (bool, error)
+	StartRefund(refund Refund) (int64, error)
+	CancelRefund(id int64) error
+	CompleteRefund(id int64, pointsDeducted int64, entry *LedgerEntry) error
+}
+
+// ProductRepository 商品
+type ProductRepository interface {
+	ListProducts() ([]Product, error)
+	GetProduct(id int) (Product, error)
+}
+
+// CouponRepository 优惠码
+type CouponRepository interface {
+	GetCoupon(code string) (Coupon, error)
+	CountCouponRedemptions(code string, email string) (total int, byEmail int, err error)
+}
+
+// VoucherRepository 兑换码与兑换尝试记录
+type VoucherRepository interface {
+	CreateVouchers(vouchers []Voucher) error
+	GetVoucher(code string) (Voucher, error)
+	ListVouchers(status string, limit int, offset int) ([]Voucher, error)
+	ClaimVoucher(code string, email string, now time.Time) (bool, error)
+	CompleteVoucher(code string, openwebuiUserID string) error
+	ReleaseVoucher(code string) error
+	DisableVoucher(code string) (bool, error)
+	RecordVoucherAttempt(attempt VoucherAttempt) error
+	CountFailedVoucherAttempts(ip string, email string, since time.Time) (byIP int, byEmail int, err error)
+}
+
+// SubscriptionRepository 订阅套餐、客户订阅与账单的积分发放记录
+type SubscriptionRepository interface {
+	ListSubscriptionPlans() ([]SubscriptionPlan, error)
+	GetSubscriptionPlan(id int) (SubscriptionPlan, error)
+	SaveSubscription(sub Subscription) error
+	GetSubscription(id string) (Subscription, error)
+	ListSubscriptions(email string, limit int, offset int) ([]Subscription, error)
+	ClaimSubscriptionInvoice(inv SubscriptionInvoice, job FulfillmentJob) (bool, error)
+	GetSubscriptionInvoice(invoiceID string) (SubscriptionInvoice, error)
+}
+
+// AutoTopupRepository 自动充值设置与扣款记录
+type AutoTopupRepository interface {
+	SaveAutoTopup(t AutoTopup) (int, error)
+	GetAutoTopup(id int) (AutoTopup, error)
+	ListAutoTopups(email string) ([]AutoTopup, error)
+	SetAutoTopupEnabled(id int, enabled bool, reason string) error
+	ClaimAutoTopupCheck(id int, before time.Time) (bool, error)
+	RecordAutoTopupCharge(charge AutoTopupCharge) error
+	UpdateAutoTopupCharge(paymentIntentID string, status string, errMsg string) error
+	ListAutoTopupCharges(topupID int, since time.Time) ([]AutoTopupCharge, error)
+}
+
+// CustomerRepository 邮箱与Stripe客户ID的对应关系
+type CustomerRepository interface {
+	FindCustomerID(email string) (string, error)
+	SaveCustomer(id string, email string) (string, error)
+	ListCustomers(email string, limit int, offset int) ([]Customer, error)
+}
+
+// LedgerRepository 积分流水
+type LedgerRepository interface {
+	RecordLedgerEntry(entry LedgerEntry) error
+	HasLedgerEntry(orderID string, source string) (bool, error)
+	ListLedgerEntries(filter LedgerFilter) ([]LedgerEntry, error)
+}
+
+// Locker 跨实例的互斥锁
+type Locker interface {
+	WithLock(name string, fn func() error) error
+}
+
+// Store 完整的数据存储, 由DATABASE_URL选择SQLite或PostgreSQL实现
+type Store interface {
+	OrderRepository
+	ProductRepository
+	CouponRepository
+	VoucherRepository
+	SubscriptionRepository
+	AutoTopupRepository
+	CustomerRepository
+	LedgerRepository
+	Locker
+
+	// Migrate 执行尚未执行的迁移并写入默认商品
+	Migrate() error
+	// PrintPendingMigrations 输出尚未执行的迁移, 不会修改数据库
+	PrintPendingMigrations(w io.Writer) error
+	Close() error
+}
+
+// 当前使用的存储, 由InitDB打开
+var store Store
+
+func RecordOrder(order Order) error {
+	return store.RecordOrder(order)
+}
+
+func GetOrder(orderID string) (Order, error) {
+	return store.GetOrder(orderID)
+}
+
+func FindPendingOrder(email string, siteType string, productID int, quantity int, couponCode string) (Order, error) {
+	return store.FindPendingOrder(email, siteType, productID, quantity, couponCode)
+}
+
+func AttachPaymentIntent(orderID string, paymentIntentID string, amount money.Money) error {
+	return store.AttachPaymentIntent(orderID, paymentIntentID, amount)
+}
+
+func ListOrders(filter OrderFilter) ([]Order, error) {
+	return store.ListOrders(filter)
+}
+
+func ListOrderStatuses() ([]string, error) {
+	return store.ListOrderStatuses()
+}
+
+func TransitionOrderStatus(orderID string, to OrderStatus, actor string, reason string) error {
+	return store.TransitionOrderStatus(orderID, to, actor, reason)
+}
+
+func ListOrderEvents(orderID string) ([]OrderEvent, error) {
+	return store.ListOrderEvents(orderID)
+}
+
+func ClaimOrderForFulfillment(job FulfillmentJob, paid money.Money, actor string) (bool, error) {
+	return store.ClaimOrderForFulfillment(job, paid, actor)
+}
+
+func ClaimDueFulfillmentJobs(limit int) ([]FulfillmentJob, error) {
+	return store.ClaimDueFulfillmentJobs(limit)
+}
+
+func RecordFulfillmentAttempt(paymentIntentID string, attempt int, status string, errMsg string, nextRunAt time.Time) error {
+	return store.RecordFulfillmentAttempt(paymentIntentID, attempt, status, errMsg, nextRunAt)
+}
+
+func StartFulfillmentCredit(paymentIntentID string) error {
+	return store.StartFulfillmentCredit(paymentIntentID)
+}
+
+func ClearFulfillmentCredit(paymentIntentID string) error {
+	return store.ClearFulfillmentCredit(paymentIntentID)
+}
+
+func CompleteFulfillment(paymentIntentID string, attempt int, entry *LedgerEntry) error {
+	return store.CompleteFulfillment(paymentIntentID, attempt, entry)
+}
+
+func ResetRunningFulfillmentJobs(staleBefore time.Time) (int64, error) {
+	return store.ResetRunningFulfillmentJobs(staleBefore)
+}
+
+func GetFulfillmentJob(paymentIntentID string) (FulfillmentJob, error) {
+	return store.GetFulfillmentJob(paymentIntentID)
+}
+
+func SumRefundedPoints(paymentIntentID string) (total int64, fromJob int64, err error) {
+	return store.SumRefundedPoints(paymentIntentID)
+}
+
+func RefundFromJob(refund Refund) (bool, error) {
+	return store.RefundFromJob(refund)
+}
+
+func StartRefund(refund Refund) (int64, error) {
+	return store.StartRefund(refund)
+}
+
+func CancelRefund(id int64) error {
+	return store.CancelRefund(id)
+}
+
+func CompleteRefund(id int64, pointsDeducted int64, entry *LedgerEntry) error {
+	return store.CompleteRefund(id, pointsDeducted, entry)
+}
+
+func ListProducts() ([]Product, error) {
+	return store.ListProducts()
+}
+
+func GetProduct(id int) (Product, error) {
+	return store.GetProduct(id)
+}
+
+func GetCoupon(code string) (Coupon, error) {
+	return store.GetCoupon(code)
+}
+
+func CountCouponRedemptions(code string, email string) (total int, byEmail int, err error) {
+	return store.CountCouponRedemptions(code, email)
+}
+
+func CreateVouchers(vouchers []Voucher) error {
+	return store.CreateVouchers(vouchers)
+}
+
+func GetVoucher(code string) (Voucher, error) {
+	return store.GetVoucher(code)
+}
+
+func ListVouchers(status string, limit int, offset int) ([]Voucher, error) {
+	return store.ListVouchers(status, limit, offset)
+}
+
+func ClaimVoucher(code string, email string, now time.Time) (bool, error) {
+	return store.ClaimVoucher(code, email, now)
+}
+
+func CompleteVoucher(code string, openwebuiUserID string) error {
+	return store.CompleteVoucher(code, openwebuiUserID)
+}
+
+func ReleaseVoucher(code string) error {
+	return store.ReleaseVoucher(code)
+}
+
+func DisableVoucher(code string) (bool, error) {
+	return store.DisableVoucher(code)
+}
+
+func RecordVoucherAttempt(attempt VoucherAttempt) error {
+	return store.RecordVoucherAttempt(attempt)
+}
+
+func CountFailedVoucherAttempts(ip string, email string, since time.Time) (byIP int, byEmail int, err error) {
+	return store.CountFailedVoucherAttempts(ip, email, since)
+}
+
+func ListSubscriptionPlans() ([]SubscriptionPlan, error) {
+	return store.ListSubscriptionPlans()
+}
+
+func GetSubscriptionPlan(id int) (SubscriptionPlan, error) {
+	return store.GetSubscriptionPlan(id)
+}
+
+func SaveSubscription(sub Subscription) error {
+	return store.SaveSubscription(sub)
+}
+
+func GetSubscription(id string) (Subscription, error) {
+	return store.GetSubscription(id)
+}
+
+func ListSubscriptions(email string, limit int, offset int) ([]Subscription, error) {
+	return store.ListSubscriptions(email, limit, offset)
+}
+
+func ClaimSubscriptionInvoice(inv SubscriptionInvoice, job FulfillmentJob) (bool, error) {
+	return store.ClaimSubscriptionInvoice(inv, job)
+}
+
+func GetSubscriptionInvoice(invoiceID string) (SubscriptionInvoice, error) {
+	return store.GetSubscriptionInvoice(invoiceID)
+}
+
+func SaveAutoTopup(t AutoTopup) (int, error) {
+	return store.SaveAutoTopup(t)
+}
+
+func GetAutoTopup(id int) (AutoTopup, error) {
+	return store.GetAutoTopup(id)
+}
+
+func ListAutoTopups(email string) ([]AutoTopup, error) {
+	return store.ListAutoTopups(email)
+}
+
+func SetAutoTopupEnabled(id int, enabled bool, reason string) error {
+	return store.SetAutoTopupEnabled(id, enabled, reason)
+}
+
+func ClaimAutoTopupCheck(id int, before time.Time) (bool, error) {
+	return store.ClaimAutoTopupCheck(id, before)
+}
+
+func RecordAutoTopupCharge(charge AutoTopupCharge) error {
+	return store.RecordAutoTopupCharge(charge)
+}
+
+func UpdateAutoTopupCharge(paymentIntentID string, status string, errMsg string) error {
+	return store.UpdateAutoTopupCharge(paymentIntentID, status, errMsg)
+}
+
+func ListAutoTopupCharges(topupID int, since time.Time) ([]AutoTopupCharge, error) {
+	return store.ListAutoTopupCharges(topupID, since)
+}
+
+func FindCustomerID(email string) (string, error) {
+	return store.FindCustomerID(email)
+}
+
+func ListCustomers(email string, limit int, offset int) ([]Customer, error) {
+	return store.ListCustomers(email, limit, offset)
+}
+
+func RecordLedgerEntry(entry LedgerEntry) error {
+	return store.RecordLedgerEntry(entry)
+}
+
+func HasLedgerEntry(orderID string, source string) (bool, error) {
+	return store.HasLedgerEntry(orderID, source)
+}
+
+func ListLedgerEntries(filter LedgerFilter) ([]LedgerEntry, error) {
+	return store.ListLedgerEntries(filter)
+}
+
+func WithLock(name string, fn func() error) error {
+	return store.WithLock(name, fn)
+}
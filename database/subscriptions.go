@@ -0,0 +1,199 @@
+package database
+
+import (
+	"breathaipay/money"
+
+	"strings"
+	"time"
+)
+
+// 订阅账单的发放状态
+const (
+	InvoiceGrantGranting = "granting" // 已被认领, 等待发放队列增加积分
+	InvoiceGrantGranted  = "granted"  // 已发放
+)
+
+// SubscriptionInvoice 一张订阅账单的发放记录
+type SubscriptionInvoice struct {
+	InvoiceID      string
+	SubscriptionID string
+	Points         int64
+	Status         string
+	BillingReason  string // Stripe账单类型, 如subscription_create、subscription_cycle
+}
+
+// SubscriptionPlan 订阅套餐, 每个计费周期发放Points积分
+type SubscriptionPlan struct {
+	ID            int
+	Name          string
+	StripePriceID string
+	Points        int64
+	Price         money.Money // 每期价格, 仅用于展示, 实际扣款金额以Stripe Price为准
+	Currency      string
+	Active        bool
+	SortOrder     int
+	Sites         []string // 可订阅的站点, 为空表示所有站点
+}
+
+// Subscription 客户的一个订阅, 状态与Stripe保持一致
+type Subscription struct {
+	ID                string // Stripe订阅ID
+	CustomerID        string
+	Email             string
+	SiteType          string
+	PlanID            int
+	Status            string
+	CancelAtPeriodEnd bool
+	CurrentPeriodEnd  time.Time // 未知时为零值
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+}
+
+// 查询套餐时选择的列, 与scanSubscriptionPlan的顺序一致
+const subscriptionPlanColumns = "id, name, stripe_price_id, points, unit_amount, currency, active, sort_order, sites FROM subscription_plans"
+
+// scanSubscriptionPlan 读取一行subscriptionPlanColumns
+func scanSubscriptionPlan(row interface{ Scan(dest ...any) error }) (SubscriptionPlan, error) {
+	var p SubscriptionPlan
+	var unitAmount int64
+	var sites string
+	err := row.Scan(&p.ID, &p.Name, &p.StripePriceID, &p.Points, &unitAmount, &p.Currency, &p.Active, &p.SortOrder, &sites)
+	if err != nil {
+		return SubscriptionPlan{}, err
+	}
+	p.Price = money.New(unitAmount, p.Currency)
+	for _, site := range strings.Split(sites, ",") {
+		if site = strings.TrimSpace(site); site != "" {
+			p.Sites = append(p.Sites, site)
+		}
+	}
+	return p, nil
+}
+
+// ListSubscriptionPlans 获取所有启用的套餐, 按排序字段排列
+func (s *sqlStore) ListSubscriptionPlans() ([]SubscriptionPlan, error) {
+	rows, err := s.db.Query(s.q("SELECT "+subscriptionPlanColumns+" WHERE active = ? ORDER BY sort_order, id"), true)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var plans []SubscriptionPlan
+	for rows.Next() {
+		p, err := scanSubscriptionPlan(rows)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, p)
+	}
+	return plans, rows.Err()
+}
+
+// GetSubscriptionPlan 按ID获取套餐(包括已停用的), 不存在时返回sql.ErrNoRows
+func (s *sqlStore) GetSubscriptionPlan(id int) (SubscriptionPlan, error) {
+	return scanSubscriptionPlan(s.db.QueryRow(s.q("SELECT "+subscriptionPlanColumns+" WHERE id = ?"), id))
+}
+
+// 查询订阅时选择的列, 与scanSubscription的顺序一致
+const subscriptionColumns = `id, customer_id, email, site_type, plan_id, status, cancel_at_period_end,
+	COALESCE(current_period_end, ''), created_at, updated_at FROM subscriptions`
+
+// scanSubscription 读取一行subscriptionColumns
+func scanSubscription(row interface{ Scan(dest ...any) error }) (Subscription, error) {
+	var sub Subscription
+	var periodEnd, createdAt, updatedAt string
+	err := row.Scan(&sub.ID, &sub.CustomerID, &sub.Email, &sub.SiteType, &sub.PlanID, &sub.Status, &sub.CancelAtPeriodEnd,
+		&periodEnd, &createdAt, &updatedAt)
+	if err != nil {
+		return Subscription{}, err
+	}
+	sub.CurrentPeriodEnd = parseDBTime(periodEnd, time.UTC)
+	sub.CreatedAt = parseDBTime(createdAt, time.UTC)
+	sub.UpdatedAt = parseDBTime(updatedAt, time.UTC)
+	return sub, nil
+}
+
+// SaveSubscription 写入或更新订阅的状态, 邮箱、站点和套餐只在创建时写入
+func (s *sqlStore) SaveSubscription(sub Subscription) error {
+	var periodEnd any
+	if !sub.CurrentPeriodEnd.IsZero() {
+		periodEnd = sub.CurrentPeriodEnd.UTC().Format(timeLayout)
+	}
+	query := `INSERT INTO subscriptions (id, customer_id, email, site_type, plan_id, status, cancel_at_period_end, current_period_end, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET status = excluded.status, cancel_at_period_end = excluded.cancel_at_period_end,
+		current_period_end = COALESCE(excluded.current_period_end, subscriptions.current_period_end), updated_at = excluded.updated_at`
+	_, err := s.db.Exec(s.q(query), sub.ID, sub.CustomerID, sub.Email, sub.SiteType, sub.PlanID, sub.Status,
+		sub.CancelAtPeriodEnd, periodEnd, utcNow())
+	return err
+}
+
+// GetSubscription 按Stripe订阅ID查询, 不存在时返回sql.ErrNoRows
+func (s *sqlStore) GetSubscription(id string) (Subscription, error) {
+	return scanSubscription(s.db.QueryRow(s.q("SELECT "+subscriptionColumns+" WHERE id = ?"), id))
+}
+
+// ListSubscriptions 按创建时间倒序查询订阅, email为空时不过滤, 否则按邮箱模糊匹配
+func (s *sqlStore) ListSubscriptions(email string, limit int, offset int) ([]Subscription, error) {
+	query := "SELECT " + subscriptionColumns
+	var args []any
+	if email != "" {
+		query += " WHERE email LIKE ?"
+		args = append(args, "%"+email+"%")
+	}
+	query += " ORDER BY created_at DESC, id LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := s.db.Query(s.q(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []Subscription
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// ClaimSubscriptionInvoice 认领一张已支付的账单, 并在同一事务中写入以账单ID标识的发放任务
+// 同一账单只有第一次认领能成功, 返回false表示账单已经发放或正在发放
+func (s *sqlStore) ClaimSubscriptionInvoice(inv SubscriptionInvoice, job FulfillmentJob) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO subscription_invoices (invoice_id, subscription_id, points, status, billing_reason) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (invoice_id) DO NOTHING`
+	result, err := tx.Exec(s.q(query), inv.InvoiceID, inv.SubscriptionID, inv.Points, InvoiceGrantGranting, inv.BillingReason)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 0 {
+		return false, err
+	}
+
+	job.PaymentIntentID = inv.InvoiceID
+	job.Points = inv.Points
+	job.Source = LedgerSourceSubscription
+	if err := s.insertFulfillmentJobTx(tx, job); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// GetSubscriptionInvoice 获取账单的发放记录, 不存在时返回sql.ErrNoRows
+func (s *sqlStore) GetSubscriptionInvoice(invoiceID string) (SubscriptionInvoice, error) {
+	var inv SubscriptionInvoice
+	query := "SELECT invoice_id, subscription_id, points, status, billing_reason FROM subscription_invoices WHERE invoice_id = ?"
+	err := s.db.QueryRow(s.q(query), invoiceID).Scan(&inv.InvoiceID, &inv.SubscriptionID, &inv.Points, &inv.Status, &inv.BillingReason)
+	return inv, err
+}
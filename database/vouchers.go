@@ -0,0 +1,178 @@
+package database
+
+import (
+	"time"
+)
+
+// 兑换码状态
+const (
+	VoucherStatusActive    = "active"    // 可以兑换
+	VoucherStatusRedeeming = "redeeming" // 已被认领, 正在增加积分
+	VoucherStatusRedeemed  = "redeemed"  // 已兑换
+	VoucherStatusDisabled  = "disabled"  // 已作废
+)
+
+// 兑换尝试的结果
+const (
+	VoucherOutcomeRedeemed        = "redeemed"
+	VoucherOutcomeNotFound        = "not_found"
+	VoucherOutcomeExpired         = "expired"
+	VoucherOutcomeAlreadyRedeemed = "already_redeemed"
+	VoucherOutcomeUserNotFound    = "user_not_found"
+	VoucherOutcomeRateLimited     = "rate_limited"
+	VoucherOutcomeError           = "error"
+)
+
+// Voucher 一个兑换码
+type Voucher struct {
+	Code            string
+	Points          int64
+	SiteType        string
+	ExpiresAt       time.Time // 零值表示永不过期
+	Note            string    // 批次说明, 例如渠道或活动名称
+	Status          string
+	RedeemedEmail   string
+	OpenWebUIUserID string
+	RedeemedAt      time.Time // 未兑换时为零值
+	CreatedAt       time.Time
+}
+
+// VoucherAttempt 一次兑换尝试
+type VoucherAttempt struct {
+	Code    string
+	Email   string
+	IP      string
+	Outcome string
+	Error   string
+}
+
+// 查询兑换码时选择的列, 与scanVoucher的顺序一致
+const voucherColumns = `code, points, site_type, COALESCE(expires_at, ''), note, status, redeemed_email, openwebui_user_id,
+	COALESCE(redeemed_at, ''), created_at FROM vouchers`
+
+// scanVoucher 读取一行voucherColumns
+func scanVoucher(row interface{ Scan(dest ...any) error }) (Voucher, error) {
+	var v Voucher
+	var expiresAt, redeemedAt, createdAt string
+	err := row.Scan(&v.Code, &v.Points, &v.SiteType, &expiresAt, &v.Note, &v.Status, &v.RedeemedEmail, &v.OpenWebUIUserID,
+		&redeemedAt, &createdAt)
+	if err != nil {
+		return Voucher{}, err
+	}
+	v.ExpiresAt = parseDBTime(expiresAt, time.Local)
+	v.RedeemedAt = parseDBTime(redeemedAt, time.UTC)
+	v.CreatedAt = parseDBTime(createdAt, time.UTC)
+	return v, nil
+}
+
+// CreateVouchers 在一个事务中写入一批兑换码, 任一兑换码重复时整批失败
+func (s *sqlStore) CreateVouchers(vouchers []Voucher) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "INSERT INTO vouchers (code, points, site_type, expires_at, note) VALUES (?, ?, ?, ?, ?)"
+	for _, v := range vouchers {
+		var expiresAt any
+		if !v.ExpiresAt.IsZero() {
+			expiresAt = v.ExpiresAt.Format(timeLayout)
+		}
+		if _, err := tx.Exec(s.q(query), v.Code, v.Points, v.SiteType, expiresAt, v.Note); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetVoucher 按兑换码查询, 不存在时返回sql.ErrNoRows
+func (s *sqlStore) GetVoucher(code string) (Voucher, error) {
+	return scanVoucher(s.db.QueryRow(s.q("SELECT "+voucherColumns+" WHERE code = ?"), code))
+}
+
+// ListVouchers 按创建时间倒序查询兑换码, status为空时不过滤
+func (s *sqlStore) ListVouchers(status string, limit int, offset int) ([]Voucher, error) {
+	query := "SELECT " + voucherColumns
+	var args []any
+	if status != "" {
+		query += " WHERE status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY created_at DESC, code LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := s.db.Query(s.q(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var vouchers []Voucher
+	for rows.Next() {
+		v, err := scanVoucher(rows)
+		if err != nil {
+			return nil, err
+		}
+		vouchers = append(vouchers, v)
+	}
+	return vouchers, rows.Err()
+}
+
+// ClaimVoucher 将未过期的可用兑换码原子地标记为兑换中, 并发兑换同一兑换码时只有一个能成功
+// 返回false表示兑换码不可用(已兑换、已作废或已过期)
+func (s *sqlStore) ClaimVoucher(code string, email string, now time.Time) (bool, error) {
+	query := `UPDATE vouchers SET status = ?, redeemed_email = ?, redeemed_at = ?
+		WHERE code = ? AND status = ? AND (expires_at IS NULL OR expires_at > ?)`
+	result, err := s.db.Exec(s.q(query), VoucherStatusRedeeming, email, utcNow(), code, VoucherStatusActive, now.Format(timeLayout))
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// CompleteVoucher 积分增加成功后将兑换码标记为已兑换
+func (s *sqlStore) CompleteVoucher(code string, openwebuiUserID string) error {
+	query := "UPDATE vouchers SET status = ?, openwebui_user_id = ? WHERE code = ? AND status = ?"
+	_, err := s.db.Exec(s.q(query), VoucherStatusRedeemed, openwebuiUserID, code, VoucherStatusRedeeming)
+	return err
+}
+
+// ReleaseVoucher 积分增加失败时将兑换码恢复为可兑换
+func (s *sqlStore) ReleaseVoucher(code string) error {
+	query := "UPDATE vouchers SET status = ?, redeemed_email = '', redeemed_at = NULL WHERE code = ? AND status = ?"
+	_, err := s.db.Exec(s.q(query), VoucherStatusActive, code, VoucherStatusRedeeming)
+	return err
+}
+
+// DisableVoucher 作废尚未兑换的兑换码, 返回false表示兑换码不存在或已经兑换
+func (s *sqlStore) DisableVoucher(code string) (bool, error) {
+	result, err := s.db.Exec(s.q("UPDATE vouchers SET status = ? WHERE code = ? AND status = ?"), VoucherStatusDisabled, code, VoucherStatusActive)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// RecordVoucherAttempt 写入一次兑换尝试
+func (s *sqlStore) RecordVoucherAttempt(attempt VoucherAttempt) error {
+	query := "INSERT INTO voucher_attempts (code, email, ip, outcome, error) VALUES (?, ?, ?, ?, ?)"
+	_, err := s.db.Exec(s.q(query), attempt.Code, attempt.Email, attempt.IP, attempt.Outcome, attempt.Error)
+	return err
+}
+
+// CountFailedVoucherAttempts 统计since之后来自该IP或该邮箱的失败兑换次数
+func (s *sqlStore) CountFailedVoucherAttempts(ip string, email string, since time.Time) (byIP int, byEmail int, err error) {
+	query := `SELECT COALESCE(SUM(CASE WHEN ip = ? THEN 1 ELSE 0 END), 0), COALESCE(SUM(CASE WHEN email = ? THEN 1 ELSE 0 END), 0)
+		FROM voucher_attempts WHERE (ip = ? OR email = ?) AND outcome <> ? AND created_at >= ?`
+	err = s.db.QueryRow(s.q(query), ip, email, ip, email, VoucherOutcomeRedeemed, since.UTC().Format(timeLayout)).Scan(&byIP, &byEmail)
+	return byIP, byEmail, err
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"breathaipay/database"
+	"breathaipay/payments"
+	"breathaipay/pricing"
+
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 直连支付方订单的有效期, 与付款页创建的PaymentIntent相同
+const directPaymentTTL = 30 * time.Minute
+
+// handledByStripe 所选支付方式是否由Stripe处理, 手续费规则中未指定支付方时为Stripe
+func handledByStripe(currency string, paymentMethod string) bool {
+	name := pricing.Match(currency, paymentMethod).Provider
+	return name == "" || name == payments.ProviderStripe
+}
+
+// directProvider 所选支付方式由直连支付方处理时返回该支付方, 由Stripe处理时返回nil
+func directProvider(currency string, paymentMethod string) (payments.Provider, error) {
+	if handledByStripe(currency, paymentMethod) {
+		return nil, nil
+	}
+	return payments.For(pricing.Match(currency, paymentMethod).Provider)
+}
+
+// redirectToProvider 在直连支付方创建支付并跳转到支付方的付款页面
+// 订单号由支付方返回, 付款后跳转回成功页, 同时以异步通知完成订单
+func redirectToProvider(c *gin.Context, provider payments.Provider, o checkoutOrder) error {
+	expiresAt := time.Now().Add(directPaymentTTL)
+	p, err := provider.Create(payments.CreateParams{
+		Amount:        o.quote.Total,
+		Description:   "购买灵息积分",
+		Email:         o.email,
+		PaymentMethod: o.quote.PaymentMethod,
+		ReturnURL:     baseURL(c) + "/success",
+		ExpiresAt:     expiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = database.RecordOrder(database.Order{
+		OrderID:         p.ID,
+		Status:          database.OrderCreated,
+		Provider:        provider.Name(),
+		ExpiresAt:       expiresAt,
+		OpenWebUIUserID: o.openwebuiUserID,
+		Email:           o.email,
+		SiteType:        o.site.Key,
+		ProductID:       o.product.ID,
+		Quantity:        o.quantity,
+		Points:          o.quote.Points,
+		Amount:          o.quote.Total,
+		CouponCode:      o.quote.CouponCode,
+		Discount:        o.quote.Discount,
+	})
+	if err != nil {
+		return fmt.Errorf("记录订单失败 (%s): %w", p.ID, err)
+	}
+
+	log.Printf("%s 订单已创建: %s", provider.Name(), p.ID)
+	c.Redirect(http.StatusSeeOther, p.RedirectURL)
+	return nil
+}
+
+// orderSuccessHandler 直连支付方付款后跳转回来的成功页, 订单的支付方以本地记录为准
+func orderSuccessHandler(c *gin.Context, orderID string) {
+	order, err := database.GetOrder(orderID)
+	if err != nil {
+		log.Printf("获取订单失败 (%s): %v", orderID, err)
+		c.String(http.StatusNotFound, "订单不存在")
+		return
+	}
+	provider, err := payments.For(order.Provider)
+	if err != nil {
+		log.Printf("获取支付方失败 (%s): %v", orderID, err)
+		c.String(http.StatusInternalServerError, "无法验证支付状态，请联系客服。")
+		return
+	}
+	paymentResultHandler(c, provider, orderID)
+}
+
+// alipayNotifyHandler 处理支付宝的异步通知
+// 处理完成后需要返回success, 否则支付宝会在25小时内多次重发
+func alipayNotifyHandler(provider payments.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := readWebhookBody(c)
+		if err != nil {
+			log.Printf("读取支付宝通知失败: %v", err)
+			c.String(http.StatusServiceUnavailable, "fail")
+			return
+		}
+		n, err := provider.VerifyNotification(c.Request.Header, body)
+		if err != nil {
+			log.Printf("支付宝通知校验失败: %v", err)
+			c.String(http.StatusBadRequest, "fail")
+			return
+		}
+
+		log.Printf("支付宝通知: %s 状态为 %s", n.Payment.ID, n.Type)
+		if err := handleDirectPayment(n.Payment); err != nil {
+			log.Printf("处理支付宝通知失败 (%s): %v", n.Payment.ID, err)
+			c.String(http.StatusInternalServerError, "fail")
+			return
+		}
+		c.String(http.StatusOK, "success")
+	}
+}
+
+// handleDirectPayment 根据直连支付方通知中的支付状态更新本地订单, 与成功页共用同一发放流程
+func handleDirectPayment(p payments.Payment) error {
+	switch p.Status {
+	case payments.StatusSucceeded:
+		if _, err := database.GetOrder(p.ID); err != nil {
+			if database.IsNotFound(err) {
+				log.Printf("不是本程序创建的订单, 跳过: %s", p.ID)
+				return nil
+			}
+			return err
+		}
+		// 金额在发放流程中与订单核对, 不一致时订单变更为amount_mismatch
+		_, err := fulfillPayment(p, database.OrderActorWebhook)
+		return err
+	case payments.StatusCanceled:
+		return ignoreIllegalTransition(database.TransitionOrderStatus(p.ID, database.OrderCanceled, database.OrderActorWebhook, p.RawStatus))
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package fulfillment
+
+import (
+	"breathaipay/database"
+	"breathaipay/mail"
+	"breathaipay/money"
+	"breathaipay/openwebui"
+	"breathaipay/sites"
+	"breathaipay/utils"
+
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// 队列轮询间隔, 新任务入队时会立即唤醒, 轮询只用于执行到期的重试
+const pollInterval = 5 * time.Second
+
+// 重试退避的初始间隔与上限
+const (
+	baseBackoff = 30 * time.Second
+	maxBackoff  = time.Hour
+)
+
+// 任务领取后超过该时间仍未完成时视为执行失败的worker已退出, 重新放回队列
+// 需要大于一次发放的最长耗时, 否则同一任务可能被两个worker同时执行
+const runningTimeout = 10 * time.Minute
+
+// 唤醒调度器的信号, 带缓冲以免阻塞入队方
+var wakeup = make(chan struct{}, 1)
+
+// Enqueue 认领已支付的订单并写入发放任务, 由worker异步完成积分发放
+// actor为发现订单已支付的来源, 返回false表示订单已经被处理过
+// paid为实际支付金额, 与订单金额不一致时返回database.ErrAmountMismatch, 为零值时不核对
+func Enqueue(paymentIntentID string, email string, siteType string, points int64, paid money.Money, actor string) (bool, error) {
+	claimed, err := database.ClaimOrderForFulfillment(database.FulfillmentJob{
+		PaymentIntentID: paymentIntentID,
+		Email:           email,
+		SiteType:        siteType,
+		Points:          points,
+	}, paid, actor)
+	if errors.Is(err, database.ErrAmountMismatch) {
+		alertAmountMismatch(err)
+	}
+	if err != nil || !claimed {
+		return claimed, err
+	}
+
+	select {
+	case wakeup <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// EnqueueInvoice 认领已支付的订阅账单并写入以账单ID标识的发放任务, 由worker异步完成积分发放
+// 返回false表示账单已经处理过
+func EnqueueInvoice(inv database.SubscriptionInvoice, email string, siteType string) (bool, error) {
+	claimed, err := database.ClaimSubscriptionInvoice(inv, database.FulfillmentJob{Email: email, SiteType: siteType})
+	if err != nil || !claimed {
+		return claimed, err
+	}
+
+	select {
+	case wakeup <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// 按任务来源注册的到账通知, 未注册的来源发送购买的到账邮件
+var receipts = map[string]func(job database.FulfillmentJob){}
+
+// RegisterReceipt 注册某一来源的任务积分到账后发送的通知, 需要在Start之前调用
+func RegisterReceipt(source string, send func(job database.FulfillmentJob)) {
+	receipts[source] = send
+}
+
+// alertAmountMismatch 记录金额不一致的告警, 配置了ALERT_EMAIL时同时发送邮件
+func alertAmountMismatch(err error) {
+	mail.Alert("订单支付金额不一致", err.Error()+", 请在管理后台核对后发放积分或退款")
+}
+
+// Start 启动调度器和worker池
+func Start() {
+	workers, _ := strconv.Atoi(utils.GetEnvVariable("FULFILLMENT_WORKERS", "4"))
+	if workers < 1 {
+		workers = 1
+	}
+	maxAttempts, _ := strconv.Atoi(utils.GetEnvVariable("FULFILLMENT_MAX_ATTEMPTS", "8"))
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	jobs := make(chan database.FulfillmentJob)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range jobs {
+				process(job, maxAttempts)
+			}
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			// 执行超时的任务(进程退出或卡住)重新放回队列, 可能由其他实例领取
+			if n, err := database.ResetRunningFulfillmentJobs(time.Now().Add(-runningTimeout)); err != nil {
+				log.Printf("重置执行中的发放任务失败: %v", err)
+			} else if n > 0 {
+				log.Printf("已将 %d 个执行超时的发放任务放回队列", n)
+			}
+
+			due, err := database.ClaimDueFulfillmentJobs(workers)
+			if err != nil {
+				log.Printf("领取发放任务失败: %v", err)
+			}
+			for _, job := range due {
+				jobs <- job
+			}
+			// 一批领满时说明可能还有积压, 不等待直接继续领取
+			if err == nil && len(due) == workers {
+				continue
+			}
+			select {
+			case <-ticker.C:
+			case <-wakeup:
+			}
+		}
+	}()
+}
+
+// errCreditInDoubt 之前的尝试已经开始写入余额但没有记录结果, 无法确认积分是否到账
+var errCreditInDoubt = errors.New("上一次尝试的余额写入结果未知, 需要人工核对")
+
+// process 执行一次发放尝试并记录结果
+func process(job database.FulfillmentJob, maxAttempts int) {
+	attempt := job.Attempts + 1
+	entry, err := deliver(job)
+	if err == nil {
+		log.Printf("发放任务完成: %s (第 %d 次尝试)", job.PaymentIntentID, attempt)
+		// 积分流水与任务结果在同一事务中写入, 失败时任务保留写入标记, 超时后进入死信而不会重复发放
+		if err := database.CompleteFulfillment(job.PaymentIntentID, attempt, entry); err != nil {
+			log.Printf("[告警] 记录发放结果失败 (%s): %v", job.PaymentIntentID, err)
+		}
+		if entry != nil {
+			if send, ok := receipts[job.Source]; ok {
+				send(job)
+			} else {
+				sendReceipt(job)
+			}
+		}
+		return
+	}
+
+	status := database.JobStatusPending
+	nextRunAt := time.Now().Add(backoff(attempt))
+	// 无法确认积分是否已经到账时不能自动重试, 以免重复发放
+	if attempt >= maxAttempts || errors.Is(err, errCreditInDoubt) || errors.Is(err, openwebui.ErrCreditUnknown) {
+		status = database.JobStatusDead
+		log.Printf("发放任务进入死信状态: %s: %v", job.PaymentIntentID, err)
+	} else {
+		log.Printf("发放任务失败 (%s, 第 %d 次尝试), 将于 %s 重试: %v", job.PaymentIntentID, attempt, nextRunAt.Format("15:04:05"), err)
+	}
+	if err := database.RecordFulfillmentAttempt(job.PaymentIntentID, attempt, status, err.Error(), nextRunAt); err != nil {
+		log.Printf("记录发放结果失败 (%s): %v", job.PaymentIntentID, err)
+	}
+}
+
+// backoff 计算第attempt次失败后的等待时间
+func backoff(attempt int) time.Duration {
+	d := baseBackoff
+	for i := 1; i < attempt && d < maxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxBackoff)
+}
+
+// deliver 为用户增加积分, 返回需要与任务结果一起写入的积分流水, 没有写入余额时为nil
+// 写入前先检查积分流水并标记任务, 保证同一订单的积分只会到账一次
+func deliver(job database.FulfillmentJob) (*database.LedgerEntry, error) {
+	site, ok := sites.Get(job.SiteType)
+	if !ok {
+		return nil, fmt.Errorf("未知的站点类型: %s", job.SiteType)
+	}
+
+	// 发放前订单已全额退款, 无需再增加积分
+	if job.Points <= 0 {
+		log.Printf("订单 %s 没有需要发放的积分, 跳过", job.PaymentIntentID)
+		return nil, nil
+	}
+
+	// 积分流水中已有该订单的发放记录, 说明之前的尝试已经到账, 只需记录结果
+	credited, err := database.HasLedgerEntry(job.PaymentIntentID, job.Source)
+	if err != nil {
+		return nil, err
+	}
+	if credited {
+		log.Printf("订单 %s 的积分已经到账, 跳过", job.PaymentIntentID)
+		return nil, nil
+	}
+	if job.CreditStarted {
+		return nil, errCreditInDoubt
+	}
+	if err := database.StartFulfillmentCredit(job.PaymentIntentID); err != nil {
+		return nil, err
+	}
+
+	reason := openwebui.Reason{
+		OrderID:     job.PaymentIntentID,
+		Source:      job.Source,
+		DeferLedger: true,
+	}
+	change, err := openwebui.AddBalance(openwebui.Account{ID: job.OpenWebUIUserID, Email: job.Email}, job.Points, site, reason)
+	if err != nil {
+		if errors.Is(err, openwebui.ErrCreditUnknown) {
+			return nil, err
+		}
+		// 余额没有写入, 清除标记后可以安全地重试
+		if clearErr := database.ClearFulfillmentCredit(job.PaymentIntentID); clearErr != nil {
+			log.Printf("清除发放任务的写入标记失败 (%s): %v", job.PaymentIntentID, clearErr)
+		}
+		return nil, err
+	}
+	entry := openwebui.LedgerEntry(job.Email, site, change, reason)
+	return &entry, nil
+}
+
+// sendReceipt 发送到账邮件, 积分已经到账, 发送失败不影响任务结果
+func sendReceipt(job database.FulfillmentJob) {
+	log.Print("处理完成, 发送确认邮件")
+	paid := ""
+	if order, err := database.GetOrder(job.PaymentIntentID); err == nil && order.Amount.IsPositive() {
+		paid = fmt.Sprintf(", 支付金额 %s", order.Amount)
+	}
+	err := mail.NewMailer().SendMail([]string{job.Email}, "积分已到账", fmt.Sprintf("您好,尊敬的灵息用户 %s , 您的 %s 积分已到账%s<br><br>灵息.com 自动邮件<br>请勿回复", job.Email, strconv.FormatInt(job.Points, 10), paid), "text/html")
+	if err != nil {
+		log.Printf("发送到账邮件失败 (%s): %v", job.Email, err)
+	}
+}
@@ -196,3 +196,16 @@ func isValidEmail(email string) bool {
 
 	return true
 }
+
+// Alert 记录需要人工处理的告警, 配置了ALERT_EMAIL时同时发送邮件
+func Alert(subject string, message string) {
+	log.Print("[告警] ", message)
+
+	alertEmail := utils.GetEnvVariable("ALERT_EMAIL", "")
+	if alertEmail == "" {
+		return
+	}
+	if err := NewMailer().SendMail([]string{alertEmail}, subject, message, "text/plain"); err != nil {
+		log.Printf("发送告警邮件失败: %v", err)
+	}
+}
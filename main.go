@@ -1,21 +1,34 @@
 package main
 
 import (
+	"breathaipay/autotopup"
+	"breathaipay/cards"
+	"breathaipay/catalog"
+	"breathaipay/coupons"
 	"breathaipay/database"
-	"breathaipay/mail"
+	"breathaipay/fulfillment"
+	"breathaipay/money"
 	"breathaipay/openwebui"
+	"breathaipay/payments"
+	"breathaipay/pricing"
+	"breathaipay/sites"
+	"breathaipay/subscriptions"
 	"breathaipay/utils"
 
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
 	"text/template"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/stripe/stripe-go/v84"
-	"github.com/stripe/stripe-go/v84/paymentintent"
 )
 
 // UserInfo 结构体用于存储用户信息
@@ -29,37 +42,54 @@ type Order struct {
 	ExpiresAt string `json:"expires_at"` // 添加过期时间字段
 }
 
-type Product struct {
-	ID     int     `json:"id"`
-	Name   string  `json:"name"`
-	Price  float64 `json:"price"`
-	Points int     `json:"points"`
-}
+func main() {
+	migrateStatus := flag.Bool("migrate-status", false, "输出尚未执行的数据库迁移后退出, 不执行迁移")
+	flag.Parse()
+	if *migrateStatus {
+		if err := database.PrintPendingMigrations(os.Stdout); err != nil {
+			log.Fatal("查询数据库迁移失败: ", err)
+		}
+		return
+	}
 
-// 从函数获取商品列表
-func GetProducts() []Product {
-	return []Product{
-		{ID: 1, Name: "100,000 积分", Price: 20.0, Points: 100000},
-		{ID: 2, Name: "500,000 积分", Price: 50.0, Points: 500000},
-		{ID: 3, Name: "1,000,000 积分", Price: 100.0, Points: 1000000},
+	// 加载站点配置
+	if err := sites.Load(); err != nil {
+		log.Fatal("加载站点配置失败: ", err)
+	}
+
+	// 加载手续费规则
+	if err := pricing.Load(); err != nil {
+		log.Fatal("加载手续费配置失败: ", err)
 	}
-}
 
-func main() {
 	// 初始化数据库
 	database.InitDB()
 	defer database.CloseDb() // 结束后关闭数据库连接
 
-	// 初始化Stripe - 正确设置API密钥
-	stripe.Key = utils.GetEnvVariable("STRIPE_PRIVATE_KEY", "")
+	// 初始化支付方, Stripe私钥由支付方读取, 手续费规则中用到的支付方必须已启用
 	pubKey := utils.GetEnvVariable("STRIPE_PUBLIC_KEY", "")
-	if stripe.Key == "" || pubKey == "" {
+	if pubKey == "" {
 		log.Fatal("没有配置Stripe密钥")
 	}
+	if err := payments.Init(); err != nil {
+		log.Fatal("初始化支付方失败: ", err)
+	}
+	for _, name := range pricing.Providers() {
+		if _, err := payments.For(name); err != nil {
+			log.Fatal("手续费配置中的支付方不可用: ", err)
+		}
+	}
 
 	// 设置时区
 	time.Local, _ = time.LoadLocation("Asia/Shanghai")
 
+	// 启动积分发放队列, 订阅账单到账后发送订阅的到账邮件
+	fulfillment.RegisterReceipt(database.LedgerSourceSubscription, subscriptions.SendReceipt)
+	fulfillment.Start()
+
+	// 启动自动充值的余额检查
+	autotopup.Start()
+
 	// 获取调试模式
 	debugMode := utils.GetEnvVariable("DEBUG_MODE", "true")
 
@@ -93,6 +123,10 @@ func main() {
 			return a - b
 		},
 		"printf": fmt.Sprintf,
+		"maxQuantity": func() int {
+			return pricing.MaxQuantity
+		},
+		"linksEnabled": utils.LinksEnabled,
 	}
 
 	// 应用模板函数
@@ -106,7 +140,10 @@ func main() {
 
 	// 首页 - 商品选择页面
 	r.GET("/", func(c *gin.Context) {
-		products := GetProducts()
+		products, err := catalog.List("")
+		if err != nil {
+			log.Printf("获取商品列表失败: %v", err)
+		}
 		c.HTML(http.StatusOK, "product.html", gin.H{"products": products})
 	})
 
@@ -121,25 +158,19 @@ func main() {
 		}
 
 		// 根据商品ID获取商品信息
-		products := GetProducts()
-		var selectedProduct *Product
-		for _, p := range products {
-			if p.ID == productID {
-				selectedProduct = &p
-				break
-			}
-		}
-
-		if selectedProduct == nil {
-			log.Printf("未找到ID为 %d 的商品", productID)
+		selectedProduct, err := catalog.Get(productID, "")
+		if err != nil {
+			log.Printf("未找到ID为 %d 的商品: %v", productID, err)
 			c.HTML(http.StatusOK, "product.html", nil)
 			return
 		}
 
 		c.HTML(http.StatusOK, "checkout.html", gin.H{
-			"Points":    selectedProduct.Name,
-			"Price":     fmt.Sprintf("%.0f", selectedProduct.Price),
-			"ProductID": selectedProduct.ID,
+			"Points":         selectedProduct.Name,
+			"Price":          selectedProduct.Price,
+			"ProductID":      selectedProduct.ID,
+			"Sites":          catalog.SitesFor(*selectedProduct),
+			"PaymentMethods": pricing.PaymentMethods(selectedProduct.Currency),
 		})
 	})
 
@@ -149,6 +180,8 @@ func main() {
 		siteType := c.PostForm("siteType")
 		quantityStr := c.PostForm("quantity")
 		email := c.PostForm("email")
+		couponCode := coupons.Normalize(c.PostForm("coupon"))
+		paymentMethod := paymentMethodParam(c)
 
 		// 验证商品ID
 		productID, err := strconv.Atoi(productIDStr)
@@ -158,58 +191,191 @@ func main() {
 			return
 		}
 
-		// 根据商品ID重新获取商品信息，防止篡改
-		products := GetProducts()
-		var selectedProduct *Product
-		for _, p := range products {
-			if p.ID == productID {
-				selectedProduct = &p
-				break
-			}
+		// 验证站点是否存在并允许下单
+		site, ok := sites.GetEnabled(siteType)
+		if !ok {
+			log.Printf("站点不存在或未启用: %s", siteType)
+			c.HTML(http.StatusOK, "product.html", nil)
+			return
 		}
 
-		if selectedProduct == nil {
-			log.Printf("未找到ID为 %d 的商品", productID)
+		// 根据商品ID重新获取商品信息，防止篡改
+		selectedProduct, err := catalog.Get(productID, site.Key)
+		if err != nil {
+			log.Printf("未找到站点 %s 上ID为 %d 的商品: %v", site.Key, productID, err)
 			c.HTML(http.StatusOK, "product.html", nil)
 			return
 		}
 
-		// 使用从后端获取的真实价格，而不是前端传来的值
-		price := int(selectedProduct.Price)
-
 		// 验证quantity是否为有效值
 		quantityVal, err := strconv.Atoi(quantityStr)
-		if err != nil || quantityVal < 1 {
-			log.Printf("购买数量无效: %v", err)
+		if err != nil || !pricing.ValidQuantity(quantityVal) {
+			log.Printf("购买数量无效: %s", quantityStr)
 			c.HTML(http.StatusOK, "product.html", nil)
 			return
 		}
 
+		// 信息有误时返回填写页面, 保留用户已填写的内容
+		renderCheckoutError := func(message string) {
+			c.HTML(http.StatusOK, "checkout.html", gin.H{
+				"Points":         selectedProduct.Name,
+				"Price":          selectedProduct.Price,
+				"ProductID":      selectedProduct.ID,
+				"Sites":          catalog.SitesFor(*selectedProduct),
+				"PaymentMethods": pricing.PaymentMethods(selectedProduct.Currency),
+				"SiteType":       site.Key,
+				"Quantity":       quantityStr,
+				"Email":          email,
+				"Coupon":         couponCode,
+				"PaymentMethod":  paymentMethod,
+				"Error":          message,
+			})
+		}
+
+		if !pricing.ValidPaymentMethod(selectedProduct.Currency, paymentMethod) {
+			renderCheckoutError("不支持所选的支付方式，请重新选择。")
+			return
+		}
+
+		// 确认所选站点上存在该邮箱的账户, 否则付款后积分无法到账
+		openwebuiUserID, err := findOpenWebUIUser(email, site)
+		if err != nil {
+			renderCheckoutError(accountErrorMessage(err, site))
+			return
+		}
+
+		// 校验优惠码, 创建PaymentIntent时会再次校验
+		coupon, err := coupons.Validate(couponCode, email, productID, selectedProduct.Currency)
+		if err != nil {
+			renderCheckoutError(couponErrorMessage(err))
+			return
+		}
+
 		// 计算包含手续费的总价，使用后端的价格
-		total := (float64(price*quantityVal) + 1.9) / 0.971
+		quote, err := pricing.QuoteOrder(selectedProduct, quantityVal, coupon, paymentMethod)
+		if err != nil {
+			log.Printf("计算订单金额失败: %v", err)
+			renderCheckoutError(quoteErrorMessage(err))
+			return
+		}
+
+		order := checkoutOrder{
+			product:         selectedProduct,
+			site:            site,
+			quantity:        quantityVal,
+			email:           email,
+			openwebuiUserID: openwebuiUserID,
+			quote:           quote,
+		}
+
+		// 所选支付方式由直连支付方处理时跳转到支付方的页面
+		provider, err := directProvider(selectedProduct.Currency, paymentMethod)
+		if err != nil {
+			log.Printf("获取支付方失败: %v", err)
+			renderCheckoutError("不支持所选的支付方式，请重新选择。")
+			return
+		}
+		if provider != nil {
+			if err := redirectToProvider(c, provider, order); err != nil {
+				log.Printf("创建%s支付失败: %v", provider.Name(), err)
+				renderCheckoutError("创建支付失败，请稍后再试。")
+			}
+			return
+		}
+
+		// 使用Stripe托管的Checkout页面付款时直接跳转
+		if useCheckoutSession() {
+			if err := redirectToCheckout(c, order); err != nil {
+				log.Printf("Stripe API error: %v", err)
+				renderCheckoutError("创建支付失败，请稍后再试。")
+			}
+			return
+		}
 
 		c.HTML(http.StatusOK, "payment.html", gin.H{
 			"ProductID":         productID,
 			"Points":            selectedProduct.Name,
-			"Price":             fmt.Sprintf("%.0f", selectedProduct.Price),
-			"SiteType":          siteType,
+			"Price":             selectedProduct.Price,
+			"SiteType":          site.Key,
+			"SiteName":          site.Name,
 			"Quantity":          quantityStr, // 保持为字符串以满足模板显示需求
 			"Email":             email,
-			"Total":             total,
+			"Coupon":            quote.CouponCode,
+			"PaymentMethod":     quote.PaymentMethod,
+			"PaymentMethodName": pricing.Match(selectedProduct.Currency, paymentMethod).Name,
+			"Quote":             quote,
+			"IdempotencyKey":    newIdempotencyKey(), // 每次打开付款页生成一次, 重复提交时复用同一个PaymentIntent
+			"CanSaveCard":       utils.LinksEnabled() && (paymentMethod == "" || paymentMethod == cards.PaymentMethodCard),
 			"STRIPE_PUBLIC_KEY": pubKey,
 		})
 	})
 
 	r.POST("/api/payment", createPaymentIntent) // 修改为创建PaymentIntent
+	r.POST("/api/payment/save-card", saveCardHandler)
 
 	// 替换原有的success路由处理器
 	r.GET("/success", successPageHandler)
 
+	// 兑换码兑换积分
+	r.GET("/redeem", redeemPageHandler)
+	r.POST("/redeem", sameOrigin, redeemHandler)
+
+	// 一键购买、自动充值和订阅都通过签名链接验证用户, 未配置签名密钥时不启用
+	if utils.LinksEnabled() {
+		// 使用已保存的卡片一键购买
+		r.GET("/quick", quickPageHandler)
+		r.POST("/quick", sameOrigin, quickLinkHandler)
+		r.GET("/quick/buy", quickBuyPageHandler)
+		r.POST("/quick/confirm", sameOrigin, quickConfirmHandler(pubKey))
+		r.POST("/quick/cards/remove", sameOrigin, quickRemoveCardHandler)
+		r.POST("/api/quick-buy", sameOrigin, quickBuyHandler)
+
+		// 自动充值
+		r.POST("/quick/auto-topup", sameOrigin, quickAutoTopupHandler)
+		r.GET("/auto-topup", autoTopupPageHandler)
+		r.POST("/auto-topup", sameOrigin, autoTopupActionHandler)
+
+		// 按月订阅积分套餐
+		r.GET("/subscribe", subscribePageHandler)
+		r.POST("/subscribe", sameOrigin, subscribeCheckoutHandler(pubKey))
+		r.POST("/api/subscribe", sameOrigin, createSubscriptionHandler)
+		r.GET("/subscription/success", subscriptionSuccessHandler)
+		r.GET("/subscription/manage", subscriptionManageHandler)
+		r.POST("/subscription/manage", sameOrigin, subscriptionManageActionHandler)
+	} else {
+		log.Print("未配置LINK_SECRET, 一键购买、自动充值和订阅已禁用")
+	}
+
+	// Stripe Webhook, 即使用户关闭了页面也能完成订单
+	webhookSecret := utils.GetEnvVariable("STRIPE_WEBHOOK_SECRET", "")
+	if webhookSecret != "" {
+		r.POST("/webhooks/stripe", stripeWebhookHandler)
+	} else {
+		log.Print("未配置STRIPE_WEBHOOK_SECRET, Stripe Webhook已禁用")
+	}
+
+	// 直连支付宝的异步通知
+	if alipay, err := payments.For(payments.ProviderAlipay); err == nil {
+		r.POST("/notify/alipay", alipayNotifyHandler(alipay))
+	}
+
+	// 管理后台, 未配置账号密码时不启用
+	adminUsername := utils.GetEnvVariable("ADMIN_USERNAME", "")
+	adminPassword := utils.GetEnvVariable("ADMIN_PASSWORD", "")
+	if adminUsername != "" && adminPassword != "" {
+		registerAdminRoutes(r, adminUsername, adminPassword)
+	} else {
+		log.Print("未配置ADMIN_USERNAME/ADMIN_PASSWORD, 管理后台已禁用")
+	}
+
 	// 启动定期清理过期订单的goroutine
 	go func() {
 		for {
 			// log.Println("开始删除过期订单")
-			err := database.DeleteExpiredOrder()
+			err := database.DeleteExpiredOrder(func(p payments.Payment) error {
+				_, err := fulfillPayment(p, database.OrderActorSweeper)
+				return err
+			})
 			if err != nil {
 				log.Printf("删除过期订单出错: %v", err)
 			}
@@ -237,6 +403,8 @@ func createPaymentIntent(c *gin.Context) {
 	siteType := c.PostForm("siteType")
 	quantityStr := c.PostForm("quantity") // 购买数量
 	email := c.PostForm("email")
+	couponCode := coupons.Normalize(c.PostForm("coupon"))
+	paymentMethod := paymentMethodParam(c)
 
 	// 验证商品ID
 	productID, err := strconv.Atoi(productIDStr)
@@ -250,18 +418,22 @@ func createPaymentIntent(c *gin.Context) {
 		return
 	}
 
-	// 根据商品ID重新获取商品信息，防止篡改
-	products := GetProducts()
-	var selectedProduct *Product
-	for _, p := range products {
-		if p.ID == productID {
-			selectedProduct = &p
-			break
-		}
+	// 验证站点是否存在并允许下单
+	site, ok := sites.GetEnabled(siteType)
+	if !ok {
+		log.Printf("站点不存在或未启用: %s", siteType)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"message": "无效的站点",
+			},
+		})
+		return
 	}
 
-	if selectedProduct == nil {
-		log.Printf("未找到ID为 %d 的商品", productID)
+	// 根据商品ID重新获取商品信息，防止篡改
+	selectedProduct, err := catalog.Get(productID, site.Key)
+	if err != nil {
+		log.Printf("未找到站点 %s 上ID为 %d 的商品: %v", site.Key, productID, err)
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": gin.H{
 				"message": "无效的商品ID",
@@ -272,8 +444,8 @@ func createPaymentIntent(c *gin.Context) {
 
 	// 验证quantity是否为有效值
 	quantityVal, err := strconv.Atoi(quantityStr)
-	if err != nil || quantityVal < 1 {
-		log.Printf("购买数量无效: %v", err)
+	if err != nil || !pricing.ValidQuantity(quantityVal) {
+		log.Printf("购买数量无效: %s", quantityStr)
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": gin.H{
 				"message": "无效的购买数量",
@@ -282,9 +454,73 @@ func createPaymentIntent(c *gin.Context) {
 		return
 	}
 
+	// 确认所选站点上存在该邮箱的账户, 否则付款后积分无法到账
+	openwebuiUserID, err := findOpenWebUIUser(email, site)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"message": accountErrorMessage(err, site),
+				"code":    "account_not_found",
+			},
+		})
+		return
+	}
+
+	// 优惠码以服务端校验结果为准
+	coupon, err := coupons.Validate(couponCode, email, productID, selectedProduct.Currency)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"message": couponErrorMessage(err),
+				"code":    "invalid_coupon",
+			},
+		})
+		return
+	}
+
+	// 直连支付方的订单在付款页之前已经跳转, 这里只创建Stripe的PaymentIntent
+	if !pricing.ValidPaymentMethod(selectedProduct.Currency, paymentMethod) || !handledByStripe(selectedProduct.Currency, paymentMethod) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"message": "不支持所选的支付方式",
+			},
+		})
+		return
+	}
+
 	// 使用从后端获取的真实价格，而不是前端传来的价格参数
-	priceVal := int(selectedProduct.Price)
-	total := (float64(priceVal*quantityVal) + 1.9) / 0.971
+	quote, err := pricing.QuoteOrder(selectedProduct, quantityVal, coupon, paymentMethod)
+	if err != nil {
+		log.Printf("计算订单金额失败: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"message": quoteErrorMessage(err),
+			},
+		})
+		return
+	}
+
+	// 幂等键由付款页生成, 重复点击或前端重试时保持不变
+	idempotencyKey := c.PostForm("idempotencyKey")
+	if len(idempotencyKey) > 64 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"message": "无效的请求",
+			},
+		})
+		return
+	}
+
+	// 已有相同邮箱、站点、商品、数量和优惠码的未过期订单时, 直接返回该订单, 不再创建新的PaymentIntent
+	if order, ok := reusablePendingOrder(email, site.Key, productID, quantityVal, quote.CouponCode, paymentMethod, quote.Total); ok {
+		log.Printf("复用未过期的订单: %s", order.payment.ID)
+		c.JSON(http.StatusOK, gin.H{
+			"clientSecret": order.payment.ClientSecret,
+			"expiresAt":    order.expiresAt.Unix(),
+			"saveCard":     order.payment.SaveCard,
+		})
+		return
+	}
 
 	// 获取客户ID
 	customerId, err := database.GetCustomerId(email)
@@ -297,44 +533,40 @@ func createPaymentIntent(c *gin.Context) {
 		return
 	}
 
-	// --- 2. 准备 PaymentIntent 参数 ---
-	params := &stripe.PaymentIntentParams{
-		Amount:       stripe.Int64(int64(total * 100.0)),
-		Currency:     stripe.String(string(stripe.CurrencyCNY)),
-		Description:  stripe.String("购买灵息积分"),
-		ReceiptEmail: stripe.String(email),
+	// --- 2. 通过Stripe创建 PaymentIntent ---
+	// 相同幂等键的请求由Stripe返回同一个PaymentIntent, 防止并发的重复请求创建多笔订单
+	pi, err := payments.Stripe().Create(payments.CreateParams{
+		Amount:      quote.Total,
+		Description: "购买灵息积分",
+		Email:       email,
+		CustomerID:  customerId,
 		Metadata: map[string]string{ // 添加元数据
-			"email":     email,
-			"sitetype":  siteType,
-			"amount":    strconv.Itoa(selectedProduct.Points * quantityVal), // 使用后端给出的积分数量
-			"productID": strconv.Itoa(productID),                            // 记录商品ID到元数据
-		},
-		// 启用自动支付方式选择
-		AutomaticPaymentMethods: &stripe.PaymentIntentAutomaticPaymentMethodsParams{
-			Enabled:        stripe.Bool(true),
-			AllowRedirects: stripe.String("always"),
+			"email":           email,
+			"sitetype":        site.Key,
+			"amount":          strconv.FormatInt(quote.Points, 10),          // 使用后端给出的积分数量, 包含优惠码赠送的积分
+			"productID":       strconv.Itoa(productID),                      // 记录商品ID到元数据
+			"openwebuiUserID": openwebuiUserID,                              // 下单时查到的OpenWebUI用户ID
+			"coupon":          quote.CouponCode,                             // 使用的优惠码, 未使用时为空
+			"discount":        strconv.FormatInt(quote.Discount.Amount, 10), // 以最小货币单位表示
+			"fee":             strconv.FormatInt(quote.Fee.Amount, 10),      // 用户承担的手续费
 		},
-		Customer: stripe.String(customerId),
-	}
-
-	// --- 3. 调用 Stripe API 创建 PaymentIntent ---
-	pi, err := paymentintent.New(params)
+		PaymentMethod:  paymentMethod,
+		IdempotencyKey: idempotencyKey,
+	})
 	if err != nil {
-		// --- 4. 处理 Stripe API 错误 ---
+		// --- 3. 处理 Stripe API 错误 ---
 		log.Printf("Stripe API error: %v\n", err) // 记录详细错误到服务器日志
 
 		// 检查是否是amount_too_large错误
-		if stripeErr, ok := err.(*stripe.Error); ok {
-			if stripeErr.Code == "amount_too_large" {
-				// 向前端返回特定的错误信息
-				c.JSON(http.StatusBadRequest, gin.H{
-					"error": gin.H{
-						"message": "订单金额过大，请减少购买数量或选择其他商品。",
-						"code":    "amount_too_large",
-					},
-				})
-				return
-			}
+		if errors.Is(err, payments.ErrAmountTooLarge) {
+			// 向前端返回特定的错误信息
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": gin.H{
+					"message": "订单金额过大，请减少购买数量或选择其他商品。",
+					"code":    "amount_too_large",
+				},
+			})
+			return
 		}
 
 		// 向前端返回通用的用户友好错误信息
@@ -347,7 +579,22 @@ func createPaymentIntent(c *gin.Context) {
 	}
 
 	// 记录订单到数据库，包含过期时间
-	err = database.RecordOrder(pi.ID, "created", expiresAt)
+	err = database.RecordOrder(database.Order{
+		OrderID:         pi.ID,
+		Status:          "created",
+		Provider:        payments.ProviderStripe,
+		ExpiresAt:       expiresAt,
+		OpenWebUIUserID: openwebuiUserID,
+		Email:           email,
+		SiteType:        site.Key,
+		ProductID:       productID,
+		Quantity:        quantityVal,
+		Points:          quote.Points,
+		Amount:          quote.Total,
+		IdempotencyKey:  idempotencyKey,
+		CouponCode:      quote.CouponCode,
+		Discount:        quote.Discount,
+	})
 	if err != nil {
 		log.Printf("记录订单到数据库失败 (%s): %v", pi.ID, err)
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -358,15 +605,28 @@ func createPaymentIntent(c *gin.Context) {
 		return
 	}
 
-	// --- 5. 成功创建，返回 client_secret ---
+	// --- 4. 成功创建，返回 client_secret ---
 	log.Printf("PaymentIntent created: %s\n", pi.ID) // 记录日志
 	c.JSON(http.StatusOK, gin.H{
 		"clientSecret": pi.ClientSecret,
 		"expiresAt":    expiresAt.Unix(), // 返回过期时间戳
+		"saveCard":     false,
 	})
 }
 
 func successPageHandler(c *gin.Context) {
+	// Checkout Session模式跳转回来时只带有session_id
+	if sessionID := c.Query("session_id"); sessionID != "" {
+		checkoutSuccessHandler(c, sessionID)
+		return
+	}
+
+	// 直连支付方跳转回来时带有本程序生成的订单号
+	if orderID := c.Query("out_trade_no"); orderID != "" {
+		orderSuccessHandler(c, orderID)
+		return
+	}
+
 	// 1. 从查询参数中获取 PaymentIntent ID
 	paymentIntentID := c.Query("payment_intent")
 	// clientSecret := c.Query("payment_intent_client_secret") // 有时也会用到，用于额外验证
@@ -385,97 +645,227 @@ func successPageHandler(c *gin.Context) {
 	}
 	// 可以记录 redirectStatus 日志，但不要完全依赖它作为成功依据
 
-	// 3. 调用 Stripe API 获取 PaymentIntent 详情
-	// 确保 stripe.Key 已经在 main 函数中用你的 Secret Key 初始化
-	pi, err := paymentintent.Get(paymentIntentID, nil) // 第二个参数是可选的请求参数
+	paymentResultHandler(c, payments.Stripe(), paymentIntentID)
+}
+
+// paymentResultHandler 向支付方查询支付状态并展示结果, 支付成功时与Webhook共用同一发放流程
+func paymentResultHandler(c *gin.Context, provider payments.Provider, paymentID string) {
+	// 3. 调用支付方的 API 获取支付详情
+	p, err := provider.Get(paymentID)
 	if err != nil {
-		log.Printf("获取 PaymentIntent 失败 (%s): %v", paymentIntentID, err)
+		log.Printf("获取支付状态失败 (%s): %v", paymentID, err)
 		// 可能是 ID 无效，或网络问题等
 		c.String(http.StatusInternalServerError, "无法验证支付状态，请联系客服。")
 		return
 	}
 
-	// 4. 验证 PaymentIntent 状态和其他关键信息
-	switch pi.Status {
-	case stripe.PaymentIntentStatusSucceeded:
+	// 4. 验证支付状态和其他关键信息
+	switch p.Status {
+	case payments.StatusSucceeded:
 		// 支付成功
-		log.Printf("支付成功: PaymentIntent ID=%s, Amount=%d, Currency=%s", pi.ID, pi.Amount, pi.Currency)
+		log.Printf("支付成功: %s ID=%s, Amount=%s", provider.Name(), p.ID, p.Amount)
 
-		// 检查订单是否已经处理过，防止重复处理
-		alreadyProcessed, err := database.IsOrderProcessed(paymentIntentID)
-		if err != nil {
-			log.Printf("检查订单是否已处理时出错 (%s): %v", paymentIntentID, err)
+		// 原子地将订单从created改为fulfilling, 与Webhook共用同一流程
+		// 刷新或前进后退产生的并发请求中只有一个能认领成功, 其余的直接展示订单信息
+		if _, err := fulfillPayment(p, database.OrderActorSuccessPage); err != nil {
+			log.Printf("处理支付成功订单时出错 (%s): %v", paymentID, err)
 			c.String(http.StatusInternalServerError, "系统错误，请联系客服。")
 			return
 		}
 
-		if alreadyProcessed {
-			log.Printf("订单已处理过，跳过重复处理: %s", paymentIntentID)
-			c.HTML(http.StatusOK, "success.html", gin.H{
-				"paymentIntentID": paymentIntentID,
-				"amount":          pi.Amount / 100.0,
-				"currency":        pi.Currency,
-				"email":           "", // 订单已处理，但没有获取到邮箱
-				"sitetype":        "", // 订单已处理，但没有获取到站点类型
-			})
-			return
-		}
+		// 5. 向用户返回成功页面
+		renderSuccessPage(c, p.ID, p.Metadata["email"], p.Metadata["sitetype"], p.Amount)
 
-		// 5. 获取并处理你的业务订单信息
-		var email string
-		var siteType string
-		var realAmount int
-		if pi.Metadata != nil {
-			email = pi.Metadata["email"]
-			siteType = pi.Metadata["sitetype"]
-			realAmount, _ = strconv.Atoi(pi.Metadata["amount"])
+	case payments.StatusProcessing:
+		c.String(http.StatusOK, "支付处理中，到账后积分将自动发放，请稍后查看邮箱。")
+	case payments.StatusCanceled, payments.StatusPending:
+		// 支付失败或需要其他支付方式
+		log.Printf("支付失败或已取消: %s ID=%s, Status=%s", provider.Name(), p.ID, p.RawStatus)
+		c.String(http.StatusBadRequest, "支付失败或已取消。")
+	default:
+		log.Printf("未知支付状态: %s ID=%s, Status=%s", provider.Name(), p.ID, p.RawStatus)
+		c.String(http.StatusInternalServerError, "未知支付状态。")
+	}
+}
+
+// renderSuccessPage 展示支付成功页面, 内容以订单记录为准, 旧订单缺少的信息使用支付记录中的信息补充
+func renderSuccessPage(c *gin.Context, paymentIntentID string, email string, siteType string, amount money.Money) {
+	if order, err := database.GetOrder(paymentIntentID); err == nil {
+		email, siteType = order.Email, order.SiteType
+		if order.Amount.IsPositive() {
+			amount = order.Amount
 		}
+	} else {
+		log.Printf("获取订单失败 (%s): %v", paymentIntentID, err)
+	}
+	c.HTML(http.StatusOK, "success.html", gin.H{
+		"paymentIntentID": paymentIntentID,
+		"amount":          amount,
+		"currency":        strings.ToUpper(amount.Currency),
+		"email":           email,
+		"sitetype":        siteName(siteType),
+	})
+}
 
-		// 更新订单状态为已成功
-		err = database.UpdateOrderStatus(paymentIntentID, "succeeded", false)
+// saveCardHandler 用户在付款页勾选或取消保存卡片时更新PaymentIntent的setup_future_usage
+// 需要同时提供client secret, 只能修改自己的待支付订单
+func saveCardHandler(c *gin.Context) {
+	clientSecret := c.PostForm("clientSecret")
+	paymentIntentID, _, _ := strings.Cut(clientSecret, "_secret_")
+	order, err := database.GetOrder(paymentIntentID)
+	if err != nil || order.Provider != payments.ProviderStripe || (order.Status != database.OrderCreated && order.Status != database.OrderPaymentFailed) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": "订单不存在或已支付"}})
+		return
+	}
+	p, err := payments.Stripe().Get(paymentIntentID)
+	if err != nil || p.ClientSecret != clientSecret {
 		if err != nil {
-			log.Printf("更新订单状态到数据库失败 (%s): %v", paymentIntentID, err)
-			c.String(http.StatusInternalServerError, "系统错误，无法记录订单，请联系客服。")
-			return
+			log.Printf("获取 PaymentIntent 失败 (%s): %v", paymentIntentID, err)
 		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": "订单不存在或已支付"}})
+		return
+	}
 
-		log.Printf("Real Amount: %d", realAmount)
-		switch siteType {
-		case "international":
-			go finishPay(email, int64(realAmount), 1)
-		case "domestic":
-			go finishPay(email, int64(realAmount), 2)
+	save := c.PostForm("save") == "true"
+	if p.SaveCard != save {
+		if err := payments.Stripe().SetSaveCard(paymentIntentID, save); err != nil {
+			log.Printf("更新保存卡片设置失败 (%s): %v", paymentIntentID, err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": "所选支付方式不支持保存，请取消勾选后重试。"}})
+			return
 		}
+	}
+	c.JSON(http.StatusOK, gin.H{"saveCard": save})
+}
 
-		// 6. 向用户返回成功页面
-		c.HTML(http.StatusOK, "success.html", gin.H{
-			"paymentIntentID": paymentIntentID,
-			"amount":          pi.Amount / 100.0,
-			"currency":        pi.Currency,
-			"email":           email,
-			"sitetype":        siteType,
-		})
+// paymentMethodParam 读取用户选择的支付方式, 未选择或选择默认时返回空字符串表示自动选择
+func paymentMethodParam(c *gin.Context) string {
+	method := strings.ToLower(strings.TrimSpace(c.PostForm("paymentMethod")))
+	if method == "default" {
+		return ""
+	}
+	return method
+}
 
-	case stripe.PaymentIntentStatusCanceled, stripe.PaymentIntentStatusRequiresPaymentMethod:
-		// 支付失败或需要其他支付方式
-		log.Printf("支付失败或已取消: PaymentIntent ID=%s, Status=%s", pi.ID, pi.Status)
-		c.String(http.StatusBadRequest, "支付失败或已取消。")
-	default:
-		log.Printf("未知支付状态: PaymentIntent ID=%s, Status=%s", pi.ID, pi.Status)
-		c.String(http.StatusInternalServerError, "未知支付状态。")
+// couponErrorMessage 优惠码不可用时展示给用户的提示
+func couponErrorMessage(err error) string {
+	if coupons.IsUserError(err) {
+		return err.Error()
+	}
+	log.Printf("校验优惠码失败: %v", err)
+	return "暂时无法验证优惠码，请稍后再试。"
+}
+
+// siteName 获取站点的展示名称, 站点已从配置中移除时返回标识本身
+func siteName(key string) string {
+	if site, ok := sites.Get(key); ok {
+		return site.Name
 	}
+	return key
+}
+
+// pendingOrder 可以复用的待支付订单
+type pendingOrder struct {
+	payment   payments.Payment
+	expiresAt time.Time
 }
 
-// 处理积分增加
+// reusablePendingOrder 查找可以直接返回给前端的待支付订单
+// 订单对应的PaymentIntent需要仍可支付且金额和支付方式未变化, 否则创建新订单
+func reusablePendingOrder(email string, siteType string, productID int, quantity int, couponCode string, paymentMethod string, amount money.Money) (pendingOrder, bool) {
+	order, err := database.FindPendingOrder(email, siteType, productID, quantity, couponCode)
+	if err != nil {
+		if !database.IsNotFound(err) {
+			log.Printf("查询待支付订单失败: %v", err)
+		}
+		return pendingOrder{}, false
+	}
+	// 只有付款页创建的PaymentIntent可以复用
+	if order.Provider != payments.ProviderStripe || strings.HasPrefix(order.OrderID, "cs_") {
+		return pendingOrder{}, false
+	}
 
-func finishPay(email string, amount int64, sitetype int) {
-	user := openwebui.GetUserIDWithEmail(email, sitetype)
-	err := openwebui.AddBalance(user, amount, sitetype)
+	p, err := payments.Stripe().Get(order.OrderID)
 	if err != nil {
-		log.Println("Failed to add balance:", err)
-		return
+		log.Printf("获取 PaymentIntent 失败 (%s): %v", order.OrderID, err)
+		return pendingOrder{}, false
+	}
+	if p.Status != payments.StatusPending || p.ClientSecret == "" {
+		return pendingOrder{}, false
+	}
+	if p.Amount != amount || p.PaymentMethod != paymentMethod {
+		return pendingOrder{}, false
+	}
+	return pendingOrder{payment: p, expiresAt: order.ExpiresAt}, true
+}
+
+// newIdempotencyKey 生成付款页使用的幂等键
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// 没有幂等键时仍会按邮箱、商品和数量复用订单
+		log.Printf("生成幂等键失败: %v", err)
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// findOpenWebUIUser 在站点上查找使用该邮箱注册的账户, 返回OpenWebUI用户ID
+func findOpenWebUIUser(email string, site sites.Site) (string, error) {
+	user, err := openwebui.FindUser(email, site)
+	if err != nil {
+		log.Printf("在站点 %s 上查找用户 %s 失败: %v", site.Key, email, err)
+		return "", err
+	}
+	return user.ID, nil
+}
+
+// accountErrorMessage 查找账户失败时展示给用户的提示
+func accountErrorMessage(err error, site sites.Site) string {
+	if errors.Is(err, openwebui.ErrUserNotFound) {
+		return fmt.Sprintf("%s上没有使用该邮箱注册的账户，请先注册或检查邮箱是否填写正确。", site.Name)
+	}
+	return "暂时无法验证您的账户，请稍后再试。"
+}
+
+// quoteErrorMessage 计算订单金额失败时展示给用户的提示
+func quoteErrorMessage(err error) string {
+	if errors.Is(err, pricing.ErrZeroTotal) {
+		return "优惠后订单金额为0，无法下单。"
+	}
+	return "订单金额过大，请减少购买数量。"
+}
+
+// fulfillPayment 处理一笔已支付成功的订单, 成功页、Webhook和过期清理共用, actor为调用方
+// 只有原子地认领到订单的调用者才会写入发放任务, 返回false表示订单已被处理过
+// p.Amount为支付方返回的实际支付金额, 与订单金额不一致时不发放积分, 订单等待人工核对
+func fulfillPayment(p payments.Payment, actor string) (bool, error) {
+	// 获取业务订单信息, 支付宝等不支持元数据的支付方以订单记录为准
+	var email string
+	var siteType string
+	var realAmount int
+	if p.Metadata != nil {
+		email = p.Metadata["email"]
+		siteType = p.Metadata["sitetype"]
+		realAmount, _ = strconv.Atoi(p.Metadata["amount"])
 	} else {
-		log.Print("处理完成, 发送确认邮件")
-		mail.NewMailer().SendMail([]string{email}, "积分已到账", fmt.Sprintf("您好,尊敬的灵息用户 %s , 您的 %s 积分已到账<br><br>灵息.com 自动邮件<br>请勿回复", email, strconv.Itoa(int(amount))), "text/html")
+		order, err := database.GetOrder(p.ID)
+		if err != nil {
+			return false, fmt.Errorf("获取订单失败: %w", err)
+		}
+		email, siteType, realAmount = order.Email, order.SiteType, int(order.Points)
+	}
+
+	log.Printf("Real Amount: %d", realAmount)
+	queued, err := fulfillment.Enqueue(p.ID, email, siteType, int64(realAmount), p.Amount, actor)
+	if errors.Is(err, database.ErrAmountMismatch) {
+		// 订单已变更为amount_mismatch, 由管理员核对后处理, 不需要支付方重试
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !queued {
+		log.Printf("订单已处理过，跳过重复处理: %s", p.ID)
 	}
+	return queued, nil
 }
@@ -0,0 +1,200 @@
+package migrations
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 每组迁移一个目录, 文件名格式为 0001_说明.sql, 按版本号顺序执行
+// 已发布的迁移不要修改, 新的迁移使用更大的版本号追加, 修改表结构时SQLite和PostgreSQL需要同时添加
+//
+//go:embed sqlite/*.sql postgres/*.sql
+var files embed.FS
+
+// Set 一组迁移及其适用的数据库
+type Set struct {
+	Dir      string
+	Postgres bool
+}
+
+// 各数据库对应的迁移
+var (
+	SQLite   = Set{Dir: "sqlite"}
+	Postgres = Set{Dir: "postgres", Postgres: true}
+)
+
+// Migration 一个迁移文件
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// Load 读取指定数据库的所有迁移, 按版本号排序
+func Load(set Set) ([]Migration, error) {
+	entries, err := fs.ReadDir(files, set.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	seen := make(map[int]string)
+	for _, entry := range entries {
+		filename := entry.Name()
+		prefix, name, ok := strings.Cut(strings.TrimSuffix(filename, ".sql"), "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("迁移文件名格式错误: %s/%s", set.Dir, filename)
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("迁移版本号重复: %s/%s 与 %s/%s", set.Dir, filename, set.Dir, other)
+		}
+		seen[version] = filename
+
+		content, err := files.ReadFile(path.Join(set.Dir, filename))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: name, SQL: string(content)})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Applied 返回已执行的迁移版本, schema_migrations表不存在时返回空
+func Applied(db *sql.DB, set Set) (map[int]bool, error) {
+	query := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'"
+	if set.Postgres {
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'schema_migrations'"
+	}
+	var count int
+	err := db.QueryRow(query).Scan(&count)
+	if err != nil || count == 0 {
+		return map[int]bool{}, err
+	}
+
+	rows, err := db.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// Pending 返回尚未执行的迁移, 不会修改数据库
+func Pending(db *sql.DB, set Set) ([]Migration, error) {
+	migrations, err := Load(set)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := Applied(db, set)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, m := range migrations {
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Apply 依次执行尚未执行的迁移, 每个迁移与其记录在同一个事务中完成
+func Apply(db *sql.DB, set Set) error {
+	if err := ensureTable(db); err != nil {
+		return err
+	}
+	pending, err := Pending(db, set)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range pending {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(m.SQL); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("执行迁移 %s/%04d_%s 失败: %w", set.Dir, m.Version, m.Name, err)
+		}
+		if _, err := tx.Exec(insertQuery(set), m.Version, m.Name); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("已执行迁移 %s/%04d_%s", set.Dir, m.Version, m.Name)
+	}
+	return nil
+}
+
+// Baseline 将版本号不超过version的迁移记录为已执行, 但不执行其中的SQL
+// 用于接管由旧版本程序创建的数据库, 只在还没有任何迁移记录时生效
+func Baseline(db *sql.DB, set Set, version int) error {
+	if err := ensureTable(db); err != nil {
+		return err
+	}
+	applied, err := Applied(db, set)
+	if err != nil || len(applied) > 0 {
+		return err
+	}
+	migrations, err := Load(set)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, m := range migrations {
+		if m.Version > version {
+			break
+		}
+		if _, err := tx.Exec(insertQuery(set), m.Version, m.Name); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ensureTable 创建记录已执行迁移的表
+func ensureTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	return err
+}
+
+// insertQuery 记录已执行迁移的语句, PostgreSQL使用$n占位符
+func insertQuery(set Set) string {
+	if set.Postgres {
+		return "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)"
+	}
+	return "INSERT INTO schema_migrations (version, name) VALUES (?, ?)"
+}
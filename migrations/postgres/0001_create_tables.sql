@@ -0,0 +1,92 @@
+-- PostgreSQL的初始表结构, 对应SQLite迁移执行到当前版本后的结构
+-- 时间字段与SQLite一样以 YYYY-MM-DD HH:MM:SS 格式的文本保存, created_at等默认值为UTC时间
+CREATE TABLE IF NOT EXISTS orders (
+	id BIGSERIAL PRIMARY KEY,
+	order_id TEXT NOT NULL UNIQUE,
+	status TEXT NOT NULL,
+	created_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+	expires_at TEXT NOT NULL,
+	openwebui_user_id TEXT NOT NULL DEFAULT '',
+	email TEXT NOT NULL DEFAULT '',
+	site_type TEXT NOT NULL DEFAULT '',
+	product_id INTEGER NOT NULL DEFAULT 0,
+	quantity INTEGER NOT NULL DEFAULT 0,
+	idempotency_key TEXT NOT NULL DEFAULT '',
+	points BIGINT NOT NULL DEFAULT 0,
+	amount BIGINT NOT NULL DEFAULT 0,
+	currency TEXT NOT NULL DEFAULT '',
+	paid_at TEXT,
+	fulfilled_at TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_orders_email_status ON orders (email, status);
+
+CREATE TABLE IF NOT EXISTS fulfillment_jobs (
+	id BIGSERIAL PRIMARY KEY,
+	payment_intent_id TEXT NOT NULL UNIQUE,
+	email TEXT NOT NULL,
+	site_type TEXT NOT NULL,
+	points BIGINT NOT NULL,
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT NOT NULL DEFAULT '',
+	next_run_at TEXT NOT NULL,
+	created_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+	updated_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+);
+
+CREATE TABLE IF NOT EXISTS fulfillment_attempts (
+	id BIGSERIAL PRIMARY KEY,
+	payment_intent_id TEXT NOT NULL,
+	attempt INTEGER NOT NULL,
+	outcome TEXT NOT NULL,
+	error TEXT NOT NULL DEFAULT '',
+	created_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+);
+CREATE INDEX IF NOT EXISTS idx_fulfillment_attempts_pi ON fulfillment_attempts (payment_intent_id);
+
+CREATE TABLE IF NOT EXISTS refunds (
+	id BIGSERIAL PRIMARY KEY,
+	payment_intent_id TEXT NOT NULL,
+	amount_refunded BIGINT NOT NULL,
+	points BIGINT NOT NULL,
+	points_deducted BIGINT NOT NULL,
+	deducted_from TEXT NOT NULL,
+	source TEXT NOT NULL,
+	created_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+);
+CREATE INDEX IF NOT EXISTS idx_refunds_pi ON refunds (payment_intent_id);
+
+CREATE TABLE IF NOT EXISTS credit_ledger (
+	id BIGSERIAL PRIMARY KEY,
+	order_id TEXT NOT NULL,
+	openwebui_user_id TEXT NOT NULL,
+	email TEXT NOT NULL,
+	site TEXT NOT NULL,
+	delta BIGINT NOT NULL,
+	balance_before BIGINT NOT NULL,
+	balance_after BIGINT NOT NULL,
+	source TEXT NOT NULL,
+	mismatch BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+);
+CREATE INDEX IF NOT EXISTS idx_credit_ledger_order ON credit_ledger (order_id);
+CREATE INDEX IF NOT EXISTS idx_credit_ledger_user ON credit_ledger (openwebui_user_id);
+CREATE INDEX IF NOT EXISTS idx_credit_ledger_email ON credit_ledger (email);
+
+CREATE TABLE IF NOT EXISTS products (
+	id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	price DOUBLE PRECISION NOT NULL,
+	points INTEGER NOT NULL,
+	currency TEXT NOT NULL DEFAULT 'cny',
+	active BOOLEAN NOT NULL DEFAULT TRUE,
+	sort_order INTEGER NOT NULL DEFAULT 0,
+	sites TEXT NOT NULL DEFAULT ''
+);
+
+-- 客户记录表, seq用于按创建顺序排列
+CREATE TABLE IF NOT EXISTS customers (
+	seq BIGSERIAL,
+	id TEXT PRIMARY KEY,
+	mail TEXT NOT NULL UNIQUE
+);
@@ -0,0 +1,11 @@
+-- 订单状态变更记录, from_status为空表示订单创建
+CREATE TABLE IF NOT EXISTS order_events (
+	id BIGSERIAL PRIMARY KEY,
+	order_id TEXT NOT NULL,
+	from_status TEXT NOT NULL DEFAULT '',
+	to_status TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	created_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+);
+CREATE INDEX IF NOT EXISTS idx_order_events_order_id ON order_events (order_id);
@@ -0,0 +1,26 @@
+-- 优惠码, 字段含义与SQLite迁移0006相同
+CREATE TABLE IF NOT EXISTS coupons (
+	code TEXT PRIMARY KEY,
+	percent_off INTEGER NOT NULL DEFAULT 0,
+	amount_off BIGINT NOT NULL DEFAULT 0,
+	currency TEXT NOT NULL DEFAULT '',
+	bonus_points BIGINT NOT NULL DEFAULT 0,
+	expires_at TEXT,
+	max_redemptions INTEGER NOT NULL DEFAULT 0,
+	per_email_limit INTEGER NOT NULL DEFAULT 0,
+	product_ids TEXT NOT NULL DEFAULT '',
+	active BOOLEAN NOT NULL DEFAULT TRUE,
+	created_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+);
+
+CREATE TABLE IF NOT EXISTS coupon_redemptions (
+	id BIGSERIAL PRIMARY KEY,
+	code TEXT NOT NULL,
+	order_id TEXT NOT NULL UNIQUE,
+	email TEXT NOT NULL,
+	created_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+);
+CREATE INDEX IF NOT EXISTS idx_coupon_redemptions_code_email ON coupon_redemptions (code, email);
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS coupon_code TEXT NOT NULL DEFAULT '';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS discount BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,25 @@
+-- 兑换码, 字段含义与SQLite迁移0007相同
+CREATE TABLE IF NOT EXISTS vouchers (
+	code TEXT PRIMARY KEY,
+	points BIGINT NOT NULL,
+	site_type TEXT NOT NULL,
+	expires_at TEXT,
+	note TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL DEFAULT 'active',
+	redeemed_email TEXT NOT NULL DEFAULT '',
+	openwebui_user_id TEXT NOT NULL DEFAULT '',
+	redeemed_at TEXT,
+	created_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+);
+
+CREATE TABLE IF NOT EXISTS voucher_attempts (
+	id BIGSERIAL PRIMARY KEY,
+	code TEXT NOT NULL,
+	email TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	outcome TEXT NOT NULL,
+	error TEXT NOT NULL DEFAULT '',
+	created_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+);
+CREATE INDEX IF NOT EXISTS idx_voucher_attempts_ip ON voucher_attempts (ip, created_at);
+CREATE INDEX IF NOT EXISTS idx_voucher_attempts_email ON voucher_attempts (email, created_at);
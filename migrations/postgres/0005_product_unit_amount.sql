@@ -0,0 +1,7 @@
+-- 商品单价改为以最小货币单位保存的整数, 与SQLite迁移0008相同
+ALTER TABLE products ADD COLUMN IF NOT EXISTS unit_amount BIGINT NOT NULL DEFAULT 0;
+UPDATE products SET unit_amount = ROUND(price::NUMERIC * CASE
+	WHEN lower(currency) IN ('bif', 'clp', 'djf', 'gnf', 'jpy', 'kmf', 'krw', 'mga', 'pyg', 'rwf', 'ugx', 'vnd', 'vuv', 'xaf', 'xof', 'xpf') THEN 1
+	WHEN lower(currency) IN ('bhd', 'jod', 'kwd', 'omr', 'tnd') THEN 1000
+	ELSE 100 END)::BIGINT;
+ALTER TABLE products DROP COLUMN IF EXISTS price;
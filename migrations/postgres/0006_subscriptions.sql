@@ -0,0 +1,37 @@
+-- 订阅套餐、订阅和账单发放记录, 字段含义与SQLite迁移0009相同
+CREATE TABLE IF NOT EXISTS subscription_plans (
+	id SERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	stripe_price_id TEXT NOT NULL UNIQUE,
+	points BIGINT NOT NULL,
+	unit_amount BIGINT NOT NULL,
+	currency TEXT NOT NULL DEFAULT 'cny',
+	sites TEXT NOT NULL DEFAULT '',
+	active BOOLEAN NOT NULL DEFAULT TRUE,
+	sort_order INTEGER NOT NULL DEFAULT 0,
+	created_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+);
+
+CREATE TABLE IF NOT EXISTS subscriptions (
+	id TEXT PRIMARY KEY,
+	customer_id TEXT NOT NULL,
+	email TEXT NOT NULL,
+	site_type TEXT NOT NULL,
+	plan_id INTEGER NOT NULL,
+	status TEXT NOT NULL,
+	cancel_at_period_end BOOLEAN NOT NULL DEFAULT FALSE,
+	current_period_end TEXT,
+	created_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+	updated_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+);
+CREATE INDEX IF NOT EXISTS idx_subscriptions_customer ON subscriptions (customer_id);
+CREATE INDEX IF NOT EXISTS idx_subscriptions_email ON subscriptions (email);
+
+CREATE TABLE IF NOT EXISTS subscription_invoices (
+	invoice_id TEXT PRIMARY KEY,
+	subscription_id TEXT NOT NULL,
+	points BIGINT NOT NULL,
+	status TEXT NOT NULL,
+	created_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+);
+CREATE INDEX IF NOT EXISTS idx_subscription_invoices_subscription ON subscription_invoices (subscription_id);
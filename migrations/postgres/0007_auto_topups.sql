@@ -0,0 +1,26 @@
+-- 自动充值设置和扣款记录, 字段含义与SQLite迁移0010相同
+CREATE TABLE IF NOT EXISTS auto_topups (
+	id SERIAL PRIMARY KEY,
+	email TEXT NOT NULL,
+	site_type TEXT NOT NULL,
+	customer_id TEXT NOT NULL,
+	payment_method_id TEXT NOT NULL,
+	product_id INTEGER NOT NULL,
+	threshold BIGINT NOT NULL,
+	daily_limit INTEGER NOT NULL,
+	enabled BOOLEAN NOT NULL DEFAULT TRUE,
+	last_error TEXT NOT NULL DEFAULT '',
+	checked_at TEXT,
+	created_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+	updated_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+	UNIQUE (email, site_type)
+);
+
+CREATE TABLE IF NOT EXISTS auto_topup_charges (
+	payment_intent_id TEXT PRIMARY KEY,
+	topup_id INTEGER NOT NULL,
+	status TEXT NOT NULL,
+	error TEXT NOT NULL DEFAULT '',
+	created_at TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+);
+CREATE INDEX IF NOT EXISTS idx_auto_topup_charges_topup ON auto_topup_charges (topup_id, created_at);
@@ -0,0 +1,2 @@
+-- 订单的支付方, 与SQLite迁移0011相同
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS provider TEXT NOT NULL DEFAULT 'stripe';
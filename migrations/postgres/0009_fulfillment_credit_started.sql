@@ -0,0 +1,2 @@
+-- 发放任务开始写入余额的时间, 与SQLite迁移0012相同
+ALTER TABLE fulfillment_jobs ADD COLUMN IF NOT EXISTS credit_started_at TEXT;
@@ -0,0 +1,3 @@
+-- 订阅账单通过发放队列发放积分, 与SQLite迁移0014相同
+ALTER TABLE fulfillment_jobs ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT 'purchase';
+ALTER TABLE subscription_invoices ADD COLUMN IF NOT EXISTS billing_reason TEXT NOT NULL DEFAULT '';
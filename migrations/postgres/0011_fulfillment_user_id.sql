@@ -0,0 +1,2 @@
+-- 发放任务记录下单时的OpenWebUI用户ID, 与SQLite迁移0015相同
+ALTER TABLE fulfillment_jobs ADD COLUMN IF NOT EXISTS openwebui_user_id TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- 退款记录的状态, 与SQLite迁移0016相同
+ALTER TABLE refunds ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'completed';
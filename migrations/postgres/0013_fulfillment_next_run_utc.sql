@@ -0,0 +1,2 @@
+-- 发放任务的下次执行时间改为UTC时间, 与SQLite迁移0017相同
+UPDATE fulfillment_jobs SET next_run_at = to_char(next_run_at::timestamp - interval '8 hours', 'YYYY-MM-DD HH24:MI:SS');
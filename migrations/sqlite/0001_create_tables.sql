@@ -0,0 +1,73 @@
+-- 订单表及积分发放、退款、积分流水和商品表
+CREATE TABLE IF NOT EXISTS orders (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	order_id TEXT NOT NULL UNIQUE,
+	status TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	expires_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS fulfillment_jobs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	payment_intent_id TEXT NOT NULL UNIQUE,
+	email TEXT NOT NULL,
+	site_type TEXT NOT NULL,
+	points INTEGER NOT NULL,
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT NOT NULL DEFAULT '',
+	next_run_at DATETIME NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS fulfillment_attempts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	payment_intent_id TEXT NOT NULL,
+	attempt INTEGER NOT NULL,
+	outcome TEXT NOT NULL,
+	error TEXT NOT NULL DEFAULT '',
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_fulfillment_attempts_pi ON fulfillment_attempts (payment_intent_id);
+
+CREATE TABLE IF NOT EXISTS refunds (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	payment_intent_id TEXT NOT NULL,
+	amount_refunded INTEGER NOT NULL,
+	points INTEGER NOT NULL,
+	points_deducted INTEGER NOT NULL,
+	deducted_from TEXT NOT NULL,
+	source TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_refunds_pi ON refunds (payment_intent_id);
+
+CREATE TABLE IF NOT EXISTS credit_ledger (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	order_id TEXT NOT NULL,
+	openwebui_user_id TEXT NOT NULL,
+	email TEXT NOT NULL,
+	site TEXT NOT NULL,
+	delta INTEGER NOT NULL,
+	balance_before INTEGER NOT NULL,
+	balance_after INTEGER NOT NULL,
+	source TEXT NOT NULL,
+	mismatch INTEGER NOT NULL DEFAULT 0,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_credit_ledger_order ON credit_ledger (order_id);
+CREATE INDEX IF NOT EXISTS idx_credit_ledger_user ON credit_ledger (openwebui_user_id);
+CREATE INDEX IF NOT EXISTS idx_credit_ledger_email ON credit_ledger (email);
+
+-- 商品表, 修改后无需重启即可生效
+CREATE TABLE IF NOT EXISTS products (
+	id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	price REAL NOT NULL,
+	points INTEGER NOT NULL,
+	currency TEXT NOT NULL DEFAULT 'cny',
+	active INTEGER NOT NULL DEFAULT 1,
+	sort_order INTEGER NOT NULL DEFAULT 0,
+	sites TEXT NOT NULL DEFAULT ''
+);
@@ -0,0 +1,8 @@
+-- 订单记录OpenWebUI用户ID、邮箱、站点、商品、数量和幂等键
+ALTER TABLE orders ADD COLUMN openwebui_user_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE orders ADD COLUMN email TEXT NOT NULL DEFAULT '';
+ALTER TABLE orders ADD COLUMN site_type TEXT NOT NULL DEFAULT '';
+ALTER TABLE orders ADD COLUMN product_id INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN quantity INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN idempotency_key TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS idx_orders_email_status ON orders (email, status);
@@ -0,0 +1,15 @@
+-- 订单记录积分、金额(分)、币种、支付时间和发放时间
+ALTER TABLE orders ADD COLUMN points INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN amount INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN currency TEXT NOT NULL DEFAULT '';
+ALTER TABLE orders ADD COLUMN paid_at DATETIME;
+ALTER TABLE orders ADD COLUMN fulfilled_at DATETIME;
+
+-- 已有订单的信息从发放任务中补全, 时间与created_at一样使用UTC
+UPDATE orders SET
+	email = CASE WHEN orders.email = '' THEN j.email ELSE orders.email END,
+	site_type = CASE WHEN orders.site_type = '' THEN j.site_type ELSE orders.site_type END,
+	points = j.points,
+	paid_at = j.created_at,
+	fulfilled_at = CASE WHEN j.status = 'succeeded' THEN j.updated_at END
+FROM fulfillment_jobs j WHERE j.payment_intent_id = orders.order_id;
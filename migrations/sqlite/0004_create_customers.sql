@@ -0,0 +1,5 @@
+-- 客户记录表
+CREATE TABLE IF NOT EXISTS customers (
+	id TEXT PRIMARY KEY,
+	mail TEXT NOT NULL UNIQUE
+);
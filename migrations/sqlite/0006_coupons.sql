@@ -0,0 +1,31 @@
+-- 优惠码, 通过SQL维护, 与商品一样只停用不删除
+-- percent_off与amount_off(最小货币单位)二选一, bonus_points为每个订单额外赠送的积分
+-- max_redemptions和per_email_limit为0表示不限制, product_ids为空表示所有商品, currency为空表示所有币种
+-- expires_at为本地时间, 为空表示永不过期
+CREATE TABLE IF NOT EXISTS coupons (
+	code TEXT PRIMARY KEY,
+	percent_off INTEGER NOT NULL DEFAULT 0,
+	amount_off INTEGER NOT NULL DEFAULT 0,
+	currency TEXT NOT NULL DEFAULT '',
+	bonus_points INTEGER NOT NULL DEFAULT 0,
+	expires_at DATETIME,
+	max_redemptions INTEGER NOT NULL DEFAULT 0,
+	per_email_limit INTEGER NOT NULL DEFAULT 0,
+	product_ids TEXT NOT NULL DEFAULT '',
+	active INTEGER NOT NULL DEFAULT 1,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 优惠码使用记录, 订单支付成功后写入, 每个订单最多一条
+CREATE TABLE IF NOT EXISTS coupon_redemptions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	code TEXT NOT NULL,
+	order_id TEXT NOT NULL UNIQUE,
+	email TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_coupon_redemptions_code_email ON coupon_redemptions (code, email);
+
+-- 订单使用的优惠码和优惠金额(最小货币单位)
+ALTER TABLE orders ADD COLUMN coupon_code TEXT NOT NULL DEFAULT '';
+ALTER TABLE orders ADD COLUMN discount INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,28 @@
+-- 兑换码, 每个兑换码只能兑换一次, 为指定站点上的账户增加points积分
+-- status: active(可兑换), redeeming(兑换中), redeemed(已兑换), disabled(已作废)
+-- expires_at为本地时间, 为空表示永不过期
+CREATE TABLE IF NOT EXISTS vouchers (
+	code TEXT PRIMARY KEY,
+	points INTEGER NOT NULL,
+	site_type TEXT NOT NULL,
+	expires_at DATETIME,
+	note TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL DEFAULT 'active',
+	redeemed_email TEXT NOT NULL DEFAULT '',
+	openwebui_user_id TEXT NOT NULL DEFAULT '',
+	redeemed_at DATETIME,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 每一次兑换尝试, 同时用于限制失败次数
+CREATE TABLE IF NOT EXISTS voucher_attempts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	code TEXT NOT NULL,
+	email TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	outcome TEXT NOT NULL,
+	error TEXT NOT NULL DEFAULT '',
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_voucher_attempts_ip ON voucher_attempts (ip, created_at);
+CREATE INDEX IF NOT EXISTS idx_voucher_attempts_email ON voucher_attempts (email, created_at);
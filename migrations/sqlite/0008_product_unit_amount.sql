@@ -0,0 +1,8 @@
+-- 商品单价改为以最小货币单位(分)保存的整数, 替换浮点数的price
+-- 零位小数币种(如jpy)的最小单位即主单位, 三位小数币种(如kwd)为千分之一
+ALTER TABLE products ADD COLUMN unit_amount INTEGER NOT NULL DEFAULT 0;
+UPDATE products SET unit_amount = CAST(ROUND(price * CASE
+	WHEN lower(currency) IN ('bif', 'clp', 'djf', 'gnf', 'jpy', 'kmf', 'krw', 'mga', 'pyg', 'rwf', 'ugx', 'vnd', 'vuv', 'xaf', 'xof', 'xpf') THEN 1
+	WHEN lower(currency) IN ('bhd', 'jod', 'kwd', 'omr', 'tnd') THEN 1000
+	ELSE 100 END) AS INTEGER);
+ALTER TABLE products DROP COLUMN price;
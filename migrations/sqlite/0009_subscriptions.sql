@@ -0,0 +1,44 @@
+-- 订阅套餐, 通过SQL维护, 与商品一样只停用不删除
+-- stripe_price_id为Stripe中按月计费的Price, unit_amount和currency仅用于展示, 需要与该Price保持一致
+-- points为每个计费周期发放的积分, sites为空表示币种匹配的所有站点
+CREATE TABLE IF NOT EXISTS subscription_plans (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	stripe_price_id TEXT NOT NULL UNIQUE,
+	points INTEGER NOT NULL,
+	unit_amount INTEGER NOT NULL,
+	currency TEXT NOT NULL DEFAULT 'cny',
+	sites TEXT NOT NULL DEFAULT '',
+	active INTEGER NOT NULL DEFAULT 1,
+	sort_order INTEGER NOT NULL DEFAULT 0,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 客户的订阅, id为Stripe的订阅ID, 状态由Webhook同步
+-- status与Stripe一致: incomplete、active、past_due、canceled等
+-- current_period_end为当前计费周期的结束时间(UTC), cancel_at_period_end为1表示到期后取消
+CREATE TABLE IF NOT EXISTS subscriptions (
+	id TEXT PRIMARY KEY,
+	customer_id TEXT NOT NULL,
+	email TEXT NOT NULL,
+	site_type TEXT NOT NULL,
+	plan_id INTEGER NOT NULL,
+	status TEXT NOT NULL,
+	cancel_at_period_end INTEGER NOT NULL DEFAULT 0,
+	current_period_end DATETIME,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_subscriptions_customer ON subscriptions (customer_id);
+CREATE INDEX IF NOT EXISTS idx_subscriptions_email ON subscriptions (email);
+
+-- 每张已支付账单的积分发放记录, 保证同一账单只发放一次
+-- status: granting(已认领, 正在增加积分), granted(已发放)
+CREATE TABLE IF NOT EXISTS subscription_invoices (
+	invoice_id TEXT PRIMARY KEY,
+	subscription_id TEXT NOT NULL,
+	points INTEGER NOT NULL,
+	status TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_subscription_invoices_subscription ON subscription_invoices (subscription_id);
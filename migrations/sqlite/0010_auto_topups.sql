@@ -0,0 +1,31 @@
+-- 自动充值设置, 每个邮箱在每个站点上最多一条
+-- 余额低于threshold时使用payment_method_id对应的已保存卡片购买product_id, 每天最多扣款daily_limit次
+-- 扣款失败或卡片失效时enabled置为0并在last_error中记录原因, 用户重新开启后清空
+-- checked_at为最近一次检查余额的时间, 用于避免多个实例同时检查同一条设置
+CREATE TABLE IF NOT EXISTS auto_topups (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email TEXT NOT NULL,
+	site_type TEXT NOT NULL,
+	customer_id TEXT NOT NULL,
+	payment_method_id TEXT NOT NULL,
+	product_id INTEGER NOT NULL,
+	threshold INTEGER NOT NULL,
+	daily_limit INTEGER NOT NULL,
+	enabled INTEGER NOT NULL DEFAULT 1,
+	last_error TEXT NOT NULL DEFAULT '',
+	checked_at DATETIME,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (email, site_type)
+);
+
+-- 自动充值发起的每笔扣款, payment_intent_id同时是订单号
+-- status: pending(已创建订单, 等待扣款结果), succeeded(扣款成功), failed(扣款失败)
+CREATE TABLE IF NOT EXISTS auto_topup_charges (
+	payment_intent_id TEXT PRIMARY KEY,
+	topup_id INTEGER NOT NULL,
+	status TEXT NOT NULL,
+	error TEXT NOT NULL DEFAULT '',
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_auto_topup_charges_topup ON auto_topup_charges (topup_id, created_at);
@@ -0,0 +1,2 @@
+-- 订单的支付方, 已有订单都由Stripe处理
+ALTER TABLE orders ADD COLUMN provider TEXT NOT NULL DEFAULT 'stripe';
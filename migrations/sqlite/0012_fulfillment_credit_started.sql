@@ -0,0 +1,2 @@
+-- 发放任务开始写入余额的时间, 写入结果未记录时据此判断上一次尝试可能已经到账
+ALTER TABLE fulfillment_jobs ADD COLUMN credit_started_at TEXT;
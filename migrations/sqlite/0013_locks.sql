@@ -0,0 +1,7 @@
+-- 跨实例的互斥锁, 每个锁一行, 以条件更新获取, 租期结束后其他实例可以接管
+-- PostgreSQL使用咨询锁, 不需要该表
+CREATE TABLE IF NOT EXISTS locks (
+    name TEXT PRIMARY KEY,
+    owner TEXT NOT NULL,
+    expires_at TEXT NOT NULL
+);
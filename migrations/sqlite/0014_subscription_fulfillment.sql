@@ -0,0 +1,4 @@
+-- 发放任务的来源, 与积分流水的来源相同; 订阅账单的任务以账单ID作为payment_intent_id
+ALTER TABLE fulfillment_jobs ADD COLUMN source TEXT NOT NULL DEFAULT 'purchase';
+-- 账单类型, 首期账单的到账邮件附带订阅管理链接
+ALTER TABLE subscription_invoices ADD COLUMN billing_reason TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- 下单时记录的OpenWebUI用户ID, 按ID发放积分; 旧任务为空, 按邮箱查找用户
+ALTER TABLE fulfillment_jobs ADD COLUMN openwebui_user_id TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+-- 从用户余额扣回积分前先写入pending状态的退款记录, 扣回后与积分流水在同一事务中改为completed
+-- pending的记录同样计入已处理的积分, 扣回结果无法确认时不会被重复扣回
+ALTER TABLE refunds ADD COLUMN status TEXT NOT NULL DEFAULT 'completed';
@@ -0,0 +1,3 @@
+-- 发放任务的下次执行时间改为与updated_at一致的UTC时间
+-- 旧版本按程序设置的本地时区(Asia/Shanghai, UTC+8)写入, 转换已有的任务
+UPDATE fulfillment_jobs SET next_run_at = datetime(next_run_at, '-8 hours');
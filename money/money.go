@@ -0,0 +1,228 @@
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Money 一笔金额, Amount以币种的最小货币单位保存(人民币为分, 日元为元)
+// 金额之间的运算只在同一币种内进行, 所有需要取整的地方都必须显式指定Rounding
+type Money struct {
+	Amount   int64
+	Currency string // 小写的ISO货币代码, 与Stripe一致
+}
+
+// Rounding 金额取整方式
+type Rounding int
+
+const (
+	RoundHalfUp Rounding = iota // 四舍五入, 0.5远离零取整
+	RoundDown                   // 向零取整, 舍去多余的部分
+	RoundUp                     // 远离零取整, 不足一个最小单位也按一个计算
+)
+
+// Stripe的零位小数币种和三位小数币种, 其他币种均为两位小数
+// https://docs.stripe.com/currencies#zero-decimal
+var (
+	zeroDecimal  = []string{"bif", "clp", "djf", "gnf", "jpy", "kmf", "krw", "mga", "pyg", "rwf", "ugx", "vnd", "vuv", "xaf", "xof", "xpf"}
+	threeDecimal = []string{"bhd", "jod", "kwd", "omr", "tnd"}
+)
+
+// 常用币种的符号, 其他币种在金额后附加货币代码
+var symbols = map[string]string{
+	"cny": "¥",
+	"jpy": "¥",
+	"usd": "$",
+	"eur": "€",
+	"gbp": "£",
+	"hkd": "HK$",
+}
+
+var (
+	// ErrInvalidAmount 无法解析的金额, 或小数位数超过了币种允许的位数
+	ErrInvalidAmount = errors.New("金额格式无效")
+	// ErrOverflow 运算结果超出int64能表示的范围
+	ErrOverflow = errors.New("金额超出范围")
+)
+
+// Exponent 币种的小数位数
+func Exponent(currency string) int {
+	currency = strings.ToLower(currency)
+	for _, c := range zeroDecimal {
+		if c == currency {
+			return 0
+		}
+	}
+	for _, c := range threeDecimal {
+		if c == currency {
+			return 3
+		}
+	}
+	return 2
+}
+
+// New 以最小货币单位创建金额
+func New(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: strings.ToLower(currency)}
+}
+
+// Parse 解析以主货币单位表示的十进制字符串(如 "12.34"), 不经过浮点数
+// 小数位数超过币种允许的位数时返回ErrInvalidAmount, 不做隐式取整
+func Parse(s string, currency string) (Money, error) {
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	whole, frac, _ := strings.Cut(s, ".")
+	exp := Exponent(currency)
+	frac = strings.TrimRight(frac, "0")
+	if whole == "" || !isDigits(whole) || !isDigits(frac) || len(frac) > exp {
+		return Money{}, ErrInvalidAmount
+	}
+
+	amount, err := strconv.ParseInt(whole+frac+strings.Repeat("0", exp-len(frac)), 10, 64)
+	if err != nil {
+		return Money{}, ErrInvalidAmount
+	}
+	if negative {
+		amount = -amount
+	}
+	return New(amount, currency), nil
+}
+
+// isDigits 判断字符串是否只包含数字, 空字符串返回true
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Add 两笔同币种金额相加, 币种不同或结果溢出时panic, 属于程序错误
+func (m Money) Add(other Money) Money {
+	return Money{Amount: checkedAdd(m.Amount, other.Amount), Currency: m.currencyWith(other)}
+}
+
+// Sub 两笔同币种金额相减
+func (m Money) Sub(other Money) Money {
+	if other.Amount == math.MinInt64 {
+		panic(ErrOverflow)
+	}
+	return Money{Amount: checkedAdd(m.Amount, -other.Amount), Currency: m.currencyWith(other)}
+}
+
+// Mul 金额乘以整数, 如单价乘以数量, 结果溢出时返回ErrOverflow
+func (m Money) Mul(n int64) (Money, error) {
+	return m.MulDiv(n, 1, RoundDown)
+}
+
+// MulDiv 金额乘以 num/den, 结果按rounding取整到最小货币单位, 用于按比例计算优惠和手续费
+// 中间结果使用big.Int计算, 只有最终结果超出int64时才返回ErrOverflow
+func (m Money) MulDiv(num int64, den int64, rounding Rounding) (Money, error) {
+	if den == 0 {
+		panic("money: 除数为0")
+	}
+	product := new(big.Int).Mul(big.NewInt(m.Amount), big.NewInt(num))
+	divisor := big.NewInt(den)
+	quotient, remainder := new(big.Int).QuoRem(product, divisor, new(big.Int))
+	if remainder.Sign() != 0 {
+		// 余数的两倍与除数比较判断是否过半, 避免使用浮点数
+		negative := product.Sign() != divisor.Sign()
+		twice := new(big.Int).Lsh(remainder.Abs(remainder), 1)
+		switch {
+		case rounding == RoundUp, rounding == RoundHalfUp && twice.Cmp(divisor.Abs(divisor)) >= 0:
+			if negative {
+				quotient.Sub(quotient, big.NewInt(1))
+			} else {
+				quotient.Add(quotient, big.NewInt(1))
+			}
+		}
+	}
+	if !quotient.IsInt64() {
+		return Money{}, ErrOverflow
+	}
+	return Money{Amount: quotient.Int64(), Currency: m.Currency}, nil
+}
+
+// Neg 取相反数
+func (m Money) Neg() Money {
+	if m.Amount == math.MinInt64 {
+		panic(ErrOverflow)
+	}
+	return Money{Amount: -m.Amount, Currency: m.Currency}
+}
+
+// Min 两笔同币种金额中较小的一笔
+func (m Money) Min(other Money) Money {
+	currency := m.currencyWith(other)
+	return Money{Amount: min(m.Amount, other.Amount), Currency: currency}
+}
+
+// IsZero 金额是否为0
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// IsNegative 金额是否小于0
+func (m Money) IsNegative() bool {
+	return m.Amount < 0
+}
+
+// IsPositive 金额是否大于0
+func (m Money) IsPositive() bool {
+	return m.Amount > 0
+}
+
+// Major 以主货币单位格式化, 保留币种的全部小数位, 如 "12.30"
+func (m Money) Major() string {
+	exp := Exponent(m.Currency)
+	// 转为uint64取绝对值, math.MinInt64取反也不会溢出
+	sign := ""
+	amount := uint64(m.Amount)
+	if m.Amount < 0 {
+		sign, amount = "-", -amount
+	}
+	if exp == 0 {
+		return sign + strconv.FormatUint(amount, 10)
+	}
+	unit := uint64(math.Pow10(exp))
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/unit, exp, amount%unit)
+}
+
+// String 带货币符号的金额, 如 "¥12.30"、"-$5.00", 没有符号的币种显示为 "12.30 CHF"
+func (m Money) String() string {
+	symbol, ok := symbols[m.Currency]
+	if !ok {
+		return strings.TrimSpace(m.Major() + " " + strings.ToUpper(m.Currency))
+	}
+	if m.Amount < 0 {
+		return "-" + symbol + strings.TrimPrefix(m.Major(), "-")
+	}
+	return symbol + m.Major()
+}
+
+// currencyWith 两笔金额运算结果的币种, 币种为空的零值金额可以与任意币种运算
+func (m Money) currencyWith(other Money) string {
+	switch {
+	case m.Currency == other.Currency || other.Currency == "":
+		return m.Currency
+	case m.Currency == "":
+		return other.Currency
+	default:
+		panic(fmt.Sprintf("money: 币种不同 %s 与 %s", m.Currency, other.Currency))
+	}
+}
+
+// checkedAdd 两个int64相加, 溢出时panic; 可能溢出的输入应先经过Mul或MulDiv检查
+func checkedAdd(a int64, b int64) int64 {
+	sum := a + b
+	if (b > 0 && sum < a) || (b < 0 && sum > a) {
+		panic(ErrOverflow)
+	}
+	return sum
+}
@@ -0,0 +1,173 @@
+package money
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestMulDivRounding(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   int64
+		currency string
+		num, den int64
+		rounding Rounding
+		want     int64
+	}{
+		// 没有余数时三种取整方式结果相同
+		{"整除 四舍五入", 1000, "cny", 3, 2, RoundHalfUp, 1500},
+		{"整除 向零", 1000, "cny", 3, 2, RoundDown, 1500},
+		{"整除 远离零", 1000, "cny", 3, 2, RoundUp, 1500},
+
+		// 两位小数: 1.25 元 × 1/2 = 0.625 元, 即 62.5 分
+		{"两位小数 半数 四舍五入", 125, "cny", 1, 2, RoundHalfUp, 63},
+		{"两位小数 半数 向零", 125, "cny", 1, 2, RoundDown, 62},
+		{"两位小数 半数 远离零", 125, "cny", 1, 2, RoundUp, 63},
+		{"两位小数 不足半数 四舍五入", 100, "usd", 1, 3, RoundHalfUp, 33},
+		{"两位小数 不足半数 向零", 100, "usd", 1, 3, RoundDown, 33},
+		{"两位小数 不足半数 远离零", 100, "usd", 1, 3, RoundUp, 34},
+		{"两位小数 超过半数 四舍五入", 200, "usd", 1, 3, RoundHalfUp, 67},
+		{"两位小数 超过半数 向零", 200, "usd", 1, 3, RoundDown, 66},
+		{"两位小数 超过半数 远离零", 200, "usd", 1, 3, RoundUp, 67},
+
+		// 零位小数: 5 日元 × 1/2 = 2.5 日元
+		{"零位小数 半数 四舍五入", 5, "jpy", 1, 2, RoundHalfUp, 3},
+		{"零位小数 半数 向零", 5, "jpy", 1, 2, RoundDown, 2},
+		{"零位小数 半数 远离零", 5, "jpy", 1, 2, RoundUp, 3},
+		{"零位小数 手续费", 1000, "jpy", 1000000, 971000, RoundUp, 1030},
+
+		// 三位小数: 0.005 第纳尔 × 1/2 = 0.0025 第纳尔, 即 2.5 个最小单位
+		{"三位小数 半数 四舍五入", 5, "kwd", 1, 2, RoundHalfUp, 3},
+		{"三位小数 半数 向零", 5, "kwd", 1, 2, RoundDown, 2},
+		{"三位小数 半数 远离零", 5, "kwd", 1, 2, RoundUp, 3},
+		{"三位小数 不足半数 远离零", 1001, "kwd", 1, 10, RoundUp, 101},
+
+		// 负数按绝对值取整, 结果与正数对称
+		{"负数 半数 四舍五入", -125, "cny", 1, 2, RoundHalfUp, -63},
+		{"负数 半数 向零", -125, "cny", 1, 2, RoundDown, -62},
+		{"负数 半数 远离零", -125, "cny", 1, 2, RoundUp, -63},
+		{"负数 不足半数 四舍五入", -100, "cny", 1, 3, RoundHalfUp, -33},
+		{"负数 不足半数 远离零", -100, "cny", 1, 3, RoundUp, -34},
+		{"负除数 半数 四舍五入", 125, "cny", 1, -2, RoundHalfUp, -63},
+		{"负数除以负数 半数 向零", -125, "cny", 1, -2, RoundDown, 62},
+
+		// 中间结果超出int64但最终结果不超出
+		{"中间结果溢出", math.MaxInt64, "cny", 3, 4, RoundDown, 6917529027641081855},
+		{"手续费中间结果溢出", 18446744074190, "cny", 1000000, 971000, RoundUp, 18997676698445},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := New(tt.amount, tt.currency).MulDiv(tt.num, tt.den, tt.rounding)
+			if err != nil {
+				t.Fatalf("MulDiv() error = %v", err)
+			}
+			if got.Amount != tt.want || got.Currency != tt.currency {
+				t.Errorf("MulDiv() = %d %s, want %d %s", got.Amount, got.Currency, tt.want, tt.currency)
+			}
+		})
+	}
+}
+
+func TestMulOverflow(t *testing.T) {
+	tests := []struct {
+		name    string
+		amount  int64
+		n       int64
+		want    int64
+		wantErr error
+	}{
+		{"正常", 2000, 3, 6000, nil},
+		{"负数", -2000, 3, -6000, nil},
+		{"最大值", math.MaxInt64, 1, math.MaxInt64, nil},
+		{"正数溢出", 2000, math.MaxInt64 / 1000, 0, ErrOverflow},
+		{"负数溢出", -2000, math.MaxInt64 / 1000, 0, ErrOverflow},
+		{"最小值取反溢出", math.MinInt64, -1, 0, ErrOverflow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := New(tt.amount, "cny").Mul(tt.n)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Mul() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got.Amount != tt.want {
+				t.Errorf("Mul() = %d, want %d", got.Amount, tt.want)
+			}
+		})
+	}
+}
+
+func TestMulDivOverflow(t *testing.T) {
+	if _, err := New(math.MaxInt64, "cny").MulDiv(1000000, 971000, RoundUp); !errors.Is(err, ErrOverflow) {
+		t.Errorf("MulDiv() error = %v, want %v", err, ErrOverflow)
+	}
+}
+
+func TestAddOverflowPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Add() 溢出时没有panic")
+		}
+	}()
+	New(math.MaxInt64, "cny").Add(New(1, "cny"))
+}
+
+func TestParseAndFormat(t *testing.T) {
+	tests := []struct {
+		input    string
+		currency string
+		amount   int64
+		major    string
+		str      string
+	}{
+		{"12.3", "cny", 1230, "12.30", "¥12.30"},
+		{"0.05", "usd", 5, "0.05", "$0.05"},
+		{"-5", "usd", -500, "-5.00", "-$5.00"},
+		{"1000", "jpy", 1000, "1000", "¥1000"},
+		{"1.005", "kwd", 1005, "1.005", "1.005 KWD"},
+		{"-0.001", "kwd", -1, "-0.001", "-0.001 KWD"},
+		{"12.30", "chf", 1230, "12.30", "12.30 CHF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input+" "+tt.currency, func(t *testing.T) {
+			m, err := Parse(tt.input, tt.currency)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if m.Amount != tt.amount {
+				t.Errorf("Parse() = %d, want %d", m.Amount, tt.amount)
+			}
+			if got := m.Major(); got != tt.major {
+				t.Errorf("Major() = %q, want %q", got, tt.major)
+			}
+			if got := m.String(); got != tt.str {
+				t.Errorf("String() = %q, want %q", got, tt.str)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		input    string
+		currency string
+	}{
+		{"1.5", "jpy"},    // 零位小数币种不能有小数
+		{"1.234", "cny"},  // 超过两位小数
+		{"1.0005", "kwd"}, // 超过三位小数
+		{"abc", "cny"},
+		{"", "cny"},
+		{"99999999999999999999", "cny"},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(tt.input, tt.currency); !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("Parse(%q, %q) error = %v, want %v", tt.input, tt.currency, err, ErrInvalidAmount)
+		}
+	}
+}
+
+func TestMinInt64Format(t *testing.T) {
+	if got := New(math.MinInt64, "jpy").Major(); got != "-9223372036854775808" {
+		t.Errorf("Major() = %q", got)
+	}
+}
@@ -0,0 +1,173 @@
+package openwebui
+
+import (
+	"breathaipay/database"
+	"breathaipay/mail"
+	"breathaipay/sites"
+
+	"errors"
+	"fmt"
+	"log"
+)
+
+// 写入后余额仍等于写入前余额时, 最多重新写入的次数
+const maxCreditRepairs = 3
+
+// ErrCreditUnknown 写入余额的请求失败, 且无法确认写入是否已经生效, 调用者不能直接重试
+var ErrCreditUnknown = errors.New("无法确认余额是否已经写入")
+
+// BalanceChange 一次余额修改的结果
+type BalanceChange struct {
+	UserID   string
+	Before   int64 // 写入前读取到的余额
+	After    int64 // 写入后重新读取到的余额
+	Delta    int64 // 实际应用的变化量, 扣除时可能因余额不足而小于请求的数量
+	Mismatch bool  // 写入后读取到的余额与预期不一致, 已发出告警
+}
+
+// Reason 余额变动的原因, 随余额修改一起写入积分流水
+type Reason struct {
+	OrderID     string // 关联的订单号, 如PaymentIntent ID
+	Source      string // database.LedgerSource*
+	DeferLedger bool   // 为true时不写入积分流水, 由调用者将流水与自己的状态在同一事务中写入
+}
+
+// Account 要修改余额的用户, 下单时记录了用户ID的按ID修改, 邮箱变更后仍然发放给同一个用户
+// ID为空时(旧订单、兑换码等)按邮箱查找
+type Account struct {
+	ID    string
+	Email string
+}
+
+// lookup 读取用户的最新余额
+func (a Account) lookup(site sites.Site) (UserInfo, error) {
+	if a.ID != "" {
+		return GetUser(a.ID, site)
+	}
+	return FindUser(a.Email, site)
+}
+
+// LedgerEntry 根据余额修改的结果生成积分流水
+func LedgerEntry(email string, site sites.Site, change BalanceChange, reason Reason) database.LedgerEntry {
+	return database.LedgerEntry{
+		OrderID:         reason.OrderID,
+		OpenWebUIUserID: change.UserID,
+		Email:           email,
+		Site:            site.Key,
+		Delta:           change.Delta,
+		BalanceBefore:   change.Before,
+		BalanceAfter:    change.After,
+		Source:          reason.Source,
+		Mismatch:        change.Mismatch,
+	}
+}
+
+// AddBalance 为用户增加积分, amount为负数时扣除且允许余额变为负数
+func AddBalance(account Account, amount int64, site sites.Site, reason Reason) (BalanceChange, error) {
+	return adjustCredit(account, amount, site, false, reason)
+}
+
+// DeductBalance 从用户余额中扣除积分, allowNegative为false时最多扣到0为止
+func DeductBalance(account Account, amount int64, site sites.Site, allowNegative bool, reason Reason) (BalanceChange, error) {
+	return adjustCredit(account, -amount, site, !allowNegative, reason)
+}
+
+// adjustCredit 在用户锁内修改余额, 成功写入后记录积分流水
+// OpenWebUI只提供整体更新余额的接口, 没有原子增减, 每个站点的每个用户一把数据库锁, 多个实例之间同样串行执行
+// 锁以用户ID命名, 按ID和按邮箱修改同一个用户时同样串行
+func adjustCredit(account Account, delta int64, site sites.Site, clampAtZero bool, reason Reason) (BalanceChange, error) {
+	user, err := account.lookup(site)
+	if errors.Is(err, ErrUserNotFound) {
+		return BalanceChange{}, fmt.Errorf("未找到用户 %s (%s)", account.Email, account.ID)
+	}
+	if err != nil {
+		return BalanceChange{}, err
+	}
+
+	var change BalanceChange
+	err = database.WithLock("credit:"+site.Key+":"+user.ID, func() error {
+		var err error
+		change, err = writeCredit(account, delta, site, clampAtZero)
+		if err != nil || change.Delta == 0 || reason.DeferLedger {
+			return err
+		}
+
+		// 余额已经修改, 流水写入失败时只记录日志, 不能返回错误以免调用者重试导致重复发放
+		if err := database.RecordLedgerEntry(LedgerEntry(account.Email, site, change, reason)); err != nil {
+			log.Printf("[告警] 写入积分流水失败 (%s, %s, %d): %v", reason.OrderID, account.Email, change.Delta, err)
+		}
+		return nil
+	})
+	return change, err
+}
+
+// writeCredit 完成 读取-计算-写入-校验 的完整流程, 调用者需持有用户锁
+func writeCredit(account Account, delta int64, site sites.Site, clampAtZero bool) (BalanceChange, error) {
+	email := account.Email
+	// 在锁内重新读取余额, 不使用调用者手中可能已经过期的数据
+	user, err := account.lookup(site)
+	if err != nil {
+		return BalanceChange{}, fmt.Errorf("读取用户 %s 的余额失败: %w", email, err)
+	}
+
+	change := BalanceChange{UserID: user.ID, Before: user.Credit, Delta: delta}
+	if clampAtZero && user.Credit+delta < 0 {
+		change.Delta = -max(user.Credit, 0)
+		log.Printf("用户 %s 余额不足(%d), 只扣除 %d 积分", email, user.Credit, -change.Delta)
+	}
+	if change.Delta == 0 {
+		change.After = user.Credit
+		return change, nil
+	}
+	expected := user.Credit + change.Delta
+
+	for repair := 0; ; repair++ {
+		if err := updateCredit(user, user.Credit+change.Delta, site); err != nil {
+			// 请求超时时写入可能已经生效, 重新读取余额判断, 以免调用者重试导致重复发放
+			current, _ := account.lookup(site)
+			switch {
+			case current.ID != "" && current.Credit == expected:
+				log.Printf("写入用户 %s 的余额时出错, 但余额已经更新: %v", email, err)
+				change.After = current.Credit
+				return change, nil
+			case current.ID != "" && current.Credit == user.Credit:
+				return change, err
+			default:
+				return change, fmt.Errorf("%w: %v", ErrCreditUnknown, err)
+			}
+		}
+
+		// 写入后重新读取, 确认余额与预期一致
+		current, err := account.lookup(site)
+		if err != nil {
+			// 写入已经成功, 只是无法校验, 不能返回错误以免调用者重试导致重复发放
+			log.Printf("写入后读取用户 %s 的余额失败, 无法校验: %v", email, err)
+			change.After = expected
+			return change, nil
+		}
+		change.After = current.Credit
+		if current.Credit == expected {
+			return change, nil
+		}
+
+		// 余额与写入前相同, 说明本次写入被并发的更新覆盖, 可以安全地重新写入
+		if current.Credit == user.Credit && repair < maxCreditRepairs {
+			log.Printf("用户 %s 的余额写入未生效(%d), 第 %d 次重新写入", email, current.Credit, repair+1)
+			user = current
+			expected = current.Credit + change.Delta
+			continue
+		}
+
+		// 余额被其他操作修改, 无法判断本次写入是否生效, 发出告警由人工核对
+		change.Mismatch = true
+		alertCreditMismatch(email, site, change, expected)
+		return change, nil
+	}
+}
+
+// alertCreditMismatch 记录余额校验不一致的告警, 配置了ALERT_EMAIL时同时发送邮件
+func alertCreditMismatch(email string, site sites.Site, change BalanceChange, expected int64) {
+	message := fmt.Sprintf("用户 %s (站点 %s, ID %s) 余额校验不一致: 写入前 %d, 变化 %d, 预期 %d, 实际 %d",
+		email, site.Key, change.UserID, change.Before, change.Delta, expected, change.After)
+	mail.Alert("积分余额校验不一致", message)
+}
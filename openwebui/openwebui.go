@@ -1,17 +1,23 @@
 package openwebui
 
 import (
-	"breathaipay/utils"
+	"breathaipay/sites"
 
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	neturl "net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// 请求OpenWebUI的超时时间, 保证一次积分发放能在发放任务的执行超时前结束
+const requestTimeout = 30 * time.Second
+
 type UserInfo struct {
 	ID              string `json:"id"`
 	Credit          int64  `json:"credit"`
@@ -21,13 +27,14 @@ type UserInfo struct {
 	Role            string `json:"role"`
 }
 
-func AddBalance(userInfo UserInfo, amount int64, sitetype int) error {
-	// 打印账户信息
-	log.Print("账户ID: ", userInfo.ID, " 余额: ", userInfo.Credit, " 昵称: ", userInfo.Name, " 邮箱: ", userInfo.Email, "\n")
+// updateCredit 将用户余额设置为newCredit, 由调用者负责在用户锁内计算新余额
+func updateCredit(userInfo UserInfo, newCredit int64, site sites.Site) error {
+	if userInfo.ID == "" {
+		return fmt.Errorf("用户ID为空, 无法更新余额")
+	}
 
-	// 更新OpenWebUI的账户余额
-	// 在原有余额基础上增加积分
-	newCredit := userInfo.Credit + amount
+	// 打印账户信息
+	log.Print("账户ID: ", userInfo.ID, " 余额: ", userInfo.Credit, " -> ", newCredit, " 昵称: ", userInfo.Name, " 邮箱: ", userInfo.Email, "\n")
 
 	// 构造要更新的数据
 	updateData := map[string]any{
@@ -46,12 +53,7 @@ func AddBalance(userInfo UserInfo, amount int64, sitetype int) error {
 	}
 
 	// 发起POST请求并携带请求头和数据
-	var url string
-	if sitetype == 1 { // 1为国际站
-		url = "https://chat.breathai.top/api/v1/users/" + userInfo.ID + "/update"
-	} else { // 2为中国站
-		url = "https://breath.yearnstudio.cn/api/v1/users/" + userInfo.ID + "/update"
-	}
+	url := site.BaseURL + "/api/v1/users/" + userInfo.ID + "/update"
 
 	req, err := http.NewRequest("POST", url, strings.NewReader(string(jsonData)))
 
@@ -60,137 +62,173 @@ func AddBalance(userInfo UserInfo, amount int64, sitetype int) error {
 	}
 
 	req.Header.Set("Content-Type", "application/json;encoding=utf-8")
-	if sitetype == 1 { // 1为国际站
-		req.Header.Set("Authorization", "Bearer "+utils.GetEnvVariable("OPENWEBUI_INTERNATIONAL_TOKEN", ""))
-	} else { // 2为中国站
-		req.Header.Set("Authorization", "Bearer "+utils.GetEnvVariable("OPENWEBUI_CHINESE_TOKEN", ""))
-	}
+	req.Header.Set("Authorization", "Bearer "+site.Token())
 
-	client := &http.Client{}
+	client := &http.Client{Timeout: requestTimeout}
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 
 	defer resp.Body.Close()
-	_, err = io.ReadAll(resp.Body)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return err
 	}
 
-	// fmt.Println(string(body))
+	// 非2xx说明更新没有生效, 需要返回错误以便重试
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("更新余额失败，状态码: %d, 响应: %s", resp.StatusCode, string(body))
+	}
 	return nil
 }
 
-func GetUserIDWithEmail(email string, sitetype int) UserInfo {
+// ErrUserNotFound 站点上没有使用该邮箱注册的用户
+var ErrUserNotFound = errors.New("未找到使用该邮箱注册的用户")
+
+// GetUserIDWithEmail 按邮箱查找用户, 查询失败或用户不存在时返回空的UserInfo
+func GetUserIDWithEmail(email string, site sites.Site) UserInfo {
+	userInfo, err := FindUser(email, site)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		log.Printf("查询用户 %s 失败: %v", email, err)
+	}
+	return userInfo
+}
+
+// FindUser 按邮箱查找用户, 用户不存在时返回ErrUserNotFound, 以便与查询失败区分
+func FindUser(email string, site sites.Site) (UserInfo, error) {
 	// 从OpenWebUI搜索中获取用户ID
 	originalEmail := email // 保存原始邮箱用于返回
-	// email = strings.ReplaceAll(email, "@", "%40") // 编码
-	// 发起GET请求并携带请求头和param参数
-	var url string
-	if sitetype == 1 { // 1为国际站
-		url = "https://chat.breathai.top/api/v1/users/?page=1&order_by=created_at&direction=asc&query=" + email
-		// req, err := http.NewRequest("GET", "https://chat.breathai.top/api/v1/users/?page=1&query="+email, nil)
-	} else { // 2为中国站
-		url = "https://breath.yearnstudio.cn/api/v1/users/?page=1&order_by=created_at&direction=asc&query=" + email
-		// req, err := http.NewRequest("GET", "https://openwebui.com/api/v1/users/search?email="+email, nil)
-	}
+	// 发起GET请求并携带请求头和param参数, 邮箱需要编码以免+等字符被错误解析
+	url := site.BaseURL + "/api/v1/users/?page=1&order_by=created_at&direction=asc&query=" + neturl.QueryEscape(email)
 	req, err := http.NewRequest("GET", url, nil)
-
 	if err != nil {
-		log.Printf("创建请求失败: %v", err)
-		return UserInfo{} // 出错时返回空的UserInfo对象
+		return UserInfo{}, fmt.Errorf("创建请求失败: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json;encoding=utf-8")
-	if sitetype == 1 { // 1为国际站
-		req.Header.Set("Authorization", "Bearer "+utils.GetEnvVariable("OPENWEBUI_INTERNATIONAL_TOKEN", ""))
-	} else { // 2为中国站
-		req.Header.Set("Authorization", "Bearer "+utils.GetEnvVariable("OPENWEBUI_CHINESE_TOKEN", ""))
-	}
-	client := &http.Client{}
+	req.Header.Set("Authorization", "Bearer "+site.Token())
+	client := &http.Client{Timeout: requestTimeout}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("执行请求失败: %v", err)
-		return UserInfo{} // 出错时返回空的UserInfo对象
+		return UserInfo{}, fmt.Errorf("执行请求失败: %w", err)
 	}
 	defer resp.Body.Close()
 
-	// 检查HTTP状态码
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		log.Printf("HTTP请求失败，状态码: %d, 响应: %s", resp.StatusCode, resp.Status)
-		body, _ := io.ReadAll(resp.Body)
-		log.Printf("错误响应体: %s", string(body))
-		return UserInfo{} // 返回空的UserInfo对象
-	}
-
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("读取响应体失败: %v", err)
-		return UserInfo{} // 出错时返回空的UserInfo对象
+		return UserInfo{}, fmt.Errorf("读取响应体失败: %w", err)
 	}
 
-	// 检查响应体是否以{或[开头，以确认是否为JSON
-	responseStr := string(body)
-	// fmt.Println("API响应:", responseStr)
+	// 检查HTTP状态码
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return UserInfo{}, fmt.Errorf("HTTP请求失败，状态码: %d, 响应: %s", resp.StatusCode, string(body))
+	}
 
 	// 检查响应是否为有效的JSON格式
-	if len(responseStr) == 0 {
-		log.Println("响应体为空")
-		return UserInfo{}
+	if len(body) == 0 {
+		return UserInfo{}, errors.New("响应体为空")
 	}
 
 	var result map[string]any
-	err = json.Unmarshal([]byte(body), &result)
+	err = json.Unmarshal(body, &result)
 	if err != nil {
-		log.Printf("解析JSON失败: %v, 响应内容: %s", err, responseStr)
-		return UserInfo{} // 出错时返回空的UserInfo对象
+		return UserInfo{}, fmt.Errorf("解析JSON失败: %w, 响应内容: %s", err, string(body))
 	}
 	// 判断users列表是否存在并遍历, 在每一项的email做完全匹配
-	if result["users"] != nil {
-		for _, v := range result["users"].([]any) {
-			userData := v.(map[string]any)
-			if userData["email"] == email {
-				// fmt.Println("存在")
-				// 解析credit为int64
-				var credit int64
-				if creditVal, ok := userData["credit"]; ok {
-					switch val := creditVal.(type) {
-					case float64:
-						credit = int64(val)
-					case string:
-						// 尝试解析字符串格式的数值
-						if fVal, parseErr := strconv.ParseFloat(val, 64); parseErr == nil {
-							credit = int64(fVal)
-						} else if iVal, parseErr := strconv.ParseInt(val, 10, 64); parseErr == nil {
-							credit = iVal
-						} else {
-							log.Printf("无法解析credit值: %s", val)
-							credit = 0
-						}
-					case int64:
-						credit = val
-					case int:
-						credit = int64(val)
-					default:
-						log.Printf("未知的credit类型: %T, 值: %v", creditVal, creditVal)
-						credit = 0
-					}
-				}
-
-				// 创建并返回UserInfo对象
-				userInfo := UserInfo{
-					ID:              getStringValue(userData, "id"),
-					Credit:          credit,
-					Email:           originalEmail,
-					Name:            getStringValue(userData, "name"),
-					ProfileImageURL: getStringValue(userData, "profile_image_url"),
-					Role:            getStringValue(userData, "role"),
-				}
-				return userInfo
+	users, _ := result["users"].([]any)
+	for _, v := range users {
+		userData, ok := v.(map[string]any)
+		if !ok || userData["email"] != email {
+			continue
+		}
+		userInfo := parseUser(userData)
+		userInfo.Email = originalEmail
+		if userInfo.ID == "" {
+			return UserInfo{}, errors.New("用户数据缺少ID")
+		}
+		return userInfo, nil
+	}
+	return UserInfo{}, ErrUserNotFound
+}
+
+// GetUser 按用户ID查找用户, 用户不存在时返回ErrUserNotFound
+// 响应缺少余额或邮箱时返回错误, 以免按不完整的数据写入余额
+func GetUser(id string, site sites.Site) (UserInfo, error) {
+	url := site.BaseURL + "/api/v1/users/" + neturl.PathEscape(id)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return UserInfo{}, fmt.Errorf("创建请求失败: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json;encoding=utf-8")
+	req.Header.Set("Authorization", "Bearer "+site.Token())
+	client := &http.Client{Timeout: requestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return UserInfo{}, fmt.Errorf("执行请求失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return UserInfo{}, fmt.Errorf("读取响应体失败: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return UserInfo{}, ErrUserNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return UserInfo{}, fmt.Errorf("HTTP请求失败，状态码: %d, 响应: %s", resp.StatusCode, string(body))
+	}
+
+	var userData map[string]any
+	if err := json.Unmarshal(body, &userData); err != nil {
+		return UserInfo{}, fmt.Errorf("解析JSON失败: %w, 响应内容: %s", err, string(body))
+	}
+	if _, ok := userData["credit"]; !ok || getStringValue(userData, "email") == "" {
+		return UserInfo{}, fmt.Errorf("用户 %s 的数据缺少余额或邮箱", id)
+	}
+	userInfo := parseUser(userData)
+	if userInfo.ID != id {
+		return UserInfo{}, fmt.Errorf("返回的用户ID %q 与请求的 %q 不一致", userInfo.ID, id)
+	}
+	return userInfo, nil
+}
+
+// parseUser 解析OpenWebUI返回的一个用户
+func parseUser(userData map[string]any) UserInfo {
+	// 解析credit为int64
+	var credit int64
+	if creditVal, ok := userData["credit"]; ok {
+		switch val := creditVal.(type) {
+		case float64:
+			credit = int64(val)
+		case string:
+			// 尝试解析字符串格式的数值
+			if fVal, parseErr := strconv.ParseFloat(val, 64); parseErr == nil {
+				credit = int64(fVal)
+			} else if iVal, parseErr := strconv.ParseInt(val, 10, 64); parseErr == nil {
+				credit = iVal
+			} else {
+				log.Printf("无法解析credit值: %s", val)
+				credit = 0
 			}
+		case int64:
+			credit = val
+		case int:
+			credit = int64(val)
+		default:
+			log.Printf("未知的credit类型: %T, 值: %v", creditVal, creditVal)
+			credit = 0
 		}
 	}
-	return UserInfo{} // 返回空的UserInfo对象
+
+	return UserInfo{
+		ID:              getStringValue(userData, "id"),
+		Credit:          credit,
+		Email:           getStringValue(userData, "email"),
+		Name:            getStringValue(userData, "name"),
+		ProfileImageURL: getStringValue(userData, "profile_image_url"),
+		Role:            getStringValue(userData, "role"),
+	}
 }
 
 // getStringValue 从map中安全地获取字符串值
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"breathaipay/utils"
+
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sameOrigin 拒绝来自其他站点的表单提交, 防止跨站请求伪造
+// 浏览器跨站提交时会带上Sec-Fetch-Site或Origin, 较旧的浏览器只带Referer; 三者都没有时同样拒绝
+func sameOrigin(c *gin.Context) {
+	if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead || c.Request.Method == http.MethodOptions {
+		return
+	}
+
+	switch c.GetHeader("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return
+	case "":
+	default:
+		rejectCrossOrigin(c, "Sec-Fetch-Site: "+c.GetHeader("Sec-Fetch-Site"))
+		return
+	}
+
+	source := c.GetHeader("Origin")
+	if source == "" {
+		source = c.GetHeader("Referer")
+	}
+	if source == "" || !allowedOrigin(c, source) {
+		rejectCrossOrigin(c, source)
+	}
+}
+
+// allowedOrigin 来源与PUBLIC_BASE_URL一致, 未配置时与当前请求的地址一致
+func allowedOrigin(c *gin.Context, source string) bool {
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if base, err := url.Parse(utils.PublicURL("")); err == nil && base.Host != "" {
+		return strings.EqualFold(u.Scheme, base.Scheme) && strings.EqualFold(u.Host, base.Host)
+	}
+	return strings.EqualFold(u.Host, c.Request.Host)
+}
+
+func rejectCrossOrigin(c *gin.Context, source string) {
+	log.Printf("拒绝跨站请求 %s %s, 来源: %q", c.Request.Method, c.Request.URL.Path, source)
+	c.AbortWithStatus(http.StatusForbidden)
+}
@@ -0,0 +1,422 @@
+package payments
+
+import (
+	"breathaipay/money"
+
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 支付宝开放平台的正式环境网关, 沙箱环境为https://openapi-sandbox.dl.alipaydev.com/gateway.do
+const defaultAlipayGateway = "https://openapi.alipay.com/gateway.do"
+
+// 支付宝接口要求的时间格式, 使用北京时间
+const alipayTimeLayout = "2006-01-02 15:04:05"
+
+var alipayZone = time.FixedZone("CST", 8*3600)
+
+// 交易不存在, 用户打开支付页面前查询或关闭交易时返回
+const alipayTradeNotExist = "ACQ.TRADE_NOT_EXIST"
+
+// alipayConfig 支付宝应用的配置
+type alipayConfig struct {
+	AppID      string
+	PrivateKey string // 应用私钥, PEM或开放平台工具生成的Base64字符串
+	PublicKey  string // 支付宝公钥(不是应用公钥), 用于校验响应和异步通知
+	Gateway    string
+	NotifyURL  string // 异步通知地址, 必须是外网可以访问的完整地址
+}
+
+// alipayProvider 直连支付宝, 使用电脑网站支付下单, 签名方式为RSA2
+type alipayProvider struct {
+	appID      string
+	privateKey *rsa.PrivateKey
+	publicKey  *rsa.PublicKey
+	gateway    string
+	notifyURL  string
+	client     *http.Client
+}
+
+// alipayError 支付宝接口返回的业务错误
+type alipayError struct {
+	Code    string `json:"code"`
+	Msg     string `json:"msg"`
+	SubCode string `json:"sub_code"`
+	SubMsg  string `json:"sub_msg"`
+}
+
+func (e *alipayError) Error() string {
+	return fmt.Sprintf("支付宝返回错误 %s %s: %s %s", e.Code, e.Msg, e.SubCode, e.SubMsg)
+}
+
+// isAlipayError 判断是否为指定sub_code的业务错误
+func isAlipayError(err error, subCode string) bool {
+	var e *alipayError
+	return errors.As(err, &e) && e.SubCode == subCode
+}
+
+func newAlipayProvider(cfg alipayConfig) (*alipayProvider, error) {
+	if !strings.HasPrefix(cfg.NotifyURL, "http") {
+		return nil, errors.New("支付宝异步通知需要完整的地址, 请配置PUBLIC_BASE_URL")
+	}
+	privateKey, err := parseRSAPrivateKey(cfg.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("解析ALIPAY_PRIVATE_KEY失败: %w", err)
+	}
+	publicKey, err := parseRSAPublicKey(cfg.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("解析ALIPAY_PUBLIC_KEY失败: %w", err)
+	}
+	return &alipayProvider{
+		appID:      cfg.AppID,
+		privateKey: privateKey,
+		publicKey:  publicKey,
+		gateway:    cfg.Gateway,
+		notifyURL:  cfg.NotifyURL,
+		client:     &http.Client{Timeout: 15 * time.Second},
+	}, nil
+}
+
+func (a *alipayProvider) Name() string {
+	return ProviderAlipay
+}
+
+// Create 生成电脑网站支付(alipay.trade.page.pay)的跳转地址, 交易在用户打开支付宝页面后才会创建
+// 订单号由本程序生成, 支付宝以out_trade_no识别同一笔交易
+func (a *alipayProvider) Create(params CreateParams) (Payment, error) {
+	if params.Amount.Currency != "cny" {
+		return Payment{}, fmt.Errorf("%w: %s", ErrUnsupportedCurrency, params.Amount.Currency)
+	}
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return Payment{}, err
+	}
+	id := "alipay_" + hex.EncodeToString(b)
+
+	biz := map[string]string{
+		"out_trade_no": id,
+		"total_amount": params.Amount.Major(),
+		"subject":      params.Description,
+		"product_code": "FAST_INSTANT_TRADE_PAY",
+	}
+	if !params.ExpiresAt.IsZero() {
+		// 到期后支付宝关闭交易, 与本地订单同时过期
+		biz["time_expire"] = params.ExpiresAt.In(alipayZone).Format(alipayTimeLayout)
+	}
+	values, err := a.request("alipay.trade.page.pay", biz)
+	if err != nil {
+		return Payment{}, err
+	}
+	if params.ReturnURL != "" {
+		values.Set("return_url", params.ReturnURL)
+	}
+	if err := a.sign(values); err != nil {
+		return Payment{}, err
+	}
+
+	return Payment{
+		ID:            id,
+		Provider:      ProviderAlipay,
+		Status:        StatusPending,
+		RawStatus:     "WAIT_BUYER_PAY",
+		Amount:        params.Amount,
+		PaymentMethod: params.PaymentMethod,
+		RedirectURL:   a.gateway + "?" + values.Encode(),
+	}, nil
+}
+
+// Get 通过alipay.trade.query查询交易状态, 用户还没有打开支付页面时交易不存在, 视为等待支付
+func (a *alipayProvider) Get(id string) (Payment, error) {
+	var resp struct {
+		OutTradeNo  string `json:"out_trade_no"`
+		TradeStatus string `json:"trade_status"`
+		TotalAmount string `json:"total_amount"`
+	}
+	err := a.call("alipay.trade.query", map[string]string{"out_trade_no": id}, &resp)
+	if isAlipayError(err, alipayTradeNotExist) {
+		return Payment{ID: id, Provider: ProviderAlipay, Status: StatusPending, RawStatus: "TRADE_NOT_EXIST"}, nil
+	}
+	if err != nil {
+		return Payment{}, err
+	}
+	amount, err := money.Parse(resp.TotalAmount, "cny")
+	if err != nil {
+		return Payment{}, fmt.Errorf("支付宝返回的金额无效: %s", resp.TotalAmount)
+	}
+	return Payment{
+		ID:        id,
+		Provider:  ProviderAlipay,
+		Status:    alipayStatus(resp.TradeStatus),
+		RawStatus: resp.TradeStatus,
+		Amount:    amount,
+	}, nil
+}
+
+// Cancel 通过alipay.trade.close关闭等待付款的交易, 交易尚未创建时无需关闭
+func (a *alipayProvider) Cancel(id string) error {
+	var resp struct{}
+	err := a.call("alipay.trade.close", map[string]string{"out_trade_no": id}, &resp)
+	if isAlipayError(err, alipayTradeNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Refund 通过alipay.trade.refund退款, amount为0时退还交易的全部金额
+// 每次退款使用新的退款请求号, 支付宝返回的refund_fee为累计退款金额
+func (a *alipayProvider) Refund(id string, amount money.Money) (RefundResult, error) {
+	payment, err := a.Get(id)
+	if err != nil {
+		return RefundResult{}, err
+	}
+	if payment.Status != StatusSucceeded {
+		return RefundResult{}, fmt.Errorf("交易状态为 %s, 不能退款", payment.RawStatus)
+	}
+	if !amount.IsPositive() {
+		amount = payment.Amount
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return RefundResult{}, err
+	}
+	requestNo := "refund_" + hex.EncodeToString(b)
+
+	var resp struct {
+		RefundFee string `json:"refund_fee"`
+	}
+	err = a.call("alipay.trade.refund", map[string]string{
+		"out_trade_no":   id,
+		"refund_amount":  amount.Major(),
+		"out_request_no": requestNo,
+	}, &resp)
+	if err != nil {
+		return RefundResult{}, err
+	}
+	refunded, err := money.Parse(resp.RefundFee, "cny")
+	if err != nil {
+		return RefundResult{}, fmt.Errorf("退款已发起, 但支付宝返回的累计退款金额无效: %s", resp.RefundFee)
+	}
+	return RefundResult{
+		ID:             requestNo,
+		Amount:         amount,
+		AmountPaid:     payment.Amount.Amount,
+		AmountRefunded: refunded.Amount,
+	}, nil
+}
+
+// VerifyNotification 校验支付宝异步通知的签名和app_id, 通知为表单格式
+// 签名内容为除sign和sign_type外所有非空参数按名称排序后以&连接的字符串
+func (a *alipayProvider) VerifyNotification(header http.Header, body []byte) (Notification, error) {
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return Notification{}, fmt.Errorf("解析支付宝通知失败: %w", err)
+	}
+	if err := a.verify([]byte(signContent(values, "sign", "sign_type")), values.Get("sign")); err != nil {
+		return Notification{}, fmt.Errorf("支付宝通知签名校验失败: %w", err)
+	}
+	if values.Get("app_id") != a.appID {
+		return Notification{}, fmt.Errorf("支付宝通知的app_id不匹配: %s", values.Get("app_id"))
+	}
+
+	amount, err := money.Parse(values.Get("total_amount"), "cny")
+	if err != nil {
+		return Notification{}, fmt.Errorf("支付宝通知的金额无效: %s", values.Get("total_amount"))
+	}
+	status := values.Get("trade_status")
+	return Notification{
+		ID:   values.Get("notify_id"),
+		Type: status,
+		Payment: Payment{
+			ID:        values.Get("out_trade_no"),
+			Provider:  ProviderAlipay,
+			Status:    alipayStatus(status),
+			RawStatus: status,
+			Amount:    amount,
+		},
+		Payload: body,
+	}, nil
+}
+
+// alipayStatus 将支付宝的交易状态转换为统一的支付状态
+// TRADE_FINISHED为超过退款期限的已支付交易; 全额退款后交易同样变为TRADE_CLOSED
+func alipayStatus(status string) Status {
+	switch status {
+	case "TRADE_SUCCESS", "TRADE_FINISHED":
+		return StatusSucceeded
+	case "TRADE_CLOSED":
+		return StatusCanceled
+	default:
+		return StatusPending
+	}
+}
+
+// request 生成公共请求参数, 调用方补充其他参数后签名
+func (a *alipayProvider) request(method string, biz map[string]string) (url.Values, error) {
+	content, err := json.Marshal(biz)
+	if err != nil {
+		return nil, err
+	}
+	values := url.Values{}
+	values.Set("app_id", a.appID)
+	values.Set("method", method)
+	values.Set("format", "JSON")
+	values.Set("charset", "utf-8")
+	values.Set("sign_type", "RSA2")
+	values.Set("timestamp", time.Now().In(alipayZone).Format(alipayTimeLayout))
+	values.Set("version", "1.0")
+	values.Set("notify_url", a.notifyURL)
+	values.Set("biz_content", string(content))
+	return values, nil
+}
+
+// call 调用支付宝接口, 校验响应签名后将响应内容解析到result
+// 响应的签名内容为xxx_response对应的原始JSON
+func (a *alipayProvider) call(method string, biz map[string]string, result any) error {
+	values, err := a.request(method, biz)
+	if err != nil {
+		return err
+	}
+	if err := a.sign(values); err != nil {
+		return err
+	}
+	resp, err := a.client.PostForm(a.gateway, values)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return fmt.Errorf("解析支付宝响应失败 (HTTP %d): %w", resp.StatusCode, err)
+	}
+	raw, ok := envelope[strings.ReplaceAll(method, ".", "_")+"_response"]
+	if !ok {
+		return fmt.Errorf("支付宝响应缺少%s的结果", method)
+	}
+	var common alipayError
+	if err := json.Unmarshal(raw, &common); err != nil {
+		return fmt.Errorf("解析支付宝响应失败: %w", err)
+	}
+
+	// 部分错误响应没有签名, 只作为错误返回, 不会当作成功的结果使用
+	var sign string
+	if s, ok := envelope["sign"]; ok {
+		json.Unmarshal(s, &sign)
+	}
+	if sign == "" {
+		if common.Code != "10000" {
+			return &common
+		}
+		return errors.New("支付宝响应缺少签名")
+	}
+	if err := a.verify(raw, sign); err != nil {
+		return fmt.Errorf("支付宝响应签名校验失败: %w", err)
+	}
+	if common.Code != "10000" {
+		return &common
+	}
+	return json.Unmarshal(raw, result)
+}
+
+// sign 使用应用私钥对请求参数签名, 签名内容不包含sign本身
+func (a *alipayProvider) sign(values url.Values) error {
+	values.Del("sign")
+	digest := sha256.Sum256([]byte(signContent(values, "sign")))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return err
+	}
+	values.Set("sign", base64.StdEncoding.EncodeToString(signature))
+	return nil
+}
+
+// verify 使用支付宝公钥校验签名
+func (a *alipayProvider) verify(content []byte, sign string) error {
+	signature, err := base64.StdEncoding.DecodeString(sign)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(content)
+	return rsa.VerifyPKCS1v15(a.publicKey, crypto.SHA256, digest[:], signature)
+}
+
+// signContent 将参数按名称排序后拼接为key=value&key=value, 跳过空值和exclude中的参数
+func signContent(values url.Values, exclude ...string) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		if values.Get(key) == "" || slices.Contains(exclude, key) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + values.Get(key)
+	}
+	return strings.Join(pairs, "&")
+}
+
+// parseRSAPrivateKey 解析PKCS#8或PKCS#1格式的RSA私钥
+func parseRSAPrivateKey(s string) (*rsa.PrivateKey, error) {
+	der, err := keyDER(s)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("不是RSA私钥")
+		}
+		return rsaKey, nil
+	}
+	return x509.ParsePKCS1PrivateKey(der)
+}
+
+// parseRSAPublicKey 解析支付宝公钥
+func parseRSAPublicKey(s string) (*rsa.PublicKey, error) {
+	der, err := keyDER(s)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("不是RSA公钥")
+	}
+	return rsaKey, nil
+}
+
+// keyDER 读取PEM格式或不带头尾的Base64格式密钥
+func keyDER(s string) ([]byte, error) {
+	if s == "" {
+		return nil, errors.New("未配置密钥")
+	}
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		return block.Bytes, nil
+	}
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
@@ -0,0 +1,374 @@
+package payments
+
+import (
+	"breathaipay/money"
+
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testAppID = "2021000000000001"
+
+// fakeAlipay 模拟支付宝网关: 校验请求签名, 按method返回预设的业务响应并用支付宝私钥签名
+type fakeAlipay struct {
+	t         *testing.T
+	appKey    *rsa.PrivateKey // 应用密钥, 公钥用于校验请求
+	alipayKey *rsa.PrivateKey // 支付宝密钥, 私钥用于签名响应
+	server    *httptest.Server
+
+	mu        sync.Mutex
+	responses map[string]string // method -> xxx_response的原始JSON
+	unsigned  bool              // 为true时响应不带签名
+	badSign   bool              // 为true时响应签名无效
+	requests  []url.Values
+}
+
+func newFakeAlipay(t *testing.T) *fakeAlipay {
+	t.Helper()
+	f := &fakeAlipay{t: t, appKey: newTestKey(t), alipayKey: newTestKey(t), responses: map[string]string{}}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func newTestKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// provider 使用PEM格式的应用私钥和单行Base64格式的支付宝公钥创建支付方, 两种格式都需要支持
+func (f *fakeAlipay) provider() *alipayProvider {
+	f.t.Helper()
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(f.appKey)})
+	publicKey, err := x509.MarshalPKIXPublicKey(&f.alipayKey.PublicKey)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	a, err := newAlipayProvider(alipayConfig{
+		AppID:      testAppID,
+		PrivateKey: string(privateKey),
+		PublicKey:  base64.StdEncoding.EncodeToString(publicKey),
+		Gateway:    f.server.URL,
+		NotifyURL:  "https://pay.example.com/notify/alipay",
+	})
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return a
+}
+
+func (f *fakeAlipay) respond(method, raw string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses[method] = raw
+}
+
+func (f *fakeAlipay) handle(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := verifyWith(&f.appKey.PublicKey, signContent(r.PostForm, "sign"), r.PostForm.Get("sign")); err != nil {
+		f.t.Errorf("请求签名校验失败: %v", err)
+		http.Error(w, "bad sign", http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.PostForm)
+
+	method := r.PostForm.Get("method")
+	raw, ok := f.responses[method]
+	if !ok {
+		f.t.Errorf("未预设的接口: %s", method)
+		http.Error(w, "unexpected method", http.StatusBadRequest)
+		return
+	}
+	body := `{"` + strings.ReplaceAll(method, ".", "_") + `_response":` + raw
+	if !f.unsigned {
+		sign := signWith(f.t, f.alipayKey, raw)
+		if f.badSign {
+			sign = signWith(f.t, f.alipayKey, raw+" ")
+		}
+		body += `,"sign":"` + sign + `"`
+	}
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.Write([]byte(body + "}"))
+}
+
+// lastBiz 最后一次请求的biz_content
+func (f *fakeAlipay) lastBiz() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var biz map[string]string
+	if err := json.Unmarshal([]byte(f.requests[len(f.requests)-1].Get("biz_content")), &biz); err != nil {
+		f.t.Fatal(err)
+	}
+	return biz
+}
+
+func signWith(t *testing.T, key *rsa.PrivateKey, content string) string {
+	t.Helper()
+	digest := sha256.Sum256([]byte(content))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+func verifyWith(key *rsa.PublicKey, content, sign string) error {
+	signature, err := base64.StdEncoding.DecodeString(sign)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(content))
+	return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+}
+
+func TestSignContent(t *testing.T) {
+	values := url.Values{}
+	values.Set("method", "alipay.trade.query")
+	values.Set("app_id", testAppID)
+	values.Set("sign", "xxx")
+	values.Set("sign_type", "RSA2")
+	values.Set("empty", "")
+	values.Set("biz_content", `{"a":"b&c"}`)
+
+	want := `app_id=` + testAppID + `&biz_content={"a":"b&c"}&method=alipay.trade.query`
+	if got := signContent(values, "sign", "sign_type"); got != want {
+		t.Errorf("signContent() = %q, want %q", got, want)
+	}
+}
+
+func TestSign(t *testing.T) {
+	f := newFakeAlipay(t)
+	a := f.provider()
+	values, err := a.request("alipay.trade.query", map[string]string{"out_trade_no": "alipay_1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values.Set("sign", "stale")
+	if err := a.sign(values); err != nil {
+		t.Fatal(err)
+	}
+	// 签名内容不包含sign本身, 但包含sign_type
+	if err := verifyWith(&f.appKey.PublicKey, signContent(values, "sign"), values.Get("sign")); err != nil {
+		t.Errorf("签名无法用应用公钥校验: %v", err)
+	}
+	values.Set("app_id", "other")
+	if err := verifyWith(&f.appKey.PublicKey, signContent(values, "sign"), values.Get("sign")); err == nil {
+		t.Error("修改参数后签名仍然有效")
+	}
+}
+
+func TestCreate(t *testing.T) {
+	f := newFakeAlipay(t)
+	a := f.provider()
+	expiresAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	p, err := a.Create(CreateParams{
+		Amount:      money.New(12345, "cny"),
+		Description: "购买灵息积分",
+		ExpiresAt:   expiresAt,
+		ReturnURL:   "https://pay.example.com/success",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(p.ID, "alipay_") || p.Status != StatusPending || p.Provider != ProviderAlipay {
+		t.Errorf("Create() = %+v", p)
+	}
+
+	redirect, err := url.Parse(p.RedirectURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(p.RedirectURL, f.server.URL+"?") {
+		t.Errorf("跳转地址不是网关地址: %s", p.RedirectURL)
+	}
+	query := redirect.Query()
+	if err := verifyWith(&f.appKey.PublicKey, signContent(query, "sign"), query.Get("sign")); err != nil {
+		t.Errorf("跳转地址的签名无效: %v", err)
+	}
+	if query.Get("method") != "alipay.trade.page.pay" || query.Get("return_url") != "https://pay.example.com/success" {
+		t.Errorf("跳转参数错误: %v", query)
+	}
+	var biz map[string]string
+	if err := json.Unmarshal([]byte(query.Get("biz_content")), &biz); err != nil {
+		t.Fatal(err)
+	}
+	if biz["out_trade_no"] != p.ID || biz["total_amount"] != "123.45" || biz["time_expire"] != "2026-01-02 11:04:05" {
+		t.Errorf("biz_content = %v", biz)
+	}
+
+	if _, err := a.Create(CreateParams{Amount: money.New(100, "usd")}); err == nil {
+		t.Error("Create() 接受了非人民币订单")
+	}
+}
+
+func TestGetStatus(t *testing.T) {
+	tests := []struct {
+		tradeStatus string
+		want        Status
+	}{
+		{"WAIT_BUYER_PAY", StatusPending},
+		{"TRADE_SUCCESS", StatusSucceeded},
+		{"TRADE_FINISHED", StatusSucceeded},
+		{"TRADE_CLOSED", StatusCanceled},
+	}
+	f := newFakeAlipay(t)
+	a := f.provider()
+	for _, tt := range tests {
+		t.Run(tt.tradeStatus, func(t *testing.T) {
+			f.respond("alipay.trade.query", `{"code":"10000","msg":"Success","out_trade_no":"alipay_1","trade_status":"`+tt.tradeStatus+`","total_amount":"88.80"}`)
+			p, err := a.Get("alipay_1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Status != tt.want || p.RawStatus != tt.tradeStatus || p.Amount != money.New(8880, "cny") {
+				t.Errorf("Get() = %+v", p)
+			}
+			if biz := f.lastBiz(); biz["out_trade_no"] != "alipay_1" {
+				t.Errorf("biz_content = %v", biz)
+			}
+		})
+	}
+
+	// 用户尚未打开支付页面时交易不存在, 视为等待支付; 错误响应没有签名
+	t.Run("TRADE_NOT_EXIST", func(t *testing.T) {
+		f.unsigned = true
+		defer func() { f.unsigned = false }()
+		f.respond("alipay.trade.query", `{"code":"40004","msg":"Business Failed","sub_code":"ACQ.TRADE_NOT_EXIST","sub_msg":"交易不存在"}`)
+		p, err := a.Get("alipay_1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Status != StatusPending || p.RawStatus != "TRADE_NOT_EXIST" {
+			t.Errorf("Get() = %+v", p)
+		}
+	})
+}
+
+func TestCallRejectsBadResponse(t *testing.T) {
+	f := newFakeAlipay(t)
+	a := f.provider()
+	f.respond("alipay.trade.query", `{"code":"10000","msg":"Success","out_trade_no":"alipay_1","trade_status":"TRADE_SUCCESS","total_amount":"88.80"}`)
+
+	f.unsigned = true
+	if _, err := a.Get("alipay_1"); err == nil {
+		t.Error("接受了没有签名的成功响应")
+	}
+	f.unsigned = false
+	f.badSign = true
+	if _, err := a.Get("alipay_1"); err == nil {
+		t.Error("接受了签名无效的响应")
+	}
+}
+
+func TestRefund(t *testing.T) {
+	f := newFakeAlipay(t)
+	a := f.provider()
+	f.respond("alipay.trade.query", `{"code":"10000","msg":"Success","out_trade_no":"alipay_1","trade_status":"TRADE_SUCCESS","total_amount":"100.00"}`)
+	f.respond("alipay.trade.refund", `{"code":"10000","msg":"Success","out_trade_no":"alipay_1","refund_fee":"60.00"}`)
+
+	result, err := a.Refund("alipay_1", money.New(2000, "cny"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Amount != money.New(2000, "cny") || result.AmountPaid != 10000 || result.AmountRefunded != 6000 || !strings.HasPrefix(result.ID, "refund_") {
+		t.Errorf("Refund() = %+v", result)
+	}
+	biz := f.lastBiz()
+	if biz["refund_amount"] != "20.00" || biz["out_request_no"] != result.ID {
+		t.Errorf("biz_content = %v", biz)
+	}
+
+	// 金额为0时退还全部金额
+	if _, err := a.Refund("alipay_1", money.New(0, "cny")); err != nil {
+		t.Fatal(err)
+	}
+	if biz := f.lastBiz(); biz["refund_amount"] != "100.00" {
+		t.Errorf("全额退款的biz_content = %v", biz)
+	}
+
+	// 未支付的交易不能退款
+	f.respond("alipay.trade.query", `{"code":"10000","msg":"Success","out_trade_no":"alipay_1","trade_status":"WAIT_BUYER_PAY","total_amount":"100.00"}`)
+	if _, err := a.Refund("alipay_1", money.New(0, "cny")); err == nil {
+		t.Error("未支付的交易退款成功")
+	}
+}
+
+func TestVerifyNotification(t *testing.T) {
+	f := newFakeAlipay(t)
+	a := f.provider()
+
+	notification := func(appID, tradeStatus string) url.Values {
+		values := url.Values{}
+		values.Set("notify_id", "n1")
+		values.Set("app_id", appID)
+		values.Set("out_trade_no", "alipay_1")
+		values.Set("trade_status", tradeStatus)
+		values.Set("total_amount", "12.30")
+		values.Set("sign_type", "RSA2")
+		values.Set("sign", signWith(t, f.alipayKey, signContent(values, "sign", "sign_type")))
+		return values
+	}
+
+	tests := []struct {
+		tradeStatus string
+		want        Status
+	}{
+		{"TRADE_SUCCESS", StatusSucceeded},
+		{"TRADE_FINISHED", StatusSucceeded},
+		{"TRADE_CLOSED", StatusCanceled},
+		{"WAIT_BUYER_PAY", StatusPending},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tradeStatus, func(t *testing.T) {
+			n, err := a.VerifyNotification(http.Header{}, []byte(notification(testAppID, tt.tradeStatus).Encode()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n.ID != "n1" || n.Type != tt.tradeStatus || n.Payment.ID != "alipay_1" || n.Payment.Status != tt.want || n.Payment.Amount != money.New(1230, "cny") {
+				t.Errorf("VerifyNotification() = %+v", n)
+			}
+		})
+	}
+
+	t.Run("篡改金额", func(t *testing.T) {
+		values := notification(testAppID, "TRADE_SUCCESS")
+		values.Set("total_amount", "0.01")
+		if _, err := a.VerifyNotification(http.Header{}, []byte(values.Encode())); err == nil {
+			t.Error("接受了被篡改的通知")
+		}
+	})
+	t.Run("app_id不匹配", func(t *testing.T) {
+		if _, err := a.VerifyNotification(http.Header{}, []byte(notification("other", "TRADE_SUCCESS").Encode())); err == nil {
+			t.Error("接受了其他应用的通知")
+		}
+	})
+	t.Run("应用私钥签名", func(t *testing.T) {
+		values := notification(testAppID, "TRADE_SUCCESS")
+		values.Set("sign", signWith(t, f.appKey, signContent(values, "sign", "sign_type")))
+		if _, err := a.VerifyNotification(http.Header{}, []byte(values.Encode())); err == nil {
+			t.Error("接受了不是支付宝签名的通知")
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package payments
+
+import (
+	"errors"
+
+	"github.com/stripe/stripe-go/v84"
+	"github.com/stripe/stripe-go/v84/paymentmethod"
+)
+
+// ErrCardNotFound 卡片不存在
+var ErrCardNotFound = errors.New("卡片不存在")
+
+// Card Stripe客户保存的一张卡片
+type Card struct {
+	ID         string // PaymentMethod ID
+	CustomerID string // 卡片所属的客户, 已经移除的卡片为空
+	Brand      string
+	Last4      string
+	ExpMonth   int64
+	ExpYear    int64
+}
+
+// ListCards 查询客户保存的卡片
+func (p *stripeProvider) ListCards(customerID string) ([]Card, error) {
+	params := &stripe.PaymentMethodListParams{
+		Customer: stripe.String(customerID),
+		Type:     stripe.String(string(stripe.PaymentMethodTypeCard)),
+	}
+	var list []Card
+	iter := paymentmethod.List(params)
+	for iter.Next() {
+		list = append(list, fromPaymentMethod(iter.PaymentMethod()))
+	}
+	return list, iter.Err()
+}
+
+// GetCard 获取一张卡片, 不存在或不是卡片时返回ErrCardNotFound
+func (p *stripeProvider) GetCard(paymentMethodID string) (Card, error) {
+	pm, err := paymentmethod.Get(paymentMethodID, nil)
+	if err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.HTTPStatusCode == 404 {
+			return Card{}, ErrCardNotFound
+		}
+		return Card{}, err
+	}
+	if pm.Card == nil {
+		return Card{}, ErrCardNotFound
+	}
+	return fromPaymentMethod(pm), nil
+}
+
+// DetachCard 从客户中移除一张卡片, 之后不能再用于扣款
+func (p *stripeProvider) DetachCard(paymentMethodID string) error {
+	_, err := paymentmethod.Detach(paymentMethodID, nil)
+	return err
+}
+
+// fromPaymentMethod 读取卡片的展示信息
+func fromPaymentMethod(pm *stripe.PaymentMethod) Card {
+	card := Card{ID: pm.ID}
+	if pm.Customer != nil {
+		card.CustomerID = pm.Customer.ID
+	}
+	if pm.Card != nil {
+		card.Brand = string(pm.Card.Brand)
+		card.Last4 = pm.Card.Last4
+		card.ExpMonth = pm.Card.ExpMonth
+		card.ExpYear = pm.Card.ExpYear
+	}
+	return card
+}
@@ -0,0 +1,146 @@
+package payments
+
+import (
+	"breathaipay/money"
+
+	"encoding/json"
+	"time"
+
+	"github.com/stripe/stripe-go/v84"
+	"github.com/stripe/stripe-go/v84/checkout/session"
+)
+
+// CheckoutStatus Checkout Session的状态
+type CheckoutStatus string
+
+const (
+	CheckoutOpen     CheckoutStatus = "open"     // 等待用户付款
+	CheckoutComplete CheckoutStatus = "complete" // 用户已提交付款, 异步支付方式可能尚未到账
+	CheckoutExpired  CheckoutStatus = "expired"  // 已过期, 不能再付款
+)
+
+// CheckoutParams 创建Checkout Session的参数, 订单金额作为一个商品展示
+type CheckoutParams struct {
+	CustomerID          string
+	Amount              money.Money
+	Name                string // 商品名称
+	ProductDescription  string // 商品描述
+	Description         string // PaymentIntent的描述
+	Email               string
+	Metadata            map[string]string // 同时写入Session和PaymentIntent
+	PaymentMethod       string            // 为空表示由Stripe自动选择
+	SuccessURL          string
+	CancelURL           string
+	ExpiresAt           time.Time
+	Locale              string
+	AllowPromotionCodes bool
+	AutomaticTax        bool
+}
+
+// CheckoutSession Stripe托管的Checkout页面
+type CheckoutSession struct {
+	ID              string
+	URL             string
+	Status          CheckoutStatus
+	PaymentMode     bool   // 一次性付款的Session, 订阅的Session为false
+	PaymentStatus   string // Stripe返回的支付状态, 用于日志
+	Paid            bool
+	PaymentIntentID string // 用户提交付款后才有
+	Amount          money.Money
+	Metadata        map[string]string
+}
+
+// CreateCheckoutSession 创建一次性付款的Checkout Session
+func (p *stripeProvider) CreateCheckoutSession(params CheckoutParams) (CheckoutSession, error) {
+	csParams := &stripe.CheckoutSessionParams{
+		Mode:     stripe.String(string(stripe.CheckoutSessionModePayment)),
+		Customer: stripe.String(params.CustomerID),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{{
+			PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
+				Currency:   stripe.String(params.Amount.Currency),
+				UnitAmount: stripe.Int64(params.Amount.Amount),
+				ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
+					Name:        stripe.String(params.Name),
+					Description: stripe.String(params.ProductDescription),
+				},
+			},
+			Quantity: stripe.Int64(1),
+		}},
+		Metadata: params.Metadata,
+		PaymentIntentData: &stripe.CheckoutSessionPaymentIntentDataParams{
+			Description:  stripe.String(params.Description),
+			ReceiptEmail: stripe.String(params.Email),
+			Metadata:     params.Metadata,
+		},
+		SuccessURL: stripe.String(params.SuccessURL),
+		CancelURL:  stripe.String(params.CancelURL),
+		ExpiresAt:  stripe.Int64(params.ExpiresAt.Unix()),
+		Locale:     stripe.String(params.Locale),
+	}
+	if params.PaymentMethod != "" {
+		// 手续费按所选支付方式计算, 只允许使用该支付方式
+		csParams.PaymentMethodTypes = stripe.StringSlice([]string{params.PaymentMethod})
+	}
+	if params.AllowPromotionCodes {
+		csParams.AllowPromotionCodes = stripe.Bool(true)
+	}
+	if params.AutomaticTax {
+		csParams.AutomaticTax = &stripe.CheckoutSessionAutomaticTaxParams{Enabled: stripe.Bool(true)}
+		// 已有客户时需要允许Checkout保存地址, 否则无法计算税费
+		csParams.CustomerUpdate = &stripe.CheckoutSessionCustomerUpdateParams{
+			Address: stripe.String("auto"),
+			Name:    stripe.String("auto"),
+		}
+	}
+
+	cs, err := session.New(csParams)
+	if err != nil {
+		return CheckoutSession{}, err
+	}
+	return fromCheckoutSession(cs), nil
+}
+
+// GetCheckoutSession 查询Checkout Session
+func (p *stripeProvider) GetCheckoutSession(id string) (CheckoutSession, error) {
+	cs, err := session.Get(id, nil)
+	if err != nil {
+		return CheckoutSession{}, err
+	}
+	return fromCheckoutSession(cs), nil
+}
+
+// ExpireCheckoutSession 使尚未完成的Checkout Session过期, 之后用户不能再付款
+func (p *stripeProvider) ExpireCheckoutSession(id string) (CheckoutSession, error) {
+	cs, err := session.Expire(id, nil)
+	if err != nil {
+		return CheckoutSession{}, err
+	}
+	return fromCheckoutSession(cs), nil
+}
+
+// ParseCheckoutSession 解析Webhook事件data.object中的Checkout Session
+func (p *stripeProvider) ParseCheckoutSession(payload []byte) (CheckoutSession, error) {
+	var cs stripe.CheckoutSession
+	if err := json.Unmarshal(payload, &cs); err != nil {
+		return CheckoutSession{}, err
+	}
+	return fromCheckoutSession(&cs), nil
+}
+
+// fromCheckoutSession 将Stripe的Checkout Session转换为本项目使用的字段
+func fromCheckoutSession(cs *stripe.CheckoutSession) CheckoutSession {
+	s := CheckoutSession{
+		ID:            cs.ID,
+		URL:           cs.URL,
+		Status:        CheckoutStatus(cs.Status),
+		PaymentMode:   cs.Mode == stripe.CheckoutSessionModePayment,
+		PaymentStatus: string(cs.PaymentStatus),
+		Paid:          cs.PaymentStatus == stripe.CheckoutSessionPaymentStatusPaid,
+		Amount:        money.New(cs.AmountTotal, string(cs.Currency)),
+		Metadata:      cs.Metadata,
+	}
+	if cs.PaymentIntent != nil {
+		s.PaymentIntentID = cs.PaymentIntent.ID
+	}
+	return s
+}
@@ -0,0 +1,188 @@
+package payments
+
+import (
+	"breathaipay/money"
+	"breathaipay/utils"
+
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// 支付方的名称, 与订单表的provider列和手续费规则的provider字段一致
+const (
+	ProviderStripe = "stripe"
+	ProviderAlipay = "alipay"
+)
+
+// Status 统一后的支付状态
+type Status string
+
+const (
+	StatusPending         Status = "pending"          // 等待用户完成支付
+	StatusProcessing      Status = "processing"       // 用户已提交支付, 等待支付方确认
+	StatusRequiresCapture Status = "requires_capture" // 已授权, 等待扣款
+	StatusSucceeded       Status = "succeeded"        // 支付成功
+	StatusCanceled        Status = "canceled"         // 已取消或已关闭, 不能再支付
+)
+
+var (
+	// ErrAmountTooLarge 订单金额超过支付方允许的上限
+	ErrAmountTooLarge = errors.New("订单金额过大")
+	// ErrUnsupportedCurrency 支付方不支持订单的币种
+	ErrUnsupportedCurrency = errors.New("支付方不支持该币种")
+	// ErrAuthenticationRequired 发卡行要求持卡人验证, 需要用户在场时重新确认
+	ErrAuthenticationRequired = errors.New("发卡行要求持卡人验证")
+	// ErrDeclined 扣款被拒绝, 如余额不足或卡片过期
+	ErrDeclined = errors.New("卡片扣款失败")
+)
+
+// Payment 支付方中的一笔支付
+type Payment struct {
+	ID            string
+	Provider      string
+	Status        Status
+	RawStatus     string // 支付方返回的原始状态, 用于展示和日志
+	Amount        money.Money
+	Metadata      map[string]string // 创建时附带的订单信息, 支付方不支持时为空
+	ClientSecret  string            // 前端完成支付需要的凭据, 只有Stripe有
+	RedirectURL   string            // 需要跳转到支付方页面付款时的地址
+	PaymentMethod string            // 限定的支付方式, 为空表示由支付方自动选择
+	SaveCard      bool              // 支付成功后是否保存卡片
+	LastError     string            // 最近一次支付失败的原因
+}
+
+// CreateParams 创建支付的参数
+type CreateParams struct {
+	Amount         money.Money
+	Description    string
+	Email          string
+	CustomerID     string // Stripe客户ID
+	PaymentMethod  string // 为空表示由支付方自动选择
+	SavedCard      string // 使用已保存的卡片扣款时的卡片ID, 创建后由ConfirmOffSession确认, 只有Stripe支持
+	Metadata       map[string]string
+	IdempotencyKey string
+	ReturnURL      string // 在支付方页面付款后跳转回来的地址
+	ExpiresAt      time.Time
+}
+
+// RefundResult 退款结果, 累计金额用于按比例扣回积分
+type RefundResult struct {
+	ID             string
+	Amount         money.Money // 本次退款的金额
+	AmountPaid     int64       // 支付金额, 以最小货币单位表示
+	AmountRefunded int64       // 累计退款金额, 以最小货币单位表示
+}
+
+// Notification 支付方推送的通知, 签名校验通过后才会返回
+type Notification struct {
+	ID      string // 通知的ID, 支付方没有时为空
+	Type    string // 通知类型, Stripe为事件类型, 支付宝为交易状态
+	Payment Payment
+	Payload []byte // 通知中的原始数据, Stripe为事件的data.object
+}
+
+// Provider 支付方, 订单的创建、查询、取消和退款都通过它完成
+// 同一个订单始终由创建它的支付方处理, 支付方记录在订单的provider列中
+type Provider interface {
+	// Name 支付方的名称
+	Name() string
+	// Create 创建一笔支付, 返回的ID同时作为订单号
+	Create(params CreateParams) (Payment, error)
+	// Get 查询支付的当前状态
+	Get(id string) (Payment, error)
+	// Cancel 取消尚未支付的支付, 取消后用户不能再付款
+	Cancel(id string) error
+	// Refund 退款, amount为0时全额退款
+	Refund(id string, amount money.Money) (RefundResult, error)
+	// VerifyNotification 校验支付方推送的通知并解析
+	VerifyNotification(header http.Header, body []byte) (Notification, error)
+}
+
+// StripeProvider Stripe特有的功能: 客户、保存卡片、off-session扣款、订阅和托管的Checkout页面
+// 其他支付方不支持这些功能, 使用时通过Stripe()获取
+type StripeProvider interface {
+	Provider
+	// CreateCustomer 创建客户, 返回客户ID
+	CreateCustomer(email string) (string, error)
+	// SetSaveCard 设置支付成功后是否保存卡片, 用户在付款页勾选时调用
+	SetSaveCard(id string, save bool) error
+	// ConfirmOffSession 重新查询支付的当前状态, 仍待确认时在用户不在场的情况下使用已保存的卡片扣款
+	// 发卡行要求验证时返回ErrAuthenticationRequired, 被拒绝时返回包装了ErrDeclined的错误, 已经确认过的直接返回当前状态
+	ConfirmOffSession(p Payment) (Payment, error)
+	// CreateCheckoutSession 创建托管的Checkout页面
+	CreateCheckoutSession(params CheckoutParams) (CheckoutSession, error)
+	// GetCheckoutSession 查询Checkout Session
+	GetCheckoutSession(id string) (CheckoutSession, error)
+	// ExpireCheckoutSession 使尚未完成的Checkout Session立即过期
+	ExpireCheckoutSession(id string) (CheckoutSession, error)
+	// ParseCheckoutSession 解析Webhook事件中的Checkout Session
+	ParseCheckoutSession(payload []byte) (CheckoutSession, error)
+	// InvoiceForPayment 查询PaymentIntent支付的账单, 不是账单的支付时返回空字符串
+	InvoiceForPayment(paymentIntentID string) (string, error)
+	// CreateSubscription 创建订阅, 返回的ClientSecret用于在付款页支付首期账单
+	CreateSubscription(params SubscriptionParams) (Subscription, error)
+	// GetSubscription 查询订阅及其最新的账单
+	GetSubscription(id string) (Subscription, error)
+	// SetCancelAtPeriodEnd 修改订阅是否在当前计费周期结束时取消
+	SetCancelAtPeriodEnd(id string, cancel bool) (Subscription, error)
+	// ParseSubscription 解析Webhook事件中的订阅
+	ParseSubscription(payload []byte) (Subscription, error)
+	// ParseInvoice 解析Webhook事件中的账单
+	ParseInvoice(payload []byte) (Invoice, error)
+	// ListCards 查询客户保存的卡片
+	ListCards(customerID string) ([]Card, error)
+	// GetCard 获取一张卡片, 不存在时返回ErrCardNotFound
+	GetCard(paymentMethodID string) (Card, error)
+	// DetachCard 从客户中移除一张卡片
+	DetachCard(paymentMethodID string) error
+}
+
+// 已启用的支付方
+var providers = map[string]Provider{}
+
+// Init 按环境变量启用支付方, Stripe始终启用, 配置了ALIPAY_APP_ID时启用支付宝
+func Init() error {
+	secretKey := utils.GetEnvVariable("STRIPE_PRIVATE_KEY", "")
+	if secretKey == "" {
+		return errors.New("没有配置Stripe密钥")
+	}
+	providers[ProviderStripe] = newStripeProvider(secretKey, utils.GetEnvVariable("STRIPE_WEBHOOK_SECRET", ""))
+
+	if appID := utils.GetEnvVariable("ALIPAY_APP_ID", ""); appID != "" {
+		alipay, err := newAlipayProvider(alipayConfig{
+			AppID:      appID,
+			PrivateKey: utils.GetEnvVariable("ALIPAY_PRIVATE_KEY", ""),
+			PublicKey:  utils.GetEnvVariable("ALIPAY_PUBLIC_KEY", ""),
+			Gateway:    utils.GetEnvVariable("ALIPAY_GATEWAY", defaultAlipayGateway),
+			NotifyURL:  utils.PublicURL("/notify/alipay"),
+		})
+		if err != nil {
+			return fmt.Errorf("初始化支付宝失败: %w", err)
+		}
+		providers[ProviderAlipay] = alipay
+		log.Print("已启用支付宝直连")
+	}
+	return nil
+}
+
+// For 获取订单使用的支付方, name为空时为Stripe
+func For(name string) (Provider, error) {
+	if name == "" {
+		name = ProviderStripe
+	}
+	provider, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("支付方 %s 未启用", name)
+	}
+	return provider, nil
+}
+
+// Stripe 获取Stripe支付方, 嵌入付款页、Checkout、保存卡片和Webhook使用
+func Stripe() StripeProvider {
+	provider, _ := For(ProviderStripe)
+	stripe, _ := provider.(StripeProvider)
+	return stripe
+}
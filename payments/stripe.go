@@ -0,0 +1,253 @@
+package payments
+
+import (
+	"breathaipay/money"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/stripe/stripe-go/v84"
+	"github.com/stripe/stripe-go/v84/charge"
+	"github.com/stripe/stripe-go/v84/customer"
+	"github.com/stripe/stripe-go/v84/invoicepayment"
+	"github.com/stripe/stripe-go/v84/paymentintent"
+	"github.com/stripe/stripe-go/v84/refund"
+	"github.com/stripe/stripe-go/v84/webhook"
+)
+
+// stripeProvider 通过PaymentIntent收款
+type stripeProvider struct {
+	webhookSecret string
+}
+
+// newStripeProvider 设置全局的stripe.Key, 支付、订阅和卡片的请求共用该密钥
+func newStripeProvider(secretKey string, webhookSecret string) *stripeProvider {
+	stripe.Key = secretKey
+	return &stripeProvider{webhookSecret: webhookSecret}
+}
+
+func (p *stripeProvider) Name() string {
+	return ProviderStripe
+}
+
+// Create 创建PaymentIntent, 前端使用返回的ClientSecret在付款页完成支付
+func (p *stripeProvider) Create(params CreateParams) (Payment, error) {
+	piParams := &stripe.PaymentIntentParams{
+		Amount:       stripe.Int64(params.Amount.Amount),
+		Currency:     stripe.String(params.Amount.Currency),
+		Description:  stripe.String(params.Description),
+		ReceiptEmail: stripe.String(params.Email),
+		Metadata:     params.Metadata,
+	}
+	if params.CustomerID != "" {
+		piParams.Customer = stripe.String(params.CustomerID)
+	}
+	if params.SavedCard != "" {
+		// 使用已保存的卡片, 创建后不立即确认, 由调用者先记录订单再扣款
+		piParams.PaymentMethod = stripe.String(params.SavedCard)
+		piParams.PaymentMethodTypes = stripe.StringSlice([]string{string(stripe.PaymentMethodTypeCard)})
+	} else if params.PaymentMethod != "" {
+		// 手续费按所选支付方式计算, 只允许使用该支付方式
+		piParams.PaymentMethodTypes = stripe.StringSlice([]string{params.PaymentMethod})
+	} else {
+		// 启用自动支付方式选择
+		piParams.AutomaticPaymentMethods = &stripe.PaymentIntentAutomaticPaymentMethodsParams{
+			Enabled:        stripe.Bool(true),
+			AllowRedirects: stripe.String("always"),
+		}
+	}
+
+	// 相同幂等键的请求由Stripe返回同一个PaymentIntent, 防止并发的重复请求创建多笔订单
+	if params.IdempotencyKey != "" {
+		piParams.SetIdempotencyKey("create-payment-intent-" + params.IdempotencyKey)
+	}
+
+	pi, err := paymentintent.New(piParams)
+	if err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.Code == stripe.ErrorCodeAmountTooLarge {
+			return Payment{}, fmt.Errorf("%w: %v", ErrAmountTooLarge, err)
+		}
+		return Payment{}, err
+	}
+	return fromPaymentIntent(pi), nil
+}
+
+// Get 查询PaymentIntent
+func (p *stripeProvider) Get(id string) (Payment, error) {
+	pi, err := paymentintent.Get(id, nil)
+	if err != nil {
+		return Payment{}, err
+	}
+	return fromPaymentIntent(pi), nil
+}
+
+// Cancel 以abandoned(已放弃)为原因取消PaymentIntent
+func (p *stripeProvider) Cancel(id string) error {
+	_, err := paymentintent.Cancel(id, &stripe.PaymentIntentCancelParams{
+		CancellationReason: stripe.String(string(stripe.PaymentIntentCancellationReasonAbandoned)),
+	})
+	return err
+}
+
+// Refund 发起退款, 并读取支付记录上最新的累计退款金额
+func (p *stripeProvider) Refund(id string, amount money.Money) (RefundResult, error) {
+	params := &stripe.RefundParams{
+		PaymentIntent: stripe.String(id),
+		Reason:        stripe.String(string(stripe.RefundReasonRequestedByCustomer)),
+	}
+	if amount.IsPositive() {
+		params.Amount = stripe.Int64(amount.Amount)
+	}
+	r, err := refund.New(params)
+	if err != nil {
+		return RefundResult{}, err
+	}
+	result := RefundResult{ID: r.ID, Amount: money.New(r.Amount, string(r.Currency))}
+
+	ch, err := charge.Get(r.Charge.ID, nil)
+	if err != nil {
+		return result, fmt.Errorf("退款已发起, 但获取支付记录失败: %w", err)
+	}
+	result.AmountPaid, result.AmountRefunded = ch.Amount, ch.AmountRefunded
+	return result, nil
+}
+
+// CreateCustomer 创建Stripe客户
+func (p *stripeProvider) CreateCustomer(email string) (string, error) {
+	c, err := customer.New(&stripe.CustomerParams{Email: stripe.String(email)})
+	if err != nil {
+		return "", err
+	}
+	return c.ID, nil
+}
+
+// SetSaveCard 更新PaymentIntent的setup_future_usage, 空字符串表示不再保存
+func (p *stripeProvider) SetSaveCard(id string, save bool) error {
+	usage := ""
+	if save {
+		usage = string(stripe.PaymentIntentSetupFutureUsageOffSession)
+	}
+	_, err := paymentintent.Update(id, &stripe.PaymentIntentParams{SetupFutureUsage: stripe.String(usage)})
+	return err
+}
+
+// ConfirmOffSession 以off-session方式确认PaymentIntent
+// 幂等键重放时创建接口返回的是首次请求的结果, 状态可能已经过期, 因此先重新查询, 按当前状态处理
+// 只有仍为requires_confirmation的才发起扣款, 已经扣款失败或需要验证的返回对应的错误
+func (p *stripeProvider) ConfirmOffSession(payment Payment) (Payment, error) {
+	pi, err := paymentintent.Get(payment.ID, nil)
+	if err != nil {
+		return payment, err
+	}
+	current := fromPaymentIntent(pi)
+	switch pi.Status {
+	case stripe.PaymentIntentStatusRequiresConfirmation:
+	case stripe.PaymentIntentStatusRequiresAction:
+		return current, ErrAuthenticationRequired
+	case stripe.PaymentIntentStatusRequiresPaymentMethod:
+		// 之前的扣款已经失败, 不再使用同一张卡重试
+		if pi.LastPaymentError != nil {
+			if pi.LastPaymentError.Code == stripe.ErrorCodeAuthenticationRequired {
+				return current, ErrAuthenticationRequired
+			}
+			return current, fmt.Errorf("%w: %s", ErrDeclined, pi.LastPaymentError.Msg)
+		}
+		return current, ErrDeclined
+	default:
+		// succeeded、processing等状态说明已经确认过, 由调用者按状态处理
+		return current, nil
+	}
+
+	pi, err = paymentintent.Confirm(payment.ID, &stripe.PaymentIntentConfirmParams{OffSession: stripe.Bool(true)})
+	if err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) {
+			if stripeErr.Code == stripe.ErrorCodeAuthenticationRequired {
+				return current, ErrAuthenticationRequired
+			}
+			if stripeErr.Type == stripe.ErrorTypeCard {
+				return current, fmt.Errorf("%w: %s", ErrDeclined, stripeErr.Msg)
+			}
+		}
+		return current, err
+	}
+	return fromPaymentIntent(pi), nil
+}
+
+// InvoiceForPayment 通过账单的支付记录查询PaymentIntent对应的账单, 订阅续费的PaymentIntent由Stripe创建, 元数据中没有订单信息
+func (p *stripeProvider) InvoiceForPayment(paymentIntentID string) (string, error) {
+	params := &stripe.InvoicePaymentListParams{
+		Payment: &stripe.InvoicePaymentListPaymentParams{
+			Type:          stripe.String("payment_intent"),
+			PaymentIntent: stripe.String(paymentIntentID),
+		},
+	}
+	params.Limit = stripe.Int64(1)
+	iter := invoicepayment.List(params)
+	for iter.Next() {
+		if ip := iter.InvoicePayment(); ip.Invoice != nil {
+			return ip.Invoice.ID, nil
+		}
+	}
+	return "", iter.Err()
+}
+
+// VerifyNotification 校验Webhook签名, 忽略API版本差异, 只使用本项目关心的字段
+// payment_intent.*事件同时解析出支付信息, 其他事件由调用方解析Payload
+func (p *stripeProvider) VerifyNotification(header http.Header, body []byte) (Notification, error) {
+	if p.webhookSecret == "" {
+		return Notification{}, errors.New("未配置STRIPE_WEBHOOK_SECRET")
+	}
+	event, err := webhook.ConstructEventWithOptions(body, header.Get("Stripe-Signature"), p.webhookSecret,
+		webhook.ConstructEventOptions{IgnoreAPIVersionMismatch: true})
+	if err != nil {
+		return Notification{}, err
+	}
+
+	n := Notification{ID: event.ID, Type: string(event.Type), Payload: event.Data.Raw}
+	if strings.HasPrefix(n.Type, "payment_intent.") {
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+			return Notification{}, fmt.Errorf("解析PaymentIntent失败: %w", err)
+		}
+		n.Payment = fromPaymentIntent(&pi)
+	}
+	return n, nil
+}
+
+// fromPaymentIntent 将PaymentIntent转换为统一的支付信息
+func fromPaymentIntent(pi *stripe.PaymentIntent) Payment {
+	p := Payment{
+		ID:           pi.ID,
+		Provider:     ProviderStripe,
+		RawStatus:    string(pi.Status),
+		Amount:       money.New(pi.Amount, string(pi.Currency)),
+		Metadata:     pi.Metadata,
+		ClientSecret: pi.ClientSecret,
+		SaveCard:     pi.SetupFutureUsage == stripe.PaymentIntentSetupFutureUsageOffSession,
+	}
+	switch pi.Status {
+	case stripe.PaymentIntentStatusSucceeded:
+		p.Status = StatusSucceeded
+	case stripe.PaymentIntentStatusCanceled:
+		p.Status = StatusCanceled
+	case stripe.PaymentIntentStatusProcessing:
+		p.Status = StatusProcessing
+	case stripe.PaymentIntentStatusRequiresCapture:
+		p.Status = StatusRequiresCapture
+	default:
+		p.Status = StatusPending
+	}
+	// 未启用自动选择时记录限定的支付方式, 多个时用逗号连接
+	if pi.AutomaticPaymentMethods == nil || !pi.AutomaticPaymentMethods.Enabled {
+		p.PaymentMethod = strings.Join(pi.PaymentMethodTypes, ",")
+	}
+	if pi.LastPaymentError != nil {
+		p.LastError = pi.LastPaymentError.Msg
+	}
+	return p
+}
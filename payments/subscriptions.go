@@ -0,0 +1,174 @@
+package payments
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/stripe/stripe-go/v84"
+	"github.com/stripe/stripe-go/v84/subscription"
+)
+
+// SubscriptionStatus Stripe订阅的状态
+type SubscriptionStatus string
+
+const (
+	SubscriptionActive            SubscriptionStatus = "active"
+	SubscriptionTrialing          SubscriptionStatus = "trialing"
+	SubscriptionPastDue           SubscriptionStatus = "past_due"
+	SubscriptionUnpaid            SubscriptionStatus = "unpaid"
+	SubscriptionPaused            SubscriptionStatus = "paused"
+	SubscriptionCanceled          SubscriptionStatus = "canceled"
+	SubscriptionIncompleteExpired SubscriptionStatus = "incomplete_expired"
+)
+
+// 账单类型, 本项目只为首期和每期续费的账单发放积分
+const (
+	BillingReasonSubscriptionCreate = "subscription_create"
+	BillingReasonSubscriptionCycle  = "subscription_cycle"
+)
+
+// SubscriptionParams 创建订阅的参数, 订阅只有一个订阅项
+type SubscriptionParams struct {
+	CustomerID     string
+	PriceID        string
+	Metadata       map[string]string
+	IdempotencyKey string
+}
+
+// Subscription Stripe中的一个订阅
+type Subscription struct {
+	ID                string
+	Status            SubscriptionStatus
+	CancelAtPeriodEnd bool
+	CurrentPeriodEnd  time.Time // 当前计费周期的结束时间, 未知时为零值
+	CustomerID        string
+	Metadata          map[string]string
+	ClientSecret      string   // 首期账单待支付款项的client secret, 只有创建时返回
+	LatestInvoice     *Invoice // 最新的账单, 只有查询时返回
+}
+
+// Invoice Stripe中的一张账单
+type Invoice struct {
+	ID             string
+	Paid           bool
+	BillingReason  string
+	CustomerID     string
+	SubscriptionID string            // 不是订阅账单时为空
+	Metadata       map[string]string // 订阅的元数据, Webhook中的订阅只有ID时以账单生成时的快照为准
+}
+
+// CreateSubscription 创建订阅, 首期账单不自动扣款, 由用户在付款页确认, 支付成功后保存支付方式用于之后的自动续费
+// 相同幂等键的重复请求由Stripe返回同一个订阅
+func (p *stripeProvider) CreateSubscription(params SubscriptionParams) (Subscription, error) {
+	subParams := &stripe.SubscriptionParams{
+		Customer: stripe.String(params.CustomerID),
+		Items: []*stripe.SubscriptionItemsParams{
+			{Price: stripe.String(params.PriceID)},
+		},
+		PaymentBehavior: stripe.String("default_incomplete"),
+		PaymentSettings: &stripe.SubscriptionPaymentSettingsParams{
+			SaveDefaultPaymentMethod: stripe.String("on_subscription"),
+		},
+		Metadata: params.Metadata,
+	}
+	subParams.AddExpand("latest_invoice.confirmation_secret")
+	if params.IdempotencyKey != "" {
+		subParams.SetIdempotencyKey("create-subscription-" + params.IdempotencyKey)
+	}
+
+	sub, err := subscription.New(subParams)
+	if err != nil {
+		return Subscription{}, err
+	}
+	s := fromSubscription(sub)
+	if sub.LatestInvoice != nil && sub.LatestInvoice.ConfirmationSecret != nil {
+		s.ClientSecret = sub.LatestInvoice.ConfirmationSecret.ClientSecret
+	}
+	return s, nil
+}
+
+// GetSubscription 查询订阅及其最新的账单
+func (p *stripeProvider) GetSubscription(id string) (Subscription, error) {
+	params := &stripe.SubscriptionParams{}
+	params.AddExpand("latest_invoice")
+	sub, err := subscription.Get(id, params)
+	if err != nil {
+		return Subscription{}, err
+	}
+	s := fromSubscription(sub)
+	if sub.LatestInvoice != nil {
+		inv := fromInvoice(sub.LatestInvoice)
+		// 展开的账单中订阅只有ID
+		if inv.SubscriptionID == sub.ID && inv.Metadata == nil {
+			inv.Metadata = sub.Metadata
+		}
+		s.LatestInvoice = &inv
+	}
+	return s, nil
+}
+
+// SetCancelAtPeriodEnd 修改订阅是否在当前计费周期结束时取消
+func (p *stripeProvider) SetCancelAtPeriodEnd(id string, cancel bool) (Subscription, error) {
+	sub, err := subscription.Update(id, &stripe.SubscriptionParams{CancelAtPeriodEnd: stripe.Bool(cancel)})
+	if err != nil {
+		return Subscription{}, err
+	}
+	return fromSubscription(sub), nil
+}
+
+// ParseSubscription 解析Webhook事件data.object中的订阅
+func (p *stripeProvider) ParseSubscription(payload []byte) (Subscription, error) {
+	var sub stripe.Subscription
+	if err := json.Unmarshal(payload, &sub); err != nil {
+		return Subscription{}, err
+	}
+	return fromSubscription(&sub), nil
+}
+
+// ParseInvoice 解析Webhook事件data.object中的账单
+func (p *stripeProvider) ParseInvoice(payload []byte) (Invoice, error) {
+	var inv stripe.Invoice
+	if err := json.Unmarshal(payload, &inv); err != nil {
+		return Invoice{}, err
+	}
+	return fromInvoice(&inv), nil
+}
+
+// fromSubscription 将Stripe的订阅转换为本项目使用的字段
+func fromSubscription(sub *stripe.Subscription) Subscription {
+	s := Subscription{
+		ID:                sub.ID,
+		Status:            SubscriptionStatus(sub.Status),
+		CancelAtPeriodEnd: sub.CancelAtPeriodEnd,
+		Metadata:          sub.Metadata,
+	}
+	// 计费周期记录在订阅项上, 本项目的订阅只有一个订阅项
+	if sub.Items != nil && len(sub.Items.Data) > 0 && sub.Items.Data[0].CurrentPeriodEnd > 0 {
+		s.CurrentPeriodEnd = time.Unix(sub.Items.Data[0].CurrentPeriodEnd, 0)
+	}
+	if sub.Customer != nil {
+		s.CustomerID = sub.Customer.ID
+	}
+	return s
+}
+
+// fromInvoice 将Stripe的账单转换为本项目使用的字段
+func fromInvoice(inv *stripe.Invoice) Invoice {
+	i := Invoice{
+		ID:            inv.ID,
+		Paid:          inv.Status == stripe.InvoiceStatusPaid,
+		BillingReason: string(inv.BillingReason),
+	}
+	if inv.Customer != nil {
+		i.CustomerID = inv.Customer.ID
+	}
+	if inv.Parent != nil && inv.Parent.SubscriptionDetails != nil && inv.Parent.SubscriptionDetails.Subscription != nil {
+		details := inv.Parent.SubscriptionDetails
+		i.SubscriptionID = details.Subscription.ID
+		i.Metadata = details.Subscription.Metadata
+		if i.Metadata == nil {
+			i.Metadata = details.Metadata
+		}
+	}
+	return i
+}
@@ -0,0 +1,234 @@
+package pricing
+
+import (
+	"breathaipay/catalog"
+	"breathaipay/coupons"
+	"breathaipay/money"
+	"breathaipay/utils"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Rule 一条手续费规则, 数据来自FEES_CONFIG指定的配置文件
+// 用户支付的总价 = (应收金额 + fixed) / (1 - percent/100), 即商家扣除手续费后恰好收到应收金额
+type Rule struct {
+	Currency      string  `json:"currency"`       // 适用的币种, 为空表示所有币种
+	PaymentMethod string  `json:"payment_method"` // 适用的Stripe支付方式(如card、alipay), 为空表示自动选择支付方式时使用
+	Name          string  `json:"name"`           // 支付方式展示给用户的名称
+	Percent       float64 `json:"percent"`        // 按比例收取的手续费, 如2.9表示2.9%
+	Fixed         int64   `json:"fixed"`          // 每笔固定手续费, 以订单币种的最小货币单位(分)表示
+	Absorb        bool    `json:"absorb"`         // 为true时手续费由商家承担, 用户只需支付应收金额
+	Provider      string  `json:"provider"`       // 处理该支付方式的支付方, 为空表示Stripe, alipay表示直连支付宝
+}
+
+// 未提供配置文件时使用的默认规则, 人民币与旧版本硬编码的 (price+1.9)/0.971 一致
+// 固定手续费以订单币种的最小货币单位表示, 其他币种只按比例收取
+var defaultRules = []Rule{
+	{Currency: "cny", Percent: 2.9, Fixed: 190},
+	{Percent: 2.9},
+}
+
+// 已加载的规则, 保持配置文件中的顺序
+var rules = defaultRules
+
+// Load 从FEES_CONFIG指定的JSON文件(默认fees.json)加载手续费规则, 文件不存在时使用默认规则
+func Load() error {
+	path := utils.GetEnvVariable("FEES_CONFIG", "fees.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			log.Printf("未找到手续费配置文件 %s, 使用默认手续费规则", path)
+			rules = defaultRules
+			return nil
+		}
+		return err
+	}
+
+	var loaded []Rule
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("解析手续费配置文件 %s 失败: %w", path, err)
+	}
+	hasDefault := false
+	for i, rule := range loaded {
+		if rule.Percent < 0 || rule.Percent >= 100 || rule.Fixed < 0 {
+			return fmt.Errorf("手续费配置第 %d 项的percent或fixed无效", i+1)
+		}
+		loaded[i].Currency = strings.ToLower(rule.Currency)
+		loaded[i].PaymentMethod = strings.ToLower(rule.PaymentMethod)
+		loaded[i].Provider = strings.ToLower(rule.Provider)
+		if loaded[i].Name == "" {
+			loaded[i].Name = loaded[i].PaymentMethod
+		}
+		if rule.Currency == "" && rule.PaymentMethod == "" {
+			hasDefault = true
+		}
+		if rule.Currency == "" && rule.Fixed > 0 {
+			log.Printf("手续费配置第 %d 项没有指定币种, fixed %d 会按每个订单币种的最小货币单位收取", i+1, rule.Fixed)
+		}
+	}
+	if !hasDefault {
+		return fmt.Errorf("手续费配置文件 %s 缺少currency和payment_method都为空的默认规则", path)
+	}
+	rules = loaded
+	log.Printf("已加载 %d 条手续费规则", len(rules))
+	return nil
+}
+
+// Match 选择最匹配的规则: 币种和支付方式都匹配的规则优先, 其次是只匹配币种的规则
+// paymentMethod为空时只使用没有指定支付方式的规则
+func Match(currency string, paymentMethod string) Rule {
+	best, bestScore := Rule{}, -1
+	for _, rule := range rules {
+		if rule.PaymentMethod != paymentMethod || (rule.Currency != "" && rule.Currency != currency) {
+			continue
+		}
+		score := 0
+		if rule.Currency != "" {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = rule, score
+		}
+	}
+	if bestScore < 0 && paymentMethod != "" {
+		// 指定的支付方式没有规则时按自动选择支付方式计算
+		return Match(currency, "")
+	}
+	return best
+}
+
+// PaymentMethods 返回可以为该币种单独选择的支付方式, 即配置了专门规则的支付方式
+func PaymentMethods(currency string) []Rule {
+	var methods []Rule
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		if rule.PaymentMethod == "" || seen[rule.PaymentMethod] || (rule.Currency != "" && rule.Currency != currency) {
+			continue
+		}
+		seen[rule.PaymentMethod] = true
+		methods = append(methods, Match(currency, rule.PaymentMethod))
+	}
+	return methods
+}
+
+// Providers 返回规则中用到的支付方, 用于启动时检查支付方是否已启用
+func Providers() []string {
+	var providers []string
+	for _, rule := range rules {
+		if rule.Provider != "" && !slices.Contains(providers, rule.Provider) {
+			providers = append(providers, rule.Provider)
+		}
+	}
+	return providers
+}
+
+// ValidPaymentMethod 判断用户选择的支付方式是否可用于该币种, 空字符串表示自动选择
+func ValidPaymentMethod(currency string, paymentMethod string) bool {
+	if paymentMethod == "" {
+		return true
+	}
+	for _, rule := range PaymentMethods(currency) {
+		if rule.PaymentMethod == paymentMethod {
+			return true
+		}
+	}
+	return false
+}
+
+// Line 金额明细中的一行
+type Line struct {
+	Label  string
+	Amount money.Money // 减少金额的项目为负数
+}
+
+// Quote 订单报价
+type Quote struct {
+	Currency      string
+	PaymentMethod string // 为空表示自动选择支付方式
+	Subtotal      money.Money
+	Discount      money.Money
+	Fee           money.Money // 用户承担的手续费, 商家承担手续费时为0
+	Total         money.Money // 用户实际支付的金额, 即PaymentIntent的金额
+	Points        int64       // 发放的积分, 包含优惠码赠送的积分
+	BonusPoints   int64
+	CouponCode    string
+	Lines         []Line // 展示在付款页的金额明细
+}
+
+// MaxQuantity 单笔订单的最大购买数量, 防止数量过大导致金额和积分溢出
+const MaxQuantity = 1000
+
+// ValidQuantity 判断购买数量是否在1到MaxQuantity之间
+func ValidQuantity(quantity int) bool {
+	return quantity >= 1 && quantity <= MaxQuantity
+}
+
+// ErrOrderTooLarge 订单的金额或积分超出可以表示的范围
+var ErrOrderTooLarge = errors.New("订单金额过大")
+
+// ErrZeroTotal 扣除优惠后没有需要支付的金额, 支付方不能创建金额为0的支付
+var ErrZeroTotal = errors.New("订单金额为0")
+
+// QuoteOrder 计算订单金额, 付款页展示和创建PaymentIntent共用, 保证两者一致
+// 优惠在计算手续费之前扣除, 数量超出范围或小计、总价、积分溢出时返回ErrOrderTooLarge
+// 扣除优惠后应收金额不大于0时返回ErrZeroTotal, 不向用户只收取手续费
+func QuoteOrder(product *catalog.Product, quantity int, coupon *coupons.Coupon, paymentMethod string) (Quote, error) {
+	if !ValidQuantity(quantity) || int64(product.Points) > math.MaxInt64/int64(quantity) {
+		return Quote{}, ErrOrderTooLarge
+	}
+	subtotal, err := product.Price.Mul(int64(quantity))
+	if err != nil {
+		return Quote{}, fmt.Errorf("%w: 小计 %v", ErrOrderTooLarge, err)
+	}
+	q := Quote{
+		Currency:      product.Currency,
+		PaymentMethod: paymentMethod,
+		Subtotal:      subtotal,
+		Discount:      money.New(0, product.Currency),
+		Points:        int64(product.Points) * int64(quantity),
+	}
+	q.Lines = append(q.Lines, Line{Label: "小计", Amount: q.Subtotal})
+	if coupon != nil {
+		if q.Discount, err = coupons.Discount(coupon, q.Subtotal); err != nil {
+			return Quote{}, fmt.Errorf("%w: 优惠 %v", ErrOrderTooLarge, err)
+		}
+		if coupon.BonusPoints > math.MaxInt64-q.Points {
+			return Quote{}, ErrOrderTooLarge
+		}
+		q.BonusPoints = coupon.BonusPoints
+		q.Points += coupon.BonusPoints
+		q.CouponCode = coupon.Code
+		if q.Discount.IsPositive() {
+			q.Lines = append(q.Lines, Line{Label: "优惠", Amount: q.Discount.Neg()})
+		}
+	}
+
+	net := q.Subtotal.Sub(q.Discount)
+	if !net.IsPositive() {
+		return Quote{}, ErrZeroTotal
+	}
+	rule := Match(product.Currency, paymentMethod)
+	q.Total = net
+	if !rule.Absorb {
+		// 比例换算为百万分之一后用整数计算并向上取整, 保证扣除手续费后不少于应收金额
+		keep := 1000000 - int64(math.Round(rule.Percent*10000))
+		if net.Amount > math.MaxInt64-rule.Fixed {
+			return Quote{}, ErrOrderTooLarge
+		}
+		if q.Total, err = net.Add(money.New(rule.Fixed, product.Currency)).MulDiv(1000000, keep, money.RoundUp); err != nil {
+			return Quote{}, fmt.Errorf("%w: 总价 %v", ErrOrderTooLarge, err)
+		}
+	}
+	q.Fee = q.Total.Sub(net)
+	if q.Fee.IsPositive() {
+		q.Lines = append(q.Lines, Line{Label: "手续费", Amount: q.Fee})
+	}
+	return q, nil
+}
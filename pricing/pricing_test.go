@@ -0,0 +1,204 @@
+package pricing
+
+import (
+	"breathaipay/catalog"
+	"breathaipay/coupons"
+	"breathaipay/money"
+
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func product(amount int64, currency string, points int) *catalog.Product {
+	return &catalog.Product{ID: 1, Price: money.New(amount, currency), Points: points, Currency: currency, Active: true}
+}
+
+// loadRules 从临时文件加载手续费规则, 测试结束后恢复默认规则
+func loadRules(t *testing.T, config string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fees.json")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FEES_CONFIG", path)
+	t.Cleanup(func() { rules = defaultRules })
+	if err := Load(); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+}
+
+func TestQuoteDefaultRules(t *testing.T) {
+	tests := []struct {
+		name      string
+		amount    int64
+		currency  string
+		wantTotal int64
+		wantFee   int64
+	}{
+		// 人民币与旧版本的 (price+1.9)/0.971 一致, 向上取整到分
+		{"人民币 固定手续费", 2000, "cny", 2256, 256},
+		// 固定手续费只适用于人民币, 其他币种只按比例收取
+		{"美元 只按比例", 1000, "usd", 1030, 30},
+		{"日元 只按比例", 1000, "jpy", 1030, 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := QuoteOrder(product(tt.amount, tt.currency, 100), 1, nil, "")
+			if err != nil {
+				t.Fatalf("QuoteOrder() error = %v", err)
+			}
+			if q.Total.Amount != tt.wantTotal || q.Fee.Amount != tt.wantFee || q.Total.Currency != tt.currency {
+				t.Errorf("QuoteOrder() total = %d %s, fee = %d, want %d %s, fee = %d",
+					q.Total.Amount, q.Total.Currency, q.Fee.Amount, tt.wantTotal, tt.currency, tt.wantFee)
+			}
+		})
+	}
+}
+
+func TestQuoteCurrencyScopedRules(t *testing.T) {
+	loadRules(t, `[
+		{"currency": "cny", "payment_method": "alipay", "name": "支付宝", "percent": 0.6},
+		{"currency": "cny", "percent": 2.9, "fixed": 190},
+		{"currency": "usd", "percent": 3.5, "fixed": 30, "absorb": true},
+		{"payment_method": "alipay", "percent": 1.5},
+		{"percent": 4}
+	]`)
+
+	tests := []struct {
+		name          string
+		amount        int64
+		currency      string
+		paymentMethod string
+		wantTotal     int64
+	}{
+		{"币种和支付方式都匹配", 1000, "cny", "alipay", 1007},
+		{"只匹配币种", 1000, "cny", "", 1226},
+		{"未配置的支付方式按自动选择计算", 1000, "cny", "wechat_pay", 1226},
+		{"商家承担手续费", 1000, "usd", "", 1000},
+		{"其他币种的支付方式规则", 1000, "eur", "alipay", 1016},
+		{"其他币种的默认规则", 1000, "eur", "", 1042},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := QuoteOrder(product(tt.amount, tt.currency, 100), 1, nil, tt.paymentMethod)
+			if err != nil {
+				t.Fatalf("QuoteOrder() error = %v", err)
+			}
+			if q.Total.Amount != tt.wantTotal {
+				t.Errorf("QuoteOrder() total = %d, want %d", q.Total.Amount, tt.wantTotal)
+			}
+			if q.Fee.Amount != q.Total.Amount-tt.amount {
+				t.Errorf("QuoteOrder() fee = %d, want %d", q.Fee.Amount, q.Total.Amount-tt.amount)
+			}
+		})
+	}
+
+	if got := PaymentMethods("cny"); len(got) != 1 || got[0].Name != "支付宝" || got[0].Percent != 0.6 {
+		t.Errorf("PaymentMethods(cny) = %+v", got)
+	}
+	if !ValidPaymentMethod("eur", "alipay") || ValidPaymentMethod("cny", "wechat_pay") {
+		t.Error("ValidPaymentMethod() 与规则不一致")
+	}
+}
+
+func TestLoadRequiresDefaultRule(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fees.json")
+	if err := os.WriteFile(path, []byte(`[{"currency": "cny", "percent": 2.9}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FEES_CONFIG", path)
+	t.Cleanup(func() { rules = defaultRules })
+	if err := Load(); err == nil {
+		t.Error("Load() 缺少默认规则时没有返回错误")
+	}
+}
+
+func TestQuoteCouponAndFeeRounding(t *testing.T) {
+	tests := []struct {
+		name         string
+		amount       int64
+		coupon       coupons.Coupon
+		wantDiscount int64
+		wantTotal    int64
+		wantPoints   int64
+	}{
+		// 9.99 × 15% = 1.4985 元, 舍去不足一分的零头; (8.50 + 1.90) / 0.971 = 10.7106 元, 向上取整
+		{"比例优惠舍去零头 手续费向上取整", 999, coupons.Coupon{Code: "P15", PercentOff: 15}, 149, 1072, 100},
+		// 优惠在计算手续费之前扣除
+		{"固定金额优惠", 2000, coupons.Coupon{Code: "A5", AmountOff: 500, Currency: "cny"}, 500, 1741, 100},
+		{"比例和固定金额叠加", 2000, coupons.Coupon{Code: "PA", PercentOff: 10, AmountOff: 100, Currency: "cny"}, 300, 1947, 100},
+		{"赠送积分", 2000, coupons.Coupon{Code: "B", BonusPoints: 50}, 0, 2256, 150},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := QuoteOrder(product(tt.amount, "cny", 100), 1, &tt.coupon, "")
+			if err != nil {
+				t.Fatalf("QuoteOrder() error = %v", err)
+			}
+			if q.Discount.Amount != tt.wantDiscount || q.Total.Amount != tt.wantTotal || q.Points != tt.wantPoints {
+				t.Errorf("QuoteOrder() discount = %d, total = %d, points = %d, want %d, %d, %d",
+					q.Discount.Amount, q.Total.Amount, q.Points, tt.wantDiscount, tt.wantTotal, tt.wantPoints)
+			}
+			if got := q.Subtotal.Amount - q.Discount.Amount + q.Fee.Amount; got != q.Total.Amount {
+				t.Errorf("小计 - 优惠 + 手续费 = %d, total = %d", got, q.Total.Amount)
+			}
+			if q.CouponCode != tt.coupon.Code {
+				t.Errorf("QuoteOrder() coupon = %q, want %q", q.CouponCode, tt.coupon.Code)
+			}
+		})
+	}
+}
+
+func TestQuoteZeroTotal(t *testing.T) {
+	tests := []struct {
+		name   string
+		coupon coupons.Coupon
+	}{
+		{"全额比例优惠", coupons.Coupon{Code: "FREE", PercentOff: 100}},
+		{"固定金额优惠等于小计", coupons.Coupon{Code: "A20", AmountOff: 2000, Currency: "cny"}},
+		{"固定金额优惠超过小计", coupons.Coupon{Code: "A50", AmountOff: 5000, Currency: "cny"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 只剩手续费时不能让用户支付
+			if _, err := QuoteOrder(product(2000, "cny", 100), 1, &tt.coupon, ""); !errors.Is(err, ErrZeroTotal) {
+				t.Errorf("QuoteOrder() error = %v, want %v", err, ErrZeroTotal)
+			}
+		})
+	}
+	if _, err := QuoteOrder(product(0, "cny", 100), 1, nil, ""); !errors.Is(err, ErrZeroTotal) {
+		t.Errorf("QuoteOrder() 单价为0时 error = %v, want %v", err, ErrZeroTotal)
+	}
+}
+
+func TestQuoteQuantity(t *testing.T) {
+	tests := []struct {
+		name     string
+		quantity int
+		wantErr  error
+	}{
+		{"最小数量", 1, nil},
+		{"最大数量", MaxQuantity, nil},
+		{"数量为0", 0, ErrOrderTooLarge},
+		{"负数", -1, ErrOrderTooLarge},
+		{"超过最大数量", MaxQuantity + 1, ErrOrderTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := QuoteOrder(product(2000, "cny", 100000), tt.quantity, nil, "")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("QuoteOrder() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (q.Subtotal.Amount != 2000*int64(tt.quantity) || q.Points != 100000*int64(tt.quantity)) {
+				t.Errorf("QuoteOrder() subtotal = %d, points = %d", q.Subtotal.Amount, q.Points)
+			}
+		})
+	}
+
+	// 数量在范围内但单价过大时同样拒绝
+	if _, err := QuoteOrder(product(1<<62, "cny", 1), 2, nil, ""); !errors.Is(err, ErrOrderTooLarge) {
+		t.Errorf("QuoteOrder() error = %v, want %v", err, ErrOrderTooLarge)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"breathaipay/autotopup"
+	"breathaipay/cards"
+	"breathaipay/catalog"
+	"breathaipay/database"
+	"breathaipay/payments"
+	"breathaipay/pricing"
+	"breathaipay/sites"
+
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// quickPageHandler 一键购买入口, 输入邮箱后发送登录链接
+func quickPageHandler(c *gin.Context) {
+	c.HTML(http.StatusOK, "quick.html", gin.H{})
+}
+
+// quickLinkHandler 向邮箱发送一键购买链接, 无论邮箱是否购买过都给出相同的提示
+func quickLinkHandler(c *gin.Context) {
+	email := c.PostForm("email")
+	if err := cards.SendLoginLink(email); err != nil {
+		log.Printf("发送一键购买链接失败 (%s): %v", email, err)
+	}
+	c.HTML(http.StatusOK, "quick.html", gin.H{
+		"Email": email,
+		"Sent":  true,
+	})
+}
+
+// quickSession 从请求中读取并校验一键购买会话, 同时查询邮箱对应的Stripe客户
+// 校验失败时已经写入响应
+func quickSession(c *gin.Context, session cards.Session) (string, bool) {
+	if !session.Valid() {
+		c.HTML(http.StatusOK, "quick.html", gin.H{"Error": "链接无效或已过期，请重新获取。"})
+		return "", false
+	}
+	customerID, err := database.FindCustomerID(session.Email)
+	if err != nil {
+		log.Printf("查询客户失败 (%s): %v", session.Email, err)
+		c.HTML(http.StatusOK, "quick.html", gin.H{"Error": "没有找到该邮箱保存的卡片。"})
+		return "", false
+	}
+	return customerID, true
+}
+
+// sessionFromQuery 读取链接中的会话
+func sessionFromQuery(c *gin.Context) cards.Session {
+	expires, _ := strconv.ParseInt(c.Query("expires"), 10, 64)
+	return cards.Session{Email: c.Query("email"), Expires: expires, Token: c.Query("token")}
+}
+
+// sessionFromForm 读取表单中原样带回的会话
+func sessionFromForm(c *gin.Context) cards.Session {
+	expires, _ := strconv.ParseInt(c.PostForm("expires"), 10, 64)
+	return cards.Session{Email: c.PostForm("email"), Expires: expires, Token: c.PostForm("token")}
+}
+
+// quickBuyPageHandler 展示已保存的卡片和可购买的商品
+func quickBuyPageHandler(c *gin.Context) {
+	renderQuickBuy(c, sessionFromQuery(c), "")
+}
+
+// renderQuickBuy 展示一键购买页面
+func renderQuickBuy(c *gin.Context, session cards.Session, message string) {
+	customerID, ok := quickSession(c, session)
+	if !ok {
+		return
+	}
+	saved, err := cards.List(customerID)
+	if err != nil {
+		log.Printf("查询已保存的卡片失败 (%s): %v", customerID, err)
+		message = "暂时无法获取已保存的卡片，请稍后再试。"
+	}
+	products, err := catalog.List("")
+	if err != nil {
+		log.Printf("获取商品列表失败: %v", err)
+	}
+	c.HTML(http.StatusOK, "quick_buy.html", gin.H{
+		"Session":       session,
+		"Cards":         saved,
+		"Products":      products,
+		"Sites":         sites.Enabled(),
+		"Error":         message,
+		"AutoTopups":    autoTopupViews(session.Email),
+		"MaxDailyLimit": autotopup.MaxDailyLimit(),
+	})
+}
+
+// quickRemoveCardHandler 移除一张已保存的卡片
+func quickRemoveCardHandler(c *gin.Context) {
+	session := sessionFromForm(c)
+	customerID, ok := quickSession(c, session)
+	if !ok {
+		return
+	}
+	message := ""
+	if err := cards.Remove(customerID, c.PostForm("paymentMethod")); err != nil {
+		log.Printf("移除卡片失败 (%s, %s): %v", customerID, c.PostForm("paymentMethod"), err)
+		message = "移除卡片失败，请稍后再试。"
+	}
+	renderQuickBuy(c, session, message)
+}
+
+// quickOrder 一键购买表单中的订单信息
+type quickOrder struct {
+	session         cards.Session
+	customerID      string
+	card            cards.Card
+	site            sites.Site
+	product         *catalog.Product
+	quantity        int
+	openwebuiUserID string
+	quote           pricing.Quote
+}
+
+// readQuickOrder 读取并校验一键购买表单, 与普通下单的校验一致
+// 校验失败时返回展示给用户的提示
+func readQuickOrder(c *gin.Context) (quickOrder, string) {
+	o := quickOrder{session: sessionFromForm(c)}
+	if !o.session.Valid() {
+		return o, "链接无效或已过期，请重新获取。"
+	}
+	var err error
+	if o.customerID, err = database.FindCustomerID(o.session.Email); err != nil {
+		log.Printf("查询客户失败 (%s): %v", o.session.Email, err)
+		return o, "没有找到该邮箱保存的卡片。"
+	}
+	if o.card, err = cards.Get(o.customerID, c.PostForm("paymentMethod")); err != nil {
+		if !errors.Is(err, cards.ErrNotFound) {
+			log.Printf("获取卡片失败 (%s): %v", c.PostForm("paymentMethod"), err)
+		}
+		return o, "请选择一张已保存的卡片。"
+	}
+
+	var ok bool
+	if o.site, ok = sites.GetEnabled(c.PostForm("siteType")); !ok {
+		return o, "无效的站点"
+	}
+	productID, _ := strconv.Atoi(c.PostForm("productID"))
+	if o.product, err = catalog.Get(productID, o.site.Key); err != nil {
+		return o, "该商品在所选站点不可购买"
+	}
+	if o.quantity, err = strconv.Atoi(c.PostForm("quantity")); err != nil || !pricing.ValidQuantity(o.quantity) {
+		return o, "无效的购买数量"
+	}
+	if o.openwebuiUserID, err = findOpenWebUIUser(o.session.Email, o.site); err != nil {
+		return o, accountErrorMessage(err, o.site)
+	}
+
+	if o.quote, err = pricing.QuoteOrder(o.product, o.quantity, nil, cards.MethodFor(o.product)); err != nil {
+		log.Printf("计算订单金额失败: %v", err)
+		return o, quoteErrorMessage(err)
+	}
+	return o, ""
+}
+
+// quickConfirmHandler 展示一键购买的金额明细, 用户确认后才会扣款
+func quickConfirmHandler(pubKey string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		o, message := readQuickOrder(c)
+		if message != "" {
+			renderQuickBuy(c, o.session, message)
+			return
+		}
+		c.HTML(http.StatusOK, "quick_confirm.html", gin.H{
+			"Session":           o.session,
+			"Card":              o.card,
+			"Product":           o.product,
+			"SiteType":          o.site.Key,
+			"SiteName":          o.site.Name,
+			"Quantity":          o.quantity,
+			"Quote":             o.quote,
+			"IdempotencyKey":    newIdempotencyKey(), // 每次打开确认页生成一次, 重复点击时复用同一个PaymentIntent
+			"STRIPE_PUBLIC_KEY": pubKey,
+		})
+	}
+}
+
+// quickBuyHandler 使用已保存的卡片以off-session方式扣款
+// 发卡行要求验证时返回requires_action, 由前端完成3DS验证后继续支付
+func quickBuyHandler(c *gin.Context) {
+	o, message := readQuickOrder(c)
+	if message != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": message}})
+		return
+	}
+	idempotencyKey := c.PostForm("idempotencyKey")
+	if len(idempotencyKey) > 64 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": "无效的请求"}})
+		return
+	}
+
+	if idempotencyKey != "" {
+		idempotencyKey = "quick-buy-" + idempotencyKey
+	}
+	pi, err := cards.CreateIntent(cards.Purchase{
+		Email:           o.session.Email,
+		CustomerID:      o.customerID,
+		Card:            o.card,
+		SiteType:        o.site.Key,
+		OpenWebUIUserID: o.openwebuiUserID,
+		Product:         o.product,
+		Quantity:        o.quantity,
+		Quote:           o.quote,
+		IdempotencyKey:  idempotencyKey,
+	})
+	if err != nil {
+		log.Printf("一键购买下单失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{"message": "创建订单失败，请稍后再试。"}})
+		return
+	}
+
+	pi, err = cards.ConfirmOffSession(pi)
+	if errors.Is(err, cards.ErrAuthenticationRequired) {
+		// 发卡行要求持卡人验证, PaymentIntent回到待支付状态, 由前端在用户在场时重新确认
+		log.Printf("一键购买需要持卡人验证: %s", pi.ID)
+		c.JSON(http.StatusOK, gin.H{
+			"status":        "requires_action",
+			"clientSecret":  pi.ClientSecret,
+			"paymentMethod": o.card.ID,
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("一键购买扣款失败 (%s): %v", pi.ID, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": "卡片扣款失败，请更换卡片或使用普通购买流程。"}})
+		return
+	}
+
+	switch pi.Status {
+	case payments.StatusSucceeded:
+		log.Printf("一键购买支付成功: %s", pi.ID)
+		if _, err := fulfillPayment(pi, database.OrderActorCheckout); err != nil {
+			// 订单已经支付, 成功页和Webhook会再次尝试发放
+			log.Printf("处理支付成功订单时出错 (%s): %v", pi.ID, err)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":   "succeeded",
+			"redirect": "/success?payment_intent=" + pi.ID + "&redirect_status=succeeded",
+		})
+	case payments.StatusPending:
+		// 需要持卡人验证或更换卡片, 由前端在用户在场时重新确认
+		c.JSON(http.StatusOK, gin.H{
+			"status":        "requires_action",
+			"clientSecret":  pi.ClientSecret,
+			"paymentMethod": o.card.ID,
+		})
+	case payments.StatusProcessing:
+		c.JSON(http.StatusOK, gin.H{"status": "processing"})
+	default:
+		log.Printf("一键购买的PaymentIntent状态异常: %s, %s", pi.ID, pi.RawStatus)
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"message": "支付失败，请重新下单。"}})
+	}
+}
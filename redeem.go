@@ -0,0 +1,51 @@
+package main
+
+import (
+	"breathaipay/vouchers"
+
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// redeemPageHandler 兑换码兑换页面
+func redeemPageHandler(c *gin.Context) {
+	c.HTML(http.StatusOK, "redeem.html", gin.H{
+		"Code":  c.Query("code"),
+		"Email": c.Query("email"),
+	})
+}
+
+// redeemHandler 兑换兑换码, 为邮箱对应的OpenWebUI账户增加积分
+func redeemHandler(c *gin.Context) {
+	code := c.PostForm("code")
+	email := c.PostForm("email")
+
+	result, err := vouchers.Redeem(code, email, c.ClientIP())
+	if err != nil {
+		c.HTML(http.StatusOK, "redeem.html", gin.H{
+			"Code":  code,
+			"Email": email,
+			"Error": voucherErrorMessage(err),
+		})
+		return
+	}
+
+	log.Printf("兑换码 %s 已兑换: %s 在站点 %s 增加 %d 积分", result.Voucher.Code, email, result.Voucher.SiteType, result.Voucher.Points)
+	c.HTML(http.StatusOK, "redeem.html", gin.H{
+		"Email":    email,
+		"Redeemed": result.Voucher,
+		"SiteName": siteName(result.Voucher.SiteType),
+		"Balance":  result.Change.After,
+	})
+}
+
+// voucherErrorMessage 兑换失败时展示给用户的提示
+func voucherErrorMessage(err error) string {
+	if vouchers.IsUserError(err) {
+		return err.Error()
+	}
+	log.Printf("兑换失败: %v", err)
+	return "暂时无法完成兑换，请稍后再试。"
+}
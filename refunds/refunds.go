@@ -0,0 +1,218 @@
+package refunds
+
+import (
+	"breathaipay/database"
+	"breathaipay/mail"
+	"breathaipay/money"
+	"breathaipay/openwebui"
+	"breathaipay/payments"
+	"breathaipay/sites"
+	"breathaipay/utils"
+
+	"errors"
+	"fmt"
+	"log"
+)
+
+// 退款来源, 与订单状态变更的来源一致
+const (
+	SourceWebhook = database.OrderActorWebhook
+	SourceAdmin   = database.OrderActorAdmin
+)
+
+// Create 通过订单的支付方发起退款, amount为0时全额退款, 随后按退款比例扣回积分
+func Create(orderID string, amount money.Money) error {
+	providerName := payments.ProviderStripe
+	if order, err := database.GetOrder(orderID); err == nil {
+		providerName = order.Provider
+	} else if !database.IsNotFound(err) {
+		return err
+	}
+	provider, err := payments.For(providerName)
+	if err != nil {
+		return err
+	}
+
+	// 支付方返回最新的累计退款金额, 与charge.refunded事件走同一套处理逻辑
+	r, err := provider.Refund(orderID, amount)
+	if err != nil {
+		return err
+	}
+	log.Printf("已发起退款 %s: %s订单=%s, Amount=%s", r.ID, provider.Name(), orderID, r.Amount)
+	return Apply(orderID, r.AmountPaid, r.AmountRefunded, SourceAdmin)
+}
+
+// ResolveOrderID 找到退款通知中的PaymentIntent对应的订单号
+// 订阅账单的发放任务以账单ID标识, 本地没有该PaymentIntent的订单时通过invoiceFor查询它支付的账单
+func ResolveOrderID(paymentIntentID string, invoiceFor func(paymentIntentID string) (string, error)) (string, error) {
+	if _, err := database.GetOrder(paymentIntentID); err == nil {
+		return paymentIntentID, nil
+	} else if !database.IsNotFound(err) {
+		return "", err
+	}
+	if _, err := database.GetFulfillmentJob(paymentIntentID); err == nil {
+		return paymentIntentID, nil
+	} else if !database.IsNotFound(err) {
+		return "", err
+	}
+
+	invoiceID, err := invoiceFor(paymentIntentID)
+	if err != nil {
+		return "", fmt.Errorf("查询PaymentIntent %s 对应的账单失败: %w", paymentIntentID, err)
+	}
+	if invoiceID == "" {
+		return paymentIntentID, nil
+	}
+	if _, err := database.GetSubscriptionInvoice(invoiceID); err != nil {
+		if database.IsNotFound(err) {
+			// 不是本程序发放过积分的账单
+			return paymentIntentID, nil
+		}
+		return "", err
+	}
+	return invoiceID, nil
+}
+
+// Apply 按累计退款金额占支付金额的比例扣回积分, 并更新订单状态
+// 同一订单多次调用是幂等的, 只会扣回新增退款对应的积分
+func Apply(paymentIntentID string, amountPaid int64, amountRefunded int64, source string) error {
+	if amountPaid <= 0 {
+		return fmt.Errorf("订单 %s 的支付金额无效", paymentIntentID)
+	}
+	// 同一订单的退款串行处理, Webhook与后台操作可能同时到达, 也可能由不同的实例处理
+	return database.WithLock("refund:"+paymentIntentID, func() error {
+		return apply(paymentIntentID, amountPaid, amountRefunded, source)
+	})
+}
+
+// apply 在订单的退款锁内计算应扣回的积分, 扣回后记录退款并更新订单状态
+func apply(paymentIntentID string, amountPaid int64, amountRefunded int64, source string) error {
+	status := database.OrderPartiallyRefunded
+	if amountRefunded >= amountPaid {
+		status = database.OrderRefunded
+	}
+
+	job, err := database.GetFulfillmentJob(paymentIntentID)
+	if err != nil {
+		if database.IsNotFound(err) {
+			// 订单没有发放过积分, 只需要更新状态
+			log.Printf("订单 %s 没有发放记录, 仅更新退款状态", paymentIntentID)
+			return updateStatus(paymentIntentID, status, source, amountRefunded)
+		}
+		return err
+	}
+
+	// 发放任务中的积分可能已被之前的退款减少过, 需要加回这部分再按比例计算
+	handled, fromJob, err := database.SumRefundedPoints(paymentIntentID)
+	if err != nil {
+		return err
+	}
+	totalPoints := job.Points + fromJob
+	target := totalPoints * min(amountRefunded, amountPaid) / amountPaid
+	points := target - handled
+	if points <= 0 {
+		log.Printf("订单 %s 的退款已处理过, 跳过", paymentIntentID)
+		return updateStatus(paymentIntentID, status, source, amountRefunded)
+	}
+
+	refund := database.Refund{
+		PaymentIntentID: paymentIntentID,
+		AmountRefunded:  amountRefunded,
+		Points:          points,
+		Source:          source,
+	}
+	switch job.Status {
+	case database.JobStatusSucceeded:
+		if err := deduct(job, refund); err != nil {
+			return err
+		}
+	case database.JobStatusPending, database.JobStatusDead:
+		if job.CreditStarted {
+			// 之前的尝试已经开始写入余额, 积分可能已经到账, 以积分流水为准
+			credited, err := database.HasLedgerEntry(paymentIntentID, job.Source)
+			if err != nil {
+				return err
+			}
+			if !credited {
+				mail.Alert("退款积分需要人工核对", fmt.Sprintf("订单 %s 退款时无法确认积分是否已经发放, 未扣回 %d 积分, 请核对用户余额后处理发放任务", paymentIntentID, points))
+				return updateStatus(paymentIntentID, status, source, amountRefunded)
+			}
+			if err := deduct(job, refund); err != nil {
+				return err
+			}
+			break
+		}
+		// 积分还没有发放, 直接从任务中扣除
+		ok, err := database.RefundFromJob(refund)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("发放任务状态已变化, 请稍后重试")
+		}
+		log.Printf("订单 %s 退款处理完成: 从发放任务中扣除 %d 积分", paymentIntentID, points)
+	default:
+		return errors.New("积分正在发放中, 请稍后重试")
+	}
+	return updateStatus(paymentIntentID, status, source, amountRefunded)
+}
+
+// updateStatus 将订单变更为退款状态, source同时作为状态变更的来源
+// 状态机不允许该变更(例如订单已经全额退款)或订单不存在时只记录日志
+func updateStatus(paymentIntentID string, status database.OrderStatus, source string, amountRefunded int64) error {
+	err := database.TransitionOrderStatus(paymentIntentID, status, source, fmt.Sprintf("累计退款金额 %d", amountRefunded))
+	if errors.Is(err, database.ErrIllegalTransition) || database.IsNotFound(err) {
+		log.Printf("订单 %s 未更新退款状态: %v", paymentIntentID, err)
+		return nil
+	}
+	return err
+}
+
+// deduct 从OpenWebUI用户余额中扣回积分, 与发放相同, 写入余额前先记录pending状态的退款, 扣回后与积分流水一起完成
+// 未开启REFUND_ALLOW_NEGATIVE_BALANCE时最多扣到0为止
+// 余额是否已经修改无法确认时发出告警并返回nil, 退款记录停留在pending状态, 不会因为重试而重复扣回
+func deduct(job database.FulfillmentJob, refund database.Refund) error {
+	site, ok := sites.Get(job.SiteType)
+	if !ok {
+		return fmt.Errorf("未知的站点类型: %s", job.SiteType)
+	}
+	refund.DeductedFrom = "user"
+	id, err := database.StartRefund(refund)
+	if err != nil {
+		return err
+	}
+
+	allowNegative := utils.GetEnvVariable("REFUND_ALLOW_NEGATIVE_BALANCE", "false") == "true"
+	reason := openwebui.Reason{
+		OrderID:     job.PaymentIntentID,
+		Source:      database.LedgerSourceRefund,
+		DeferLedger: true,
+	}
+	change, err := openwebui.DeductBalance(openwebui.Account{ID: job.OpenWebUIUserID, Email: job.Email}, refund.Points, site, allowNegative, reason)
+	if errors.Is(err, openwebui.ErrCreditUnknown) {
+		mail.Alert("退款积分需要人工核对", fmt.Sprintf("订单 %s 扣回 %d 积分时无法确认余额是否已经修改, 退款记录 %d 停留在pending状态, 请核对用户余额: %v",
+			job.PaymentIntentID, refund.Points, id, err))
+		return nil
+	}
+	if err != nil {
+		// 余额没有修改, 删除退款记录后可以安全地重试
+		if cancelErr := database.CancelRefund(id); cancelErr != nil {
+			log.Printf("删除退款记录失败 (%d): %v", id, cancelErr)
+		}
+		return err
+	}
+
+	var entry *database.LedgerEntry
+	if change.Delta != 0 {
+		e := openwebui.LedgerEntry(job.Email, site, change, reason)
+		entry = &e
+	}
+	if err := database.CompleteRefund(id, -change.Delta, entry); err != nil {
+		// 积分已经扣回, 退款记录停留在pending状态同样不会被重复扣回
+		mail.Alert("退款积分需要人工核对", fmt.Sprintf("订单 %s 已扣回 %d 积分, 但退款记录 %d 和积分流水写入失败: %v",
+			job.PaymentIntentID, -change.Delta, id, err))
+		return nil
+	}
+	log.Printf("订单 %s 退款处理完成: 应扣回 %d 积分, 实际扣回 %d 积分", job.PaymentIntentID, refund.Points, -change.Delta)
+	return nil
+}
@@ -0,0 +1,131 @@
+package refunds
+
+import (
+	"breathaipay/database"
+	"breathaipay/sites"
+
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+// fakeOpenWebUI 只有一个用户的OpenWebUI, 支持按ID读取和更新余额
+type fakeOpenWebUI struct {
+	mu     sync.Mutex
+	credit int64
+}
+
+func (f *fakeOpenWebUI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1/users/u1":
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1/users/u1/update":
+		var body struct {
+			Credit int64 `json:"credit"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.credit = body.Credit
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"id": "u1", "email": "a@b.c", "credit": f.credit})
+}
+
+func (f *fakeOpenWebUI) balance() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.credit
+}
+
+// setup 在临时目录中初始化SQLite数据库, 并把测试站点指向假的OpenWebUI
+func setup(t *testing.T, owui *fakeOpenWebUI) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	server := httptest.NewServer(owui)
+	t.Cleanup(server.Close)
+
+	config, err := json.Marshal([]sites.Site{{Key: "test", BaseURL: server.URL, TokenEnv: "TEST_OPENWEBUI_TOKEN", Enabled: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("sites.json", config, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SITES_CONFIG", "sites.json")
+	t.Setenv("TEST_OPENWEBUI_TOKEN", "token")
+	t.Setenv("DATABASE_URL", "")
+	if err := sites.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(database.CloseDb)
+}
+
+func TestApplyInvoiceRefund(t *testing.T) {
+	owui := &fakeOpenWebUI{credit: 1000}
+	setup(t, owui)
+
+	inv := database.SubscriptionInvoice{InvoiceID: "in_1", SubscriptionID: "sub_1", Points: 1000, BillingReason: "subscription_cycle"}
+	job := database.FulfillmentJob{OpenWebUIUserID: "u1", Email: "a@b.c", SiteType: "test"}
+	claimed, err := database.ClaimSubscriptionInvoice(inv, job)
+	if err != nil || !claimed {
+		t.Fatalf("ClaimSubscriptionInvoice = %v, %v", claimed, err)
+	}
+	if err := database.CompleteFulfillment("in_1", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// charge.refunded只带有PaymentIntent ID, 需要解析到账单
+	orderID, err := ResolveOrderID("pi_1", func(pi string) (string, error) {
+		if pi != "pi_1" {
+			t.Errorf("invoiceFor(%q), want pi_1", pi)
+		}
+		return "in_1", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orderID != "in_1" {
+		t.Fatalf("ResolveOrderID = %q, want in_1", orderID)
+	}
+
+	// 退款一半, 扣回一半积分; 重复的通知不会再次扣回
+	for range 2 {
+		if err := Apply(orderID, 2000, 1000, SourceWebhook); err != nil {
+			t.Fatal(err)
+		}
+		if got := owui.balance(); got != 500 {
+			t.Fatalf("balance = %d, want 500", got)
+		}
+	}
+	total, fromJob, err := database.SumRefundedPoints("in_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 500 || fromJob != 0 {
+		t.Fatalf("SumRefundedPoints = %d, %d, want 500, 0", total, fromJob)
+	}
+}
+
+func TestResolveOrderIDUnknownInvoice(t *testing.T) {
+	setup(t, &fakeOpenWebUI{})
+
+	// 不是本程序发放过积分的账单, 按PaymentIntent处理
+	orderID, err := ResolveOrderID("pi_2", func(string) (string, error) { return "in_unknown", nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orderID != "pi_2" {
+		t.Fatalf("ResolveOrderID = %q, want pi_2", orderID)
+	}
+}
@@ -0,0 +1,103 @@
+package sites
+
+import (
+	"breathaipay/utils"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Site 一个OpenWebUI实例
+type Site struct {
+	Key      string `json:"key"`       // 站点标识, 写入PaymentIntent元数据和订单, 上线后不要修改
+	Name     string `json:"name"`      // 展示给用户的名称
+	BaseURL  string `json:"base_url"`  // OpenWebUI地址, 如 https://chat.breathai.top
+	TokenEnv string `json:"token_env"` // 保存管理员JWT Token的环境变量名
+	Currency string `json:"currency"`  // 该站点使用的币种, 只有相同币种的商品可以在该站点购买
+	Enabled  bool   `json:"enabled"`   // 是否允许新订单选择该站点, 已有订单不受影响
+}
+
+// 未提供配置文件时使用的默认站点, 与旧版本硬编码的两个站点一致
+var defaultSites = []Site{
+	{Key: "international", Name: "国际站", BaseURL: "https://chat.breathai.top", TokenEnv: "OPENWEBUI_INTERNATIONAL_TOKEN", Currency: "cny", Enabled: true},
+	{Key: "domestic", Name: "国内站", BaseURL: "https://breath.yearnstudio.cn", TokenEnv: "OPENWEBUI_CHINESE_TOKEN", Currency: "cny", Enabled: false},
+}
+
+// 已加载的站点, 保持配置文件中的顺序
+var registry = defaultSites
+
+// Load 从SITES_CONFIG指定的JSON文件(默认sites.json)加载站点, 文件不存在时使用默认站点
+func Load() error {
+	path := utils.GetEnvVariable("SITES_CONFIG", "sites.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			log.Printf("未找到站点配置文件 %s, 使用默认站点", path)
+			registry = defaultSites
+			return nil
+		}
+		return err
+	}
+
+	var loaded []Site
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("解析站点配置文件 %s 失败: %w", path, err)
+	}
+	seen := make(map[string]bool)
+	for i, site := range loaded {
+		if site.Key == "" || site.BaseURL == "" || site.TokenEnv == "" {
+			return fmt.Errorf("站点配置第 %d 项缺少key、base_url或token_env", i+1)
+		}
+		if seen[site.Key] {
+			return fmt.Errorf("站点标识重复: %s", site.Key)
+		}
+		seen[site.Key] = true
+		loaded[i].BaseURL = strings.TrimRight(site.BaseURL, "/")
+		loaded[i].Currency = strings.ToLower(site.Currency)
+		if loaded[i].Currency == "" {
+			loaded[i].Currency = "cny"
+		}
+		if loaded[i].Name == "" {
+			loaded[i].Name = site.Key
+		}
+	}
+	registry = loaded
+	log.Printf("已加载 %d 个站点", len(registry))
+	return nil
+}
+
+// Get 按标识获取站点, 包括已停用的站点, 用于处理已有订单
+func Get(key string) (Site, bool) {
+	for _, site := range registry {
+		if site.Key == key {
+			return site, true
+		}
+	}
+	return Site{}, false
+}
+
+// GetEnabled 按标识获取允许下单的站点
+func GetEnabled(key string) (Site, bool) {
+	site, ok := Get(key)
+	return site, ok && site.Enabled
+}
+
+// Enabled 返回所有允许下单的站点
+func Enabled() []Site {
+	var enabled []Site
+	for _, site := range registry {
+		if site.Enabled {
+			enabled = append(enabled, site)
+		}
+	}
+	return enabled
+}
+
+// Token 读取站点的管理员Token
+func (s Site) Token() string {
+	return utils.GetEnvVariable(s.TokenEnv, "")
+}
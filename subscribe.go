@@ -0,0 +1,228 @@
+package main
+
+import (
+	"breathaipay/database"
+	"breathaipay/payments"
+	"breathaipay/sites"
+	"breathaipay/subscriptions"
+
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// subscribePageHandler 订阅套餐选择页面
+func subscribePageHandler(c *gin.Context) {
+	renderSubscribePage(c, "")
+}
+
+// renderSubscribePage 展示所有可订阅的套餐
+func renderSubscribePage(c *gin.Context, message string) {
+	plans, err := subscriptions.Plans("")
+	if err != nil {
+		log.Printf("获取订阅套餐失败: %v", err)
+	}
+	c.HTML(http.StatusOK, "subscribe.html", gin.H{
+		"Plans":    plans,
+		"Sites":    sites.Enabled(),
+		"PlanID":   c.PostForm("planID"),
+		"SiteType": c.PostForm("siteType"),
+		"Email":    c.PostForm("email"),
+		"Error":    message,
+	})
+}
+
+// subscribeCheckoutHandler 校验订阅信息并展示付款页
+func subscribeCheckoutHandler(pubKey string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		plan, site, email, message := subscriptionForm(c)
+		if message != "" {
+			renderSubscribePage(c, message)
+			return
+		}
+
+		c.HTML(http.StatusOK, "subscribe_payment.html", gin.H{
+			"Plan":              plan,
+			"SiteType":          site.Key,
+			"SiteName":          site.Name,
+			"Email":             email,
+			"IdempotencyKey":    newIdempotencyKey(), // 每次打开付款页生成一次, 重复提交时复用同一个订阅
+			"STRIPE_PUBLIC_KEY": pubKey,
+		})
+	}
+}
+
+// createSubscriptionHandler 创建订阅并返回首期账单的client secret
+func createSubscriptionHandler(c *gin.Context) {
+	plan, site, email, message := subscriptionForm(c)
+	if message != "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"message": message,
+			},
+		})
+		return
+	}
+
+	idempotencyKey := c.PostForm("idempotencyKey")
+	if len(idempotencyKey) > 64 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"message": "无效的请求",
+			},
+		})
+		return
+	}
+
+	sub, err := subscriptions.Create(plan, email, site, idempotencyKey)
+	if err != nil {
+		log.Printf("创建订阅失败 (%s, 套餐 %d): %v", email, plan.ID, err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{
+				"message": subscriptionErrorMessage(err),
+			},
+		})
+		return
+	}
+
+	// 支付完成后跳转到带签名的成功页, 用户可以在该页直接管理订阅
+	log.Printf("订阅已创建: %s (%s, 套餐 %d)", sub.ID, email, plan.ID)
+	c.JSON(http.StatusOK, gin.H{
+		"clientSecret": sub.ClientSecret,
+		"returnURL":    "/subscription/success?id=" + sub.ID + "&token=" + subscriptions.ManageToken(sub.ID),
+	})
+}
+
+// subscriptionForm 读取并校验订阅表单, 站点需允许下单且邮箱在该站点上已注册
+// 校验失败时返回展示给用户的提示
+func subscriptionForm(c *gin.Context) (subscriptions.Plan, sites.Site, string, string) {
+	email := c.PostForm("email")
+	site, ok := sites.GetEnabled(c.PostForm("siteType"))
+	if !ok {
+		return subscriptions.Plan{}, site, email, "无效的站点"
+	}
+	planID, _ := strconv.Atoi(c.PostForm("planID"))
+	plan, err := subscriptions.GetPlan(planID, site.Key)
+	if err != nil {
+		return plan, site, email, subscriptionErrorMessage(err)
+	}
+	if _, err := findOpenWebUIUser(email, site); err != nil {
+		return plan, site, email, accountErrorMessage(err, site)
+	}
+	return plan, site, email, ""
+}
+
+// subscriptionErrorMessage 订阅失败时展示给用户的提示
+func subscriptionErrorMessage(err error) string {
+	if subscriptions.IsUserError(err) {
+		return err.Error()
+	}
+	log.Printf("处理订阅失败: %v", err)
+	return "暂时无法处理订阅，请稍后再试。"
+}
+
+// subscriptionSuccessHandler 首期账单支付后的跳转页面
+// 与订单的成功页一样主动检查账单, 不必等待Webhook即可发放首期积分
+func subscriptionSuccessHandler(c *gin.Context) {
+	id := c.Query("id")
+	if !subscriptions.VerifyManageToken(id, c.Query("token")) {
+		c.String(http.StatusForbidden, "链接无效")
+		return
+	}
+	sub, err := payments.Stripe().GetSubscription(id)
+	if err != nil {
+		log.Printf("获取订阅失败 (%s): %v", id, err)
+		c.String(http.StatusInternalServerError, "无法验证订阅状态，请联系客服。")
+		return
+	}
+	if err := subscriptions.Sync(sub); err != nil {
+		log.Printf("同步订阅状态失败 (%s): %v", sub.ID, err)
+	}
+	if inv := sub.LatestInvoice; inv != nil && inv.Paid {
+		if _, err := subscriptions.GrantInvoice(*inv); err != nil {
+			// Webhook会继续重试发放, 这里只记录日志
+			log.Printf("发放订阅账单积分失败 (%s): %v", inv.ID, err)
+		}
+	}
+
+	record, err := database.GetSubscription(sub.ID)
+	if err != nil {
+		log.Printf("获取订阅记录失败 (%s): %v", sub.ID, err)
+		c.String(http.StatusBadRequest, "订阅不存在。")
+		return
+	}
+	renderSubscriptionManage(c, record, "")
+}
+
+// subscriptionManageHandler 通过签名链接查看订阅
+func subscriptionManageHandler(c *gin.Context) {
+	record, ok := manageableSubscription(c, c.Query("id"), c.Query("token"))
+	if !ok {
+		return
+	}
+	renderSubscriptionManage(c, record, "")
+}
+
+// subscriptionManageActionHandler 通过签名链接取消或恢复订阅
+func subscriptionManageActionHandler(c *gin.Context) {
+	record, ok := manageableSubscription(c, c.PostForm("id"), c.PostForm("token"))
+	if !ok {
+		return
+	}
+
+	var err error
+	switch c.PostForm("action") {
+	case "cancel":
+		record, err = subscriptions.Cancel(record.ID)
+	case "resume":
+		record, err = subscriptions.Resume(record.ID)
+	default:
+		c.String(http.StatusBadRequest, "无效的操作")
+		return
+	}
+	if err != nil {
+		log.Printf("修改订阅失败 (%s): %v", c.PostForm("id"), err)
+		message := "暂时无法修改订阅，请稍后再试。"
+		if subscriptions.IsUserError(err) {
+			message = err.Error()
+		}
+		record, _ = database.GetSubscription(c.PostForm("id"))
+		renderSubscriptionManage(c, record, message)
+		return
+	}
+	log.Printf("用户修改了订阅 %s: %s", record.ID, c.PostForm("action"))
+	renderSubscriptionManage(c, record, "")
+}
+
+// manageableSubscription 校验管理链接并读取订阅, 失败时已经写入响应
+func manageableSubscription(c *gin.Context, id string, token string) (subscriptions.Subscription, bool) {
+	if !subscriptions.VerifyManageToken(id, token) {
+		c.String(http.StatusForbidden, "链接无效")
+		return subscriptions.Subscription{}, false
+	}
+	record, err := database.GetSubscription(id)
+	if err != nil {
+		log.Printf("获取订阅记录失败 (%s): %v", id, err)
+		c.String(http.StatusNotFound, "订阅不存在")
+		return subscriptions.Subscription{}, false
+	}
+	return record, true
+}
+
+// renderSubscriptionManage 展示订阅状态及取消、恢复按钮
+func renderSubscriptionManage(c *gin.Context, record subscriptions.Subscription, message string) {
+	plan, err := database.GetSubscriptionPlan(record.PlanID)
+	if err != nil {
+		log.Printf("获取订阅套餐失败 (%d): %v", record.PlanID, err)
+	}
+	c.HTML(http.StatusOK, "subscription.html", gin.H{
+		"Subscription": record,
+		"Plan":         plan,
+		"SiteName":     siteName(record.SiteType),
+		"Token":        subscriptions.ManageToken(record.ID),
+		"ManageURL":    subscriptions.ManageURL(record.ID),
+		"Error":        message,
+	})
+}
@@ -0,0 +1,321 @@
+package subscriptions
+
+import (
+	"breathaipay/database"
+	"breathaipay/fulfillment"
+	"breathaipay/mail"
+	"breathaipay/payments"
+	"breathaipay/sites"
+	"breathaipay/utils"
+
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Plan 订阅套餐, 数据保存在数据库的subscription_plans表中
+type Plan = database.SubscriptionPlan
+
+// Subscription 客户的订阅, 数据保存在数据库的subscriptions表中
+type Subscription = database.Subscription
+
+// 管理链接签名的用途
+const linkPurpose = "subscription"
+
+var (
+	ErrPlanNotFound = errors.New("订阅套餐不存在或已停用")
+	ErrAlreadyExist = errors.New("该邮箱在所选站点上已有生效中的订阅")
+	ErrNotActive    = errors.New("订阅已结束, 无法修改")
+)
+
+// Plans 返回指定站点可订阅的套餐, site为空时返回在任一启用站点可订阅的套餐
+func Plans(site string) ([]Plan, error) {
+	plans, err := database.ListSubscriptionPlans()
+	if err != nil {
+		return nil, err
+	}
+	available := make([]Plan, 0, len(plans))
+	for _, p := range plans {
+		if (site == "" && len(SitesFor(p)) > 0) || (site != "" && AvailableOn(p, site)) {
+			available = append(available, p)
+		}
+	}
+	return available, nil
+}
+
+// GetPlan 按ID获取启用的套餐, 并校验所选站点是否可订阅
+func GetPlan(id int, site string) (Plan, error) {
+	p, err := database.GetSubscriptionPlan(id)
+	if err != nil {
+		if database.IsNotFound(err) {
+			return Plan{}, ErrPlanNotFound
+		}
+		return Plan{}, err
+	}
+	if !p.Active || !AvailableOn(p, site) {
+		return Plan{}, ErrPlanNotFound
+	}
+	return p, nil
+}
+
+// AvailableOn 判断套餐是否可以在指定站点订阅, 规则与商品相同
+func AvailableOn(p Plan, siteKey string) bool {
+	if len(p.Sites) > 0 && !slices.Contains(p.Sites, siteKey) {
+		return false
+	}
+	site, ok := sites.Get(siteKey)
+	return ok && site.Currency == p.Currency
+}
+
+// SitesFor 返回可以订阅该套餐的所有启用站点
+func SitesFor(p Plan) []sites.Site {
+	var available []sites.Site
+	for _, site := range sites.Enabled() {
+		if AvailableOn(p, site.Key) {
+			available = append(available, site)
+		}
+	}
+	return available
+}
+
+// live 订阅是否仍在生效或等待付款, 这些订阅会继续产生账单
+func live(status string) bool {
+	switch payments.SubscriptionStatus(status) {
+	case payments.SubscriptionActive, payments.SubscriptionTrialing, payments.SubscriptionPastDue,
+		payments.SubscriptionUnpaid, payments.SubscriptionPaused:
+		return true
+	}
+	return false
+}
+
+// ended 订阅是否已经结束, 结束后的订阅不能恢复
+func ended(status string) bool {
+	return status == string(payments.SubscriptionCanceled) || status == string(payments.SubscriptionIncompleteExpired)
+}
+
+// Create 为email在站点上创建一个订阅, 首期账单等待用户在付款页完成支付
+// 返回订阅和首期账单的client secret, 之后每期由Stripe自动扣款
+// 相同idempotencyKey的重复请求由Stripe返回同一个订阅
+func Create(plan Plan, email string, site sites.Site, idempotencyKey string) (payments.Subscription, error) {
+	existing, err := database.ListSubscriptions(email, 100, 0)
+	if err != nil {
+		return payments.Subscription{}, err
+	}
+	for _, sub := range existing {
+		if sub.Email == email && sub.SiteType == site.Key && live(sub.Status) {
+			return payments.Subscription{}, ErrAlreadyExist
+		}
+	}
+
+	customerID, err := database.GetCustomerId(email)
+	if err != nil {
+		return payments.Subscription{}, fmt.Errorf("获取客户失败: %w", err)
+	}
+
+	sub, err := payments.Stripe().CreateSubscription(payments.SubscriptionParams{
+		CustomerID: customerID,
+		PriceID:    plan.StripePriceID,
+		Metadata: map[string]string{
+			"email":    email,
+			"sitetype": site.Key,
+			"plan_id":  strconv.Itoa(plan.ID),
+		},
+		IdempotencyKey: idempotencyKey,
+	})
+	if err != nil {
+		return payments.Subscription{}, err
+	}
+	if err := database.SaveSubscription(fromStripe(sub, Subscription{
+		CustomerID: customerID,
+		Email:      email,
+		SiteType:   site.Key,
+		PlanID:     plan.ID,
+	})); err != nil {
+		return payments.Subscription{}, fmt.Errorf("记录订阅失败: %w", err)
+	}
+
+	if sub.ClientSecret == "" {
+		return payments.Subscription{}, fmt.Errorf("订阅 %s 的首期账单没有待支付的款项", sub.ID)
+	}
+	return sub, nil
+}
+
+// fromStripe 用Stripe订阅的最新状态更新本地记录
+func fromStripe(sub payments.Subscription, local Subscription) Subscription {
+	local.ID = sub.ID
+	local.Status = string(sub.Status)
+	local.CancelAtPeriodEnd = sub.CancelAtPeriodEnd
+	if !sub.CurrentPeriodEnd.IsZero() {
+		local.CurrentPeriodEnd = sub.CurrentPeriodEnd
+	}
+	return local
+}
+
+// local 查询本地订阅记录, 不存在时从Stripe订阅的元数据中恢复
+// 返回false表示订阅不是由本程序创建的
+func local(sub payments.Subscription) (Subscription, bool, error) {
+	record, err := database.GetSubscription(sub.ID)
+	if err == nil {
+		return record, true, nil
+	}
+	if !database.IsNotFound(err) {
+		return Subscription{}, false, err
+	}
+	planID, _ := strconv.Atoi(sub.Metadata["plan_id"])
+	if planID == 0 || sub.Metadata["email"] == "" || sub.Metadata["sitetype"] == "" {
+		return Subscription{}, false, nil
+	}
+	record = Subscription{
+		Email:    sub.Metadata["email"],
+		SiteType: sub.Metadata["sitetype"],
+		PlanID:   planID,
+	}
+	record.CustomerID = sub.CustomerID
+	return record, true, nil
+}
+
+// Sync 将Stripe推送的订阅状态写入本地记录, 忽略不是由本程序创建的订阅
+func Sync(sub payments.Subscription) error {
+	record, ok, err := local(sub)
+	if err != nil || !ok {
+		return err
+	}
+	// 已结束的订阅不会再变化, 忽略乱序到达的旧事件
+	if record.ID != "" && ended(record.Status) {
+		return nil
+	}
+	return database.SaveSubscription(fromStripe(sub, record))
+}
+
+// Cancel 在当前计费周期结束时取消订阅, 已发放的积分不受影响
+func Cancel(id string) (Subscription, error) {
+	return setCancelAtPeriodEnd(id, true)
+}
+
+// Resume 撤销尚未生效的取消, 订阅继续自动续费
+func Resume(id string) (Subscription, error) {
+	return setCancelAtPeriodEnd(id, false)
+}
+
+// setCancelAtPeriodEnd 修改订阅是否在周期结束时取消, 并同步本地记录
+func setCancelAtPeriodEnd(id string, cancel bool) (Subscription, error) {
+	record, err := database.GetSubscription(id)
+	if err != nil {
+		return Subscription{}, err
+	}
+	if !live(record.Status) {
+		return Subscription{}, ErrNotActive
+	}
+	sub, err := payments.Stripe().SetCancelAtPeriodEnd(id, cancel)
+	if err != nil {
+		return Subscription{}, err
+	}
+	record = fromStripe(sub, record)
+	if err := database.SaveSubscription(record); err != nil {
+		return Subscription{}, err
+	}
+	return record, nil
+}
+
+// GrantInvoice 将一张已支付的订阅账单加入积分发放队列, 由队列发放套餐积分并发送到账邮件, 同一账单只会发放一次
+// 返回false表示账单不需要发放或已经处理过; 返回错误时没有写入任何记录, 可以重试
+func GrantInvoice(inv payments.Invoice) (bool, error) {
+	if !inv.Paid || inv.SubscriptionID == "" {
+		return false, nil
+	}
+	// 只有首期和每期续费发放积分, 本项目不修改订阅, 不会产生其他类型的账单
+	if inv.BillingReason != payments.BillingReasonSubscriptionCreate &&
+		inv.BillingReason != payments.BillingReasonSubscriptionCycle {
+		log.Printf("订阅账单 %s 的类型为 %s, 不发放积分", inv.ID, inv.BillingReason)
+		return false, nil
+	}
+
+	sub := payments.Subscription{ID: inv.SubscriptionID, CustomerID: inv.CustomerID, Metadata: inv.Metadata}
+	record, ok, err := local(sub)
+	if err != nil || !ok {
+		if err == nil {
+			log.Printf("订阅 %s 不是由本程序创建的, 跳过账单 %s", sub.ID, inv.ID)
+		}
+		return false, err
+	}
+	if record.ID == "" {
+		// 本地没有记录时补写, 以便之后的状态同步
+		record.ID = sub.ID
+		record.Status = string(payments.SubscriptionActive)
+		if err := database.SaveSubscription(record); err != nil {
+			return false, err
+		}
+	}
+
+	plan, err := database.GetSubscriptionPlan(record.PlanID)
+	if err != nil {
+		return false, fmt.Errorf("获取订阅套餐 %d 失败: %w", record.PlanID, err)
+	}
+	// 已停用的套餐对已有订阅仍然有效, 站点同样不受是否允许新订单影响
+	site, ok := sites.Get(record.SiteType)
+	if !ok {
+		return false, fmt.Errorf("未知的站点类型: %s", record.SiteType)
+	}
+
+	// 账单的认领与发放任务在同一事务中写入, 发放失败时按队列的规则重试
+	queued, err := fulfillment.EnqueueInvoice(database.SubscriptionInvoice{
+		InvoiceID:      inv.ID,
+		SubscriptionID: sub.ID,
+		Points:         plan.Points,
+		BillingReason:  inv.BillingReason,
+	}, record.Email, site.Key)
+	if err != nil || !queued {
+		return false, err
+	}
+	log.Printf("订阅 %s 的账单 %s 已加入发放队列, %d 积分", sub.ID, inv.ID, plan.Points)
+	return true, nil
+}
+
+// SendReceipt 订阅账单的积分到账后发送邮件, 首期账单附带订阅管理链接, 由发放队列调用
+func SendReceipt(job database.FulfillmentJob) {
+	log.Printf("订阅账单 %s 已发放 %d 积分", job.PaymentIntentID, job.Points)
+	inv, err := database.GetSubscriptionInvoice(job.PaymentIntentID)
+	if err != nil {
+		log.Printf("获取订阅账单失败 (%s): %v", job.PaymentIntentID, err)
+		return
+	}
+	planName := "套餐"
+	if record, err := database.GetSubscription(inv.SubscriptionID); err == nil {
+		if plan, err := database.GetSubscriptionPlan(record.PlanID); err == nil {
+			planName = plan.Name
+		}
+	}
+
+	body := fmt.Sprintf("您好,尊敬的灵息用户 %s , 您订阅的%s本期 %d 积分已到账", job.Email, planName, job.Points)
+	// 未配置PUBLIC_BASE_URL时链接为相对路径, 不放入邮件
+	if link := ManageURL(inv.SubscriptionID); inv.BillingReason == payments.BillingReasonSubscriptionCreate && utils.LinksEnabled() && strings.HasPrefix(link, "http") {
+		body += fmt.Sprintf("<br>如需取消或恢复自动续费, 请访问: %s", link)
+	}
+	body += "<br><br>灵息.com 自动邮件<br>请勿回复"
+	if err := mail.NewMailer().SendMail([]string{job.Email}, "订阅积分已到账", body, "text/html"); err != nil {
+		log.Printf("发送订阅到账邮件失败 (%s): %v", job.Email, err)
+	}
+}
+
+// ManageToken 订阅管理链接的签名
+func ManageToken(id string) string {
+	return utils.SignLink(linkPurpose, id)
+}
+
+// ManageURL 订阅管理页的链接, 持有链接即可取消或恢复订阅
+func ManageURL(id string) string {
+	return utils.PublicURL("/subscription/manage?id=" + id + "&token=" + ManageToken(id))
+}
+
+// VerifyManageToken 校验管理链接中的签名
+func VerifyManageToken(id string, token string) bool {
+	return id != "" && utils.VerifyLink(linkPurpose, id, token)
+}
+
+// IsUserError 判断错误是否为可以直接展示给用户的订阅错误
+func IsUserError(err error) bool {
+	return errors.Is(err, ErrPlanNotFound) || errors.Is(err, ErrAlreadyExist) || errors.Is(err, ErrNotActive)
+}
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// LinksEnabled 是否配置了LINK_SECRET, 未配置时一键购买、自动充值和订阅管理的链接都不可用
+func LinksEnabled() bool {
+	return GetEnvVariable("LINK_SECRET", "") != ""
+}
+
+// SignLink 为发给用户的链接生成签名, purpose区分链接用途, 同一个value在不同用途下的签名不同
+// 密钥为LINK_SECRET, 未配置时返回空字符串, 更换密钥后已发出的链接全部失效
+func SignLink(purpose string, value string) string {
+	secret := GetEnvVariable("LINK_SECRET", "")
+	if secret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(purpose + ":" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyLink 校验SignLink生成的签名, 未配置LINK_SECRET时总是失败
+func VerifyLink(purpose string, value string, token string) bool {
+	signature := SignLink(purpose, value)
+	return signature != "" && hmac.Equal([]byte(signature), []byte(strings.ToLower(token)))
+}
+
+// PublicURL 拼接对外访问的完整地址, 未配置PUBLIC_BASE_URL时返回相对路径
+func PublicURL(path string) string {
+	return strings.TrimRight(GetEnvVariable("PUBLIC_BASE_URL", ""), "/") + path
+}
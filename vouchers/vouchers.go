@@ -0,0 +1,220 @@
+package vouchers
+
+import (
+	"breathaipay/database"
+	"breathaipay/mail"
+	"breathaipay/openwebui"
+	"breathaipay/sites"
+	"breathaipay/utils"
+
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Voucher 兑换码, 数据保存在数据库的vouchers表中
+type Voucher = database.Voucher
+
+// 兑换码字符集, 去掉了容易混淆的0/O/1/I
+const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// 兑换码由4组4个字符组成, 例如 ABCD-EFGH-JKLM-NPQR
+const (
+	groups    = 4
+	groupSize = 4
+)
+
+// 统计失败次数的时间窗口
+const failureWindow = 15 * time.Minute
+
+// 兑换失败的原因, 错误信息会直接展示给用户
+var (
+	ErrNotFound        = errors.New("兑换码不存在")
+	ErrExpired         = errors.New("兑换码已过期")
+	ErrAlreadyRedeemed = errors.New("兑换码已被使用")
+	ErrRateLimited     = errors.New("尝试次数过多, 请稍后再试")
+	ErrUserNotFound    = errors.New("未找到使用该邮箱注册的用户")
+)
+
+// Result 一次成功的兑换
+type Result struct {
+	Voucher Voucher
+	Change  openwebui.BalanceChange
+}
+
+// Normalize 兑换码不区分大小写, 允许省略或使用空格代替分隔符
+func Normalize(code string) string {
+	code = strings.ToUpper(code)
+	var b strings.Builder
+	for _, r := range code {
+		if strings.ContainsRune(alphabet, r) {
+			b.WriteRune(r)
+		}
+	}
+	raw := b.String()
+	if len(raw) != groups*groupSize {
+		return strings.TrimSpace(code)
+	}
+	parts := make([]string, 0, groups)
+	for i := 0; i < len(raw); i += groupSize {
+		parts = append(parts, raw[i:i+groupSize])
+	}
+	return strings.Join(parts, "-")
+}
+
+// newCode 使用crypto/rand生成一个兑换码
+func newCode() (string, error) {
+	buf := make([]byte, groups*groupSize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	// 256可以被字符集长度32整除, 取模不会产生偏差
+	raw := make([]byte, len(buf))
+	for i, v := range buf {
+		raw[i] = alphabet[int(v)%len(alphabet)]
+	}
+	return Normalize(string(raw)), nil
+}
+
+// Generate 为站点siteKey生成count个面值为points的兑换码并写入数据库
+// expiresAt为零值表示永不过期
+func Generate(count int, points int64, siteKey string, expiresAt time.Time, note string) ([]string, error) {
+	if count <= 0 || count > 1000 {
+		return nil, errors.New("生成数量必须在1到1000之间")
+	}
+	if points <= 0 {
+		return nil, errors.New("积分必须大于0")
+	}
+	if _, ok := sites.Get(siteKey); !ok {
+		return nil, fmt.Errorf("站点 %s 不存在", siteKey)
+	}
+
+	codes := make([]string, 0, count)
+	batch := make([]Voucher, 0, count)
+	seen := make(map[string]bool, count)
+	for len(codes) < count {
+		code, err := newCode()
+		if err != nil {
+			return nil, err
+		}
+		if seen[code] {
+			continue
+		}
+		seen[code] = true
+		codes = append(codes, code)
+		batch = append(batch, Voucher{Code: code, Points: points, SiteType: siteKey, ExpiresAt: expiresAt, Note: note})
+	}
+	if err := database.CreateVouchers(batch); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// maxFailures 时间窗口内同一IP或同一邮箱允许的失败次数
+func maxFailures() int {
+	n, err := strconv.Atoi(utils.GetEnvVariable("REDEEM_MAX_FAILURES", "10"))
+	if err != nil || n <= 0 {
+		return 10
+	}
+	return n
+}
+
+// Redeem 将兑换码的积分增加到email在对应站点上的账户, 每个兑换码只能成功兑换一次
+// 每次尝试都会写入voucher_attempts, 失败次数过多的IP或邮箱会被暂时拒绝
+func Redeem(code string, email string, ip string) (Result, error) {
+	code = Normalize(code)
+	email = strings.TrimSpace(email)
+	attempt := database.VoucherAttempt{Code: code, Email: email, IP: ip}
+
+	result, outcome, err := redeem(code, email, ip)
+	attempt.Outcome = outcome
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	if err := database.RecordVoucherAttempt(attempt); err != nil {
+		log.Printf("写入兑换记录失败 (%s, %s): %v", code, email, err)
+	}
+	return result, err
+}
+
+// redeem 完成兑换并返回写入兑换记录的结果
+func redeem(code string, email string, ip string) (Result, string, error) {
+	byIP, byEmail, err := database.CountFailedVoucherAttempts(ip, email, time.Now().Add(-failureWindow))
+	if err != nil {
+		return Result{}, database.VoucherOutcomeError, err
+	}
+	if limit := maxFailures(); byIP >= limit || byEmail >= limit {
+		return Result{}, database.VoucherOutcomeRateLimited, ErrRateLimited
+	}
+
+	v, err := database.GetVoucher(code)
+	if err != nil {
+		if database.IsNotFound(err) {
+			return Result{}, database.VoucherOutcomeNotFound, ErrNotFound
+		}
+		return Result{}, database.VoucherOutcomeError, err
+	}
+	switch v.Status {
+	case database.VoucherStatusActive:
+	case database.VoucherStatusDisabled:
+		return Result{}, database.VoucherOutcomeNotFound, ErrNotFound
+	default:
+		return Result{}, database.VoucherOutcomeAlreadyRedeemed, ErrAlreadyRedeemed
+	}
+	if !v.ExpiresAt.IsZero() && time.Now().After(v.ExpiresAt) {
+		return Result{}, database.VoucherOutcomeExpired, ErrExpired
+	}
+
+	// 已经发出的兑换码不受站点是否允许新订单影响
+	site, ok := sites.Get(v.SiteType)
+	if !ok {
+		return Result{}, database.VoucherOutcomeError, fmt.Errorf("兑换码对应的站点 %s 不可用", v.SiteType)
+	}
+	// 先确认用户存在, 避免认领兑换码后才发现无法增加积分
+	if _, err := openwebui.FindUser(email, site); err != nil {
+		if errors.Is(err, openwebui.ErrUserNotFound) {
+			return Result{}, database.VoucherOutcomeUserNotFound, ErrUserNotFound
+		}
+		return Result{}, database.VoucherOutcomeError, err
+	}
+
+	// 认领以状态为条件, 同一兑换码的并发兑换只有一个能继续
+	claimed, err := database.ClaimVoucher(code, email, time.Now())
+	if err != nil {
+		return Result{}, database.VoucherOutcomeError, err
+	}
+	if !claimed {
+		return Result{}, database.VoucherOutcomeAlreadyRedeemed, ErrAlreadyRedeemed
+	}
+
+	change, err := openwebui.AddBalance(openwebui.Account{Email: email}, v.Points, site, openwebui.Reason{OrderID: code, Source: database.LedgerSourceVoucher})
+	if errors.Is(err, openwebui.ErrCreditUnknown) {
+		// 余额可能已经写入, 兑换码停留在redeeming状态, 不能再次兑换, 由人工核对
+		mail.Alert("兑换码需要人工核对", fmt.Sprintf("兑换码 %s (%s) 增加 %d 积分时无法确认余额是否已经修改, 兑换码停留在redeeming状态: %v", code, email, v.Points, err))
+		return Result{}, database.VoucherOutcomeError, err
+	}
+	if err != nil {
+		// 余额没有写入, 恢复兑换码以便用户重试
+		if err := database.ReleaseVoucher(code); err != nil {
+			log.Printf("[告警] 恢复兑换码 %s 失败, 需要人工处理: %v", code, err)
+		}
+		return Result{}, database.VoucherOutcomeError, err
+	}
+	// 积分已经增加, 标记失败时兑换码停留在redeeming状态, 不会被再次兑换
+	if err := database.CompleteVoucher(code, change.UserID); err != nil {
+		log.Printf("[告警] 兑换码 %s 已增加积分但标记为已兑换失败: %v", code, err)
+	}
+	v.Status = database.VoucherStatusRedeemed
+	v.RedeemedEmail = email
+	return Result{Voucher: v, Change: change}, database.VoucherOutcomeRedeemed, nil
+}
+
+// IsUserError 判断错误是否为可以直接展示给用户的兑换错误
+func IsUserError(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, ErrExpired) || errors.Is(err, ErrAlreadyRedeemed) ||
+		errors.Is(err, ErrRateLimited) || errors.Is(err, ErrUserNotFound)
+}
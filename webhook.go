@@ -0,0 +1,186 @@
+package main
+
+import (
+	"breathaipay/database"
+	"breathaipay/payments"
+	"breathaipay/refunds"
+	"breathaipay/subscriptions"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v84"
+)
+
+// Webhook请求体的最大长度, 带有较多明细的账单、Checkout Session事件可能超过64KB
+const maxWebhookBodyBytes = 1 << 20
+
+// readWebhookBody 读取Webhook请求体, 超过长度上限时返回错误而不是截断, 截断后签名必然校验失败
+func readWebhookBody(c *gin.Context) ([]byte, error) {
+	payload, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxWebhookBodyBytes))
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return nil, fmt.Errorf("请求体超过 %d 字节", maxErr.Limit)
+	}
+	return payload, err
+}
+
+// stripeWebhookHandler 处理Stripe推送的事件
+// 返回非2xx状态码时Stripe会自动重试, 因此只有在可以重试的错误上才返回500
+func stripeWebhookHandler(c *gin.Context) {
+	payload, err := readWebhookBody(c)
+	if err != nil {
+		// 返回503让Stripe稍后重试, 以便在事件过期前调整长度上限
+		log.Printf("读取Webhook请求体失败: %v", err)
+		c.Status(http.StatusServiceUnavailable)
+		return
+	}
+
+	// 由Stripe支付方校验签名, PaymentIntent事件同时解析为统一的支付信息
+	event, err := payments.Stripe().VerifyNotification(c.Request.Header, payload)
+	if err != nil {
+		log.Printf("Webhook签名校验失败: %v", err)
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	switch eventType := stripe.EventType(event.Type); eventType {
+	case stripe.EventTypePaymentIntentSucceeded,
+		stripe.EventTypePaymentIntentCanceled,
+		stripe.EventTypePaymentIntentPaymentFailed:
+		if err := handlePaymentIntentEvent(eventType, event.Payment); err != nil {
+			log.Printf("处理Webhook事件失败 (%s, %s): %v", event.Type, event.Payment.ID, err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+	case stripe.EventTypeCheckoutSessionCompleted,
+		stripe.EventTypeCheckoutSessionAsyncPaymentSucceeded,
+		stripe.EventTypeCheckoutSessionAsyncPaymentFailed,
+		stripe.EventTypeCheckoutSessionExpired:
+		cs, err := payments.Stripe().ParseCheckoutSession(event.Payload)
+		if err != nil {
+			log.Printf("解析Webhook事件失败 (%s): %v", event.ID, err)
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		if err := handleCheckoutSessionEvent(eventType, cs); err != nil {
+			log.Printf("处理Webhook事件失败 (%s, %s): %v", event.Type, cs.ID, err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+	case stripe.EventTypeChargeRefunded:
+		var ch stripe.Charge
+		if err := json.Unmarshal(event.Payload, &ch); err != nil {
+			log.Printf("解析Webhook事件失败 (%s): %v", event.ID, err)
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		if ch.PaymentIntent == nil {
+			log.Printf("退款的支付记录没有关联PaymentIntent, 跳过: %s", ch.ID)
+			break
+		}
+		log.Printf("Webhook: 退款 %s, 累计退款 %d/%d", ch.PaymentIntent.ID, ch.AmountRefunded, ch.Amount)
+		// 订阅账单的退款按账单ID扣回积分
+		orderID, err := refunds.ResolveOrderID(ch.PaymentIntent.ID, payments.Stripe().InvoiceForPayment)
+		if err != nil {
+			log.Printf("处理退款失败 (%s): %v", ch.PaymentIntent.ID, err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		if err := refunds.Apply(orderID, ch.Amount, ch.AmountRefunded, refunds.SourceWebhook); err != nil {
+			log.Printf("处理退款失败 (%s): %v", orderID, err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+	case stripe.EventTypeInvoicePaid:
+		inv, err := payments.Stripe().ParseInvoice(event.Payload)
+		if err != nil {
+			log.Printf("解析Webhook事件失败 (%s): %v", event.ID, err)
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		log.Printf("Webhook: 账单已支付 %s", inv.ID)
+		if _, err := subscriptions.GrantInvoice(inv); err != nil {
+			log.Printf("发放订阅账单积分失败 (%s): %v", inv.ID, err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+	case stripe.EventTypeCustomerSubscriptionCreated,
+		stripe.EventTypeCustomerSubscriptionUpdated,
+		stripe.EventTypeCustomerSubscriptionDeleted:
+		sub, err := payments.Stripe().ParseSubscription(event.Payload)
+		if err != nil {
+			log.Printf("解析Webhook事件失败 (%s): %v", event.ID, err)
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		// 每个事件都带有订阅的完整状态, 直接覆盖本地记录, 已结束的订阅不再更新
+		log.Printf("Webhook: 订阅 %s 状态为 %s", sub.ID, sub.Status)
+		if err := subscriptions.Sync(sub); err != nil {
+			log.Printf("同步订阅状态失败 (%s): %v", sub.ID, err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+	default:
+		log.Printf("忽略未处理的Webhook事件: %s", event.Type)
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// handlePaymentIntentEvent 根据PaymentIntent事件更新本地订单
+func handlePaymentIntentEvent(eventType stripe.EventType, pi payments.Payment) error {
+	switch eventType {
+	case stripe.EventTypePaymentIntentSucceeded:
+		log.Printf("Webhook: 支付成功 %s", pi.ID)
+		_, err := fulfillPayment(pi, database.OrderActorWebhook)
+		return err
+	case stripe.EventTypePaymentIntentCanceled:
+		log.Printf("Webhook: 支付已取消 %s", pi.ID)
+		return ignoreIllegalTransition(database.TransitionOrderStatus(pi.ID, database.OrderCanceled, database.OrderActorWebhook, string(eventType)))
+	case stripe.EventTypePaymentIntentPaymentFailed:
+		// 支付失败后用户仍可在同一个PaymentIntent上重试, 因此订单不是终态
+		log.Printf("Webhook: 支付失败 %s: %s", pi.ID, pi.LastError)
+		return ignoreIllegalTransition(database.TransitionOrderStatus(pi.ID, database.OrderPaymentFailed, database.OrderActorWebhook, pi.LastError))
+	}
+	return nil
+}
+
+// handleCheckoutSessionEvent 根据Checkout Session事件更新本地订单
+// 支付完成后订单改用PaymentIntent ID, 之后与普通订单共用发放流程
+func handleCheckoutSessionEvent(eventType stripe.EventType, cs payments.CheckoutSession) error {
+	switch eventType {
+	case stripe.EventTypeCheckoutSessionCompleted, stripe.EventTypeCheckoutSessionAsyncPaymentSucceeded:
+		log.Printf("Webhook: Checkout Session %s 已完成, 支付状态 %s", cs.ID, cs.PaymentStatus)
+		_, err := completeCheckoutSession(cs, database.OrderActorWebhook)
+		return err
+	case stripe.EventTypeCheckoutSessionAsyncPaymentFailed:
+		log.Printf("Webhook: Checkout Session %s 异步支付失败", cs.ID)
+		if _, err := completeCheckoutSession(cs, database.OrderActorWebhook); err != nil {
+			return err
+		}
+		if cs.PaymentIntentID == "" {
+			return nil
+		}
+		return ignoreIllegalTransition(database.TransitionOrderStatus(cs.PaymentIntentID, database.OrderPaymentFailed, database.OrderActorWebhook, string(eventType)))
+	case stripe.EventTypeCheckoutSessionExpired:
+		log.Printf("Webhook: Checkout Session已过期 %s", cs.ID)
+		return ignoreIllegalTransition(database.TransitionOrderStatus(cs.ID, database.OrderCanceled, database.OrderActorWebhook, string(eventType)))
+	}
+	return nil
+}
+
+// ignoreIllegalTransition 忽略乱序到达的事件造成的非法状态变更, 例如已支付的订单又收到支付失败事件
+// 不是由本程序创建的PaymentIntent没有对应的订单, 同样忽略
+func ignoreIllegalTransition(err error) error {
+	if errors.Is(err, database.ErrIllegalTransition) || database.IsNotFound(err) {
+		log.Printf("Webhook: 忽略订单状态变更: %v", err)
+		return nil
+	}
+	return err
+}